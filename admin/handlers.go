@@ -0,0 +1,99 @@
+package admin
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/rorycl/XeroOauthTokenServer/token"
+)
+
+// signInTemplate is the administrator sign in page
+var signInTemplate = template.Must(template.New("signin").Parse(`
+	<html><title>XeroOauthTokenServer sign in</title>
+	<style>
+	p.error { color: red }
+	body { margin: 5% }
+	label { display: inline-block; margin-bottom: 4px; width: 120px }
+	</style>
+	<body>
+	<h3>XeroOauthTokenServer Sign In</h3>
+	<p>Sign in with your administrator account to manage the token server.</p>
+	{{ if .Error }}<p class="error">Error: {{ .Error }}</p>{{ end }}
+	{{ if .Passwords }}
+    <form method="POST" action="/signin">
+        <input type="hidden" name="next" value="{{ .Next }}">
+        <input type="hidden" name="csrf_token" value="{{ .CSRF }}">
+        <label>Username:</label>
+        <input size=32 type="text" name="username"><br />
+        <label>Password:</label>
+        <input size=32 type="password" name="password"><br />
+        <input type="submit" value="Sign in">
+    </form>
+	{{ end }}
+	{{ if .SSO }}
+	<p><a href="/signin/xero?next={{ .Next }}">Sign in with Xero</a></p>
+	{{ end }}
+	</body>
+	</html>
+	`))
+
+// HandleSignIn shows the sign in page and, on a POST, verifies the
+// administrator's credentials and starts a session before redirecting
+// to the "next" page
+func (s *Sessions) HandleSignIn(w http.ResponseWriter, r *http.Request) {
+
+	data := struct {
+		Error     string
+		Next      string
+		Passwords bool
+		SSO       bool
+		CSRF      string
+	}{
+		Next:      safeNext(r.FormValue("next")),
+		Passwords: s.users != nil,
+		SSO:       s.sso,
+	}
+
+	if r.Method == http.MethodPost {
+		username := r.PostFormValue("username")
+		if s.users != nil && s.users.Verify(username, r.PostFormValue("password")) {
+			if _, err := s.Create(w, username); err != nil {
+				s.logger().Error("session creation failed", "error", err)
+				http.Error(w, "session creation failed", http.StatusInternalServerError)
+				return
+			}
+			s.logger().Info("admin signed in", "user", username, "remote", r.RemoteAddr)
+			s.record(r, "signin", username, http.StatusFound)
+			http.Redirect(w, r, data.Next, http.StatusFound)
+			return
+		}
+		s.logger().Warn("admin sign in failed", "user", username, "remote", r.RemoteAddr)
+		s.record(r, "signin", username, http.StatusUnauthorized)
+		data.Error = "invalid username or password"
+		data.CSRF = token.CSRFToken(w, r, s.secure)
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+
+	if data.CSRF == "" {
+		data.CSRF = token.CSRFToken(w, r, s.secure)
+	}
+	if err := signInTemplate.Execute(w, data); err != nil {
+		s.logger().Error("sign in template error", "error", err)
+	}
+}
+
+// HandleSignOut ends the administrator's session on a POST and
+// redirects to the sign in page
+func (s *Sessions) HandleSignOut(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed; use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if sess, ok := s.Get(r); ok {
+		s.logger().Info("admin signed out", "user", sess.User, "remote", r.RemoteAddr)
+		s.record(r, "signout", sess.User, http.StatusFound)
+	}
+	s.Destroy(w, r)
+	http.Redirect(w, r, SignInPath, http.StatusFound)
+}
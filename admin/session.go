@@ -0,0 +1,218 @@
+package admin
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rorycl/XeroOauthTokenServer/token"
+)
+
+// CookieName is the name of the session cookie
+const CookieName = "xts_session"
+
+// DefaultSessionLifetime is the default lifetime of an admin session
+const DefaultSessionLifetime = 8 * time.Hour
+
+// SignInPath is the path of the sign in page
+const SignInPath = "/signin"
+
+// Session is an authenticated administrator session
+type Session struct {
+	ID      string
+	User    string
+	Expires time.Time
+}
+
+// Sessions is an in-memory store of administrator sessions, which
+// also provides the sign in and sign out handlers and middleware
+// gating pages on a valid session
+type Sessions struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+	users    *Users
+	lifetime time.Duration
+	secure   bool
+	sso      bool
+	slogger  *slog.Logger
+	audit    func(r *http.Request, endpoint string, status int)
+}
+
+// NewSessions returns a session store authenticating against users
+// (which may be nil if sessions are only created by another sign in
+// method). If lifetime is 0 DefaultSessionLifetime is used; secure
+// marks session cookies https only.
+func NewSessions(users *Users, lifetime time.Duration, secure bool) *Sessions {
+	if lifetime == 0 {
+		lifetime = DefaultSessionLifetime
+	}
+	return &Sessions{
+		sessions: map[string]*Session{},
+		users:    users,
+		lifetime: lifetime,
+		secure:   secure,
+	}
+}
+
+// SetLogger sets the structured logger used for sign in and sign out,
+// wrapping it in the token package's redaction layer. If SetLogger is
+// not called slog.Default() is used.
+func (s *Sessions) SetLogger(l *slog.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l == nil {
+		s.slogger = nil
+		return
+	}
+	s.slogger = slog.New(token.NewRedactHandler(l.Handler()))
+}
+
+// logger returns the logger set by SetLogger, falling back to a
+// redacting wrapper around slog.Default()
+func (s *Sessions) logger() *slog.Logger {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.slogger != nil {
+		return s.slogger
+	}
+	return slog.New(token.NewRedactHandler(slog.Default().Handler()))
+}
+
+// OnAudit sets a function called with each sign in attempt and sign
+// out, such as to record it in an audit log. The request carries the
+// administrator as its identity.
+func (s *Sessions) OnAudit(f func(r *http.Request, endpoint string, status int)) {
+	s.audit = f
+}
+
+// record reports a sign in or sign out by user, which is "" if the
+// user is not known, to the OnAudit function, if set
+func (s *Sessions) record(r *http.Request, endpoint, user string, status int) {
+	if s.audit == nil {
+		return
+	}
+	if user != "" {
+		r = r.WithContext(token.WithIdentity(r.Context(), "admin:"+user))
+	}
+	s.audit(r, endpoint, status)
+}
+
+// newSessionID returns a random session identifier
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Create starts a session for user and sets the session cookie on w
+func (s *Sessions) Create(w http.ResponseWriter, user string) (*Session, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	sess := &Session{ID: id, User: user, Expires: now.Add(s.lifetime)}
+
+	s.mu.Lock()
+	for k, v := range s.sessions {
+		if now.After(v.Expires) {
+			delete(s.sessions, k)
+		}
+	}
+	s.sessions[id] = sess
+	s.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    id,
+		Path:     "/",
+		Expires:  sess.Expires,
+		HttpOnly: true,
+		Secure:   s.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return sess, nil
+}
+
+// Get returns the valid session for the request, if any
+func (s *Sessions) Get(r *http.Request) (*Session, bool) {
+	c, err := r.Cookie(CookieName)
+	if err != nil || c.Value == "" {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[c.Value]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(sess.Expires) {
+		delete(s.sessions, c.Value)
+		return nil, false
+	}
+	return sess, true
+}
+
+// Destroy ends the session for the request and clears the cookie
+func (s *Sessions) Destroy(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(CookieName); err == nil {
+		s.mu.Lock()
+		delete(s.sessions, c.Value)
+		s.mu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   s.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Require wraps next so that it is only served to requests with a
+// valid session; other requests are redirected to the sign in page.
+// The session user is recorded as the request identity for auditing.
+func (s *Sessions) Require(next http.Handler) http.Handler {
+	return s.Or(next, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := SignInPath + "?next=" + url.QueryEscape(r.URL.RequestURI())
+		http.Redirect(w, r, target, http.StatusFound)
+	}))
+}
+
+// RequireAPI is as Require for json endpoints, rejecting requests
+// without a valid session with a 401 problem rather than a redirect
+func (s *Sessions) RequireAPI(next http.Handler) http.Handler {
+	return s.Or(next, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token.WriteProblem(w, http.StatusUnauthorized, token.ErrCodeUnauthorized, "an admin session is required")
+	}))
+}
+
+// Or serves next to requests with a valid session, and fallback to all
+// other requests
+func (s *Sessions) Or(next, fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess, ok := s.Get(r)
+		if !ok {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(token.WithIdentity(r.Context(), "admin:"+sess.User)))
+	})
+}
+
+// safeNext returns next if it is a local path, otherwise "/"
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
@@ -0,0 +1,194 @@
+package admin
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rorycl/XeroOauthTokenServer/token"
+)
+
+// signIn posts credentials to the sign in handler, returning the
+// response
+func signIn(s *Sessions, username, password, next string) *http.Response {
+	form := url.Values{}
+	form.Add("username", username)
+	form.Add("password", password)
+	form.Add("next", next)
+	req := httptest.NewRequest("POST", "http://127.0.0.1:5001/signin", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	s.HandleSignIn(w, req)
+	return w.Result()
+}
+
+// sessionCookie returns the session cookie set by resp, or nil
+func sessionCookie(resp *http.Response) *http.Cookie {
+	for _, c := range resp.Cookies() {
+		if c.Name == CookieName {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestSignIn(t *testing.T) {
+	s := NewSessions(testUsers(t), 0, true)
+
+	resp := signIn(s, "alice", "wrong", "/home")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Status code %d != 401", resp.StatusCode)
+	}
+	if sessionCookie(resp) != nil {
+		t.Error("failed sign in should not set a session cookie")
+	}
+
+	resp = signIn(s, "alice", "alice-password", "/home")
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("Status code %d != 302", resp.StatusCode)
+	}
+	if loc := resp.Header.Get("Location"); loc != "/home" {
+		t.Errorf("redirect location want(/home) got(%s)", loc)
+	}
+	c := sessionCookie(resp)
+	if c == nil {
+		t.Fatalf("expected session cookie, got %v", resp.Cookies())
+	}
+	if !c.HttpOnly || !c.Secure || c.SameSite != http.SameSiteLaxMode {
+		t.Errorf("session cookie attributes incorrect %+v", c)
+	}
+}
+
+func TestSignInLogger(t *testing.T) {
+	s := NewSessions(testUsers(t), 0, true)
+	var buf bytes.Buffer
+	s.SetLogger(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	signIn(s, "alice", "wrong", "/home")
+	if !strings.Contains(buf.String(), "admin sign in failed") {
+		t.Errorf("sign in not logged to the configured logger: %s", buf.String())
+	}
+}
+
+func TestSignInOffsiteRedirect(t *testing.T) {
+	s := NewSessions(testUsers(t), 0, false)
+	resp := signIn(s, "bob", "bob-password", "//evil.example.com/")
+	if loc := resp.Header.Get("Location"); loc != "/" {
+		t.Errorf("redirect location want(/) got(%s)", loc)
+	}
+}
+
+func TestRequire(t *testing.T) {
+	s := NewSessions(testUsers(t), 50*time.Millisecond, false)
+
+	var identity string
+	handler := s.Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity = token.IdentityFromContext(r.Context())
+	}))
+
+	// no session
+	req := httptest.NewRequest("GET", "http://127.0.0.1:5001/home", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusFound || !strings.HasPrefix(w.Header().Get("Location"), SignInPath) {
+		t.Errorf("expected redirect to sign in, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+
+	// valid session
+	cookie := sessionCookie(signIn(s, "alice", "alice-password", "/home"))
+	req = httptest.NewRequest("GET", "http://127.0.0.1:5001/home", nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Status code %d != 200", w.Code)
+	}
+	if identity != "admin:alice" {
+		t.Errorf("identity want(admin:alice) got(%s)", identity)
+	}
+
+	// expired session
+	time.Sleep(60 * time.Millisecond)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusFound {
+		t.Errorf("expired session: Status code %d != 302", w.Code)
+	}
+}
+
+func TestRequireAPI(t *testing.T) {
+	s := NewSessions(testUsers(t), time.Minute, false)
+	handler := s.RequireAPI(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest("GET", "http://127.0.0.1:5001/api/v1/status", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("Content-Type") != token.ProblemContentType {
+		t.Errorf("expected a 401 problem, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	req.AddCookie(sessionCookie(signIn(s, "alice", "alice-password", "/")))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Status code %d != 200", w.Code)
+	}
+}
+
+func TestSignOut(t *testing.T) {
+	s := NewSessions(testUsers(t), 0, false)
+	cookie := sessionCookie(signIn(s, "alice", "alice-password", "/"))
+
+	req := httptest.NewRequest("POST", "http://127.0.0.1:5001/signout", nil)
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	s.HandleSignOut(w, req)
+	if w.Code != http.StatusFound {
+		t.Errorf("Status code %d != 302", w.Code)
+	}
+	if _, ok := s.Get(req); ok {
+		t.Error("session should be destroyed after sign out")
+	}
+}
+
+func TestSignInAudit(t *testing.T) {
+	s := NewSessions(testUsers(t), 0, false)
+	var got []string
+	s.OnAudit(func(r *http.Request, endpoint string, status int) {
+		got = append(got, fmt.Sprintf("%s %s %d", endpoint, token.IdentityFromContext(r.Context()), status))
+	})
+
+	signIn(s, "alice", "wrong", "/")
+	cookie := sessionCookie(signIn(s, "alice", "alice-password", "/"))
+	req := httptest.NewRequest("POST", "http://127.0.0.1:5001/signout", nil)
+	req.AddCookie(cookie)
+	s.HandleSignOut(httptest.NewRecorder(), req)
+
+	want := []string{"signin admin:alice 401", "signin admin:alice 302", "signout admin:alice 302"}
+	if !slices.Equal(got, want) {
+		t.Errorf("audit got %v want %v", got, want)
+	}
+}
+
+func TestSignOutRequiresPost(t *testing.T) {
+	s := NewSessions(testUsers(t), 0, false)
+	cookie := sessionCookie(signIn(s, "alice", "alice-password", "/"))
+
+	req := httptest.NewRequest("GET", "http://127.0.0.1:5001/signout", nil)
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	s.HandleSignOut(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Status code %d != 405", w.Code)
+	}
+	if _, ok := s.Get(req); !ok {
+		t.Error("session should survive a GET to sign out")
+	}
+}
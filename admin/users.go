@@ -0,0 +1,98 @@
+/*
+Package admin provides local administrator accounts and session based
+sign in for the token server's web user interface.
+
+Administrator accounts are configured in an htpasswd style file of
+bcrypt hashed passwords, one account per line, as
+
+	<username>:<bcrypt hash>
+
+which can be generated with "htpasswd -nB <username>". Blank lines and
+lines starting with "#" are ignored.
+*/
+package admin
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against when a username is unknown so that
+// sign in timing does not reveal which accounts exist; it is generated
+// on first use rather than when every importer starts
+var dummyHash = sync.OnceValue(func() []byte {
+	h, _ := bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	return h
+})
+
+// Users is a set of administrator accounts
+type Users struct {
+	hashes map[string][]byte
+}
+
+// ParseUsers reads administrator accounts from r
+func ParseUsers(r io.Reader) (*Users, error) {
+	u := &Users{hashes: map[string][]byte{}}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		name, hash, ok := strings.Cut(l, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("admin users line %d: expected <username>:<bcrypt hash>", line)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("admin users line %d: user %s: %w", line, name, err)
+		}
+		if _, exists := u.hashes[name]; exists {
+			return nil, fmt.Errorf("admin users line %d: duplicate user %s", line, name)
+		}
+		u.hashes[name] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// ParseUsersFile reads administrator accounts from the file at path
+func ParseUsersFile(path string) (*Users, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open admin users file: %w", err)
+	}
+	defer f.Close()
+	return ParseUsers(f)
+}
+
+// HashPassword returns a bcrypt hash of password suitable for the
+// users file
+func HashPassword(password string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(h), err
+}
+
+// Len returns the number of accounts
+func (u *Users) Len() int {
+	return len(u.hashes)
+}
+
+// Verify reports if password is correct for username
+func (u *Users) Verify(username, password string) bool {
+	hash, ok := u.hashes[username]
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
@@ -0,0 +1,72 @@
+package admin
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testUsers returns users "alice" and "bob" with passwords
+// "alice-password" and "bob-password"
+func testUsers(t *testing.T) *Users {
+	t.Helper()
+	var defs strings.Builder
+	defs.WriteString("# admin accounts\n\n")
+	for _, u := range []string{"alice", "bob"} {
+		h, err := bcrypt.GenerateFromPassword([]byte(u+"-password"), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defs.WriteString(u + ":" + string(h) + "\n")
+	}
+	users, err := ParseUsers(strings.NewReader(defs.String()))
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	return users
+}
+
+func TestParseUsers(t *testing.T) {
+	users := testUsers(t)
+	if users.Len() != 2 {
+		t.Errorf("expected 2 users, got %d", users.Len())
+	}
+	bad := []string{
+		"alice",
+		"alice:notahash",
+		":$2a$04$abcdefghijklmnopqrstuu",
+	}
+	for _, b := range bad {
+		if _, err := ParseUsers(strings.NewReader(b)); err == nil {
+			t.Errorf("expected error parsing %q", b)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	users := testUsers(t)
+	if !users.Verify("alice", "alice-password") {
+		t.Error("alice should verify")
+	}
+	if users.Verify("alice", "bob-password") {
+		t.Error("alice should not verify with bob's password")
+	}
+	if users.Verify("carol", "carol-password") {
+		t.Error("unknown user should not verify")
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	h, err := HashPassword("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := ParseUsers(strings.NewReader("dave:" + h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !users.Verify("dave", "s3cret") {
+		t.Error("hashed password should verify")
+	}
+}
@@ -0,0 +1,287 @@
+package admin
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rorycl/XeroOauthTokenServer/token"
+)
+
+// XeroIssuer is the issuer of Xero OpenID Connect id tokens
+const XeroIssuer = "https://identity.xero.com"
+
+// SSOStartPath and SSOCallbackPath are the paths of the "Sign in with
+// Xero" handlers
+const (
+	SSOStartPath    = "/signin/xero"
+	SSOCallbackPath = "/signin/xero/callback"
+)
+
+// ssoScopes are the scopes requested for administrator sign in; note
+// that offline_access is not requested, so the sign in never yields a
+// refresh token and is independent of the token served to consumers
+const ssoScopes = "openid profile email"
+
+// ssoStateLifetime is how long a sign in attempt may take
+const ssoStateLifetime = 10 * time.Minute
+
+// ssoState records a pending sign in attempt
+type ssoState struct {
+	nonce   string
+	next    string
+	expires time.Time
+}
+
+// idTokenClaims are the Xero id token claims used for sign in
+type idTokenClaims struct {
+	Issuer      string `json:"iss"`
+	Audience    string `json:"aud"`
+	Expiry      int64  `json:"exp"`
+	Nonce       string `json:"nonce"`
+	Subject     string `json:"sub"`
+	XeroUserID  string `json:"xero_userid"`
+	Email       string `json:"email"`
+	PreferredID string `json:"preferred_username"`
+}
+
+// XeroSSO provides "Sign in with Xero" for administrators using Xero's
+// OpenID Connect identity service, admitting only an allowlist of
+// Xero user ids or email addresses. It uses its own Xero app client
+// credentials, separate from those used for the token served to
+// consumers.
+//
+// The id token is received directly from the Xero token endpoint over
+// https using client authentication, so (per OpenID Connect Core
+// 3.1.3.7) its claims are validated but its signature is not checked.
+type XeroSSO struct {
+	clientID          string
+	clientSecret      string
+	redirectURL       string
+	authURL           string
+	tokenURL          string
+	issuer            string
+	allowed           map[string]bool
+	sessions          *Sessions
+	httpclientTimeout time.Duration
+	mu                sync.Mutex
+	states            map[string]ssoState
+}
+
+// NewXeroSSO returns a XeroSSO creating administrator sessions in
+// sessions for the Xero users whose user id or email address is in
+// allow
+func NewXeroSSO(clientID, clientSecret, redirectURL string, allow []string, sessions *Sessions) (*XeroSSO, error) {
+	if clientID == "" || clientSecret == "" {
+		return nil, errors.New("xero sign in requires a client id and secret")
+	}
+	if _, err := url.ParseRequestURI(redirectURL); err != nil {
+		return nil, errors.New("xero sign in redirect url invalid")
+	}
+	if len(allow) == 0 {
+		return nil, errors.New("xero sign in requires at least one allowed user id or email")
+	}
+	x := &XeroSSO{
+		clientID:          clientID,
+		clientSecret:      clientSecret,
+		redirectURL:       redirectURL,
+		authURL:           token.XeroAuthURL,
+		tokenURL:          token.XeroTokenURL,
+		issuer:            XeroIssuer,
+		allowed:           map[string]bool{},
+		sessions:          sessions,
+		httpclientTimeout: time.Second * 3,
+		states:            map[string]ssoState{},
+	}
+	for _, a := range allow {
+		x.allowed[strings.ToLower(strings.TrimSpace(a))] = true
+	}
+	sessions.sso = true
+	return x, nil
+}
+
+// HandleStart redirects the administrator to Xero to sign in
+func (x *XeroSSO) HandleStart(w http.ResponseWriter, r *http.Request) {
+	state, err := newSessionID()
+	if err != nil {
+		http.Error(w, "could not start sign in", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := newSessionID()
+	if err != nil {
+		http.Error(w, "could not start sign in", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	x.mu.Lock()
+	for k, v := range x.states {
+		if now.After(v.expires) {
+			delete(x.states, k)
+		}
+	}
+	x.states[state] = ssoState{
+		nonce:   nonce,
+		next:    safeNext(r.URL.Query().Get("next")),
+		expires: now.Add(ssoStateLifetime),
+	}
+	x.mu.Unlock()
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", x.clientID)
+	q.Set("redirect_uri", x.redirectURL)
+	q.Set("scope", ssoScopes)
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	http.Redirect(w, r, x.authURL+"?"+q.Encode(), http.StatusFound)
+}
+
+// HandleCallback receives the authorization code from Xero, exchanges
+// it for an id token and, if the user is allowed, starts a session
+func (x *XeroSSO) HandleCallback(w http.ResponseWriter, r *http.Request) {
+
+	if e := r.URL.Query().Get("error"); e != "" {
+		x.sessions.logger().Warn("xero sign in refused", "error", e, "remote", r.RemoteAddr)
+		http.Error(w, "xero sign in was not completed", http.StatusForbidden)
+		return
+	}
+
+	x.mu.Lock()
+	st, ok := x.states[r.URL.Query().Get("state")]
+	delete(x.states, r.URL.Query().Get("state"))
+	x.mu.Unlock()
+	if !ok || time.Now().After(st.expires) {
+		http.Error(w, "unknown or expired sign in state", http.StatusForbidden)
+		return
+	}
+
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		http.Error(w, "no code to extract", http.StatusForbidden)
+		return
+	}
+
+	claims, err := x.exchange(code)
+	if err != nil {
+		x.sessions.logger().Error("xero sign in exchange failed", "error", err)
+		http.Error(w, "xero sign in failed", http.StatusBadGateway)
+		return
+	}
+	if err := x.validate(claims, st.nonce); err != nil {
+		x.sessions.logger().Warn("xero sign in id token invalid", "error", err, "remote", r.RemoteAddr)
+		x.sessions.record(r, "signin/xero", "", http.StatusForbidden)
+		http.Error(w, "xero sign in failed", http.StatusForbidden)
+		return
+	}
+
+	user, ok := x.allowedUser(claims)
+	if !ok {
+		x.sessions.logger().Warn("xero sign in not allowed", "xero_userid", claims.XeroUserID, "email", claims.Email, "remote", r.RemoteAddr)
+		x.sessions.record(r, "signin/xero", user, http.StatusForbidden)
+		http.Error(w, "this xero user is not permitted to administer the server", http.StatusForbidden)
+		return
+	}
+
+	if _, err := x.sessions.Create(w, user); err != nil {
+		x.sessions.logger().Error("session creation failed", "error", err)
+		http.Error(w, "session creation failed", http.StatusInternalServerError)
+		return
+	}
+	x.sessions.logger().Info("admin signed in with xero", "user", user, "remote", r.RemoteAddr)
+	x.sessions.record(r, "signin/xero", user, http.StatusFound)
+	http.Redirect(w, r, st.next, http.StatusFound)
+}
+
+// exchange swaps an authorization code for the id token claims
+func (x *XeroSSO) exchange(code string) (*idTokenClaims, error) {
+	form := url.Values{}
+	form.Add("grant_type", "authorization_code")
+	form.Add("code", code)
+	form.Add("redirect_uri", x.redirectURL)
+	req, err := http.NewRequest("POST", x.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(x.clientID), url.QueryEscape(x.clientSecret))
+
+	client := http.Client{
+		Timeout: x.httpclientTimeout,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("token endpoint returned %d: %s", resp.StatusCode, token.Redact(string(body)))
+	}
+
+	var results struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, fmt.Errorf("json decoding error: %s", err)
+	}
+	if results.IDToken == "" {
+		return nil, errors.New("no id token received")
+	}
+	return decodeIDToken(results.IDToken)
+}
+
+// decodeIDToken decodes the claims of a compact serialised jwt
+func decodeIDToken(idToken string) (*idTokenClaims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("id token is not a jwt")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("id token payload decoding error: %s", err)
+	}
+	var claims idTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("id token claims decoding error: %s", err)
+	}
+	return &claims, nil
+}
+
+// validate checks the issuer, audience, expiry and nonce of the claims
+func (x *XeroSSO) validate(c *idTokenClaims, nonce string) error {
+	switch {
+	case c.Issuer != x.issuer:
+		return fmt.Errorf("unexpected issuer %s", c.Issuer)
+	case c.Audience != x.clientID:
+		return fmt.Errorf("unexpected audience %s", c.Audience)
+	case time.Now().Unix() > c.Expiry:
+		return errors.New("id token has expired")
+	case c.Nonce != nonce:
+		return errors.New("nonce mismatch")
+	}
+	return nil
+}
+
+// allowedUser returns the session user name for the Xero user, and
+// whether their user id or email is in the allowlist
+func (x *XeroSSO) allowedUser(c *idTokenClaims) (string, bool) {
+	user := "xero:" + c.XeroUserID
+	if c.Email != "" {
+		user = "xero:" + c.Email
+	}
+	for _, id := range []string{c.XeroUserID, c.Email} {
+		if id != "" && x.allowed[strings.ToLower(id)] {
+			return user, true
+		}
+	}
+	return user, false
+}
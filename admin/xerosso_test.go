@@ -0,0 +1,160 @@
+package admin
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeIDToken returns an unsigned jwt with the given claims
+func fakeIDToken(claims map[string]interface{}) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	j, _ := json.Marshal(claims)
+	return header + "." + base64.RawURLEncoding.EncodeToString(j) + ".c2lnbmF0dXJl"
+}
+
+// ssoSignIn runs the start and callback handlers against a fake token
+// endpoint issuing an id token with the claims returned by claimsFn,
+// returning the callback response
+func ssoSignIn(t *testing.T, x *XeroSSO, claimsFn func(nonce string) map[string]interface{}) *http.Response {
+	t.Helper()
+
+	var nonce string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("code") != "abc" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"id_token": "` + fakeIDToken(claimsFn(nonce)) + `", "access_token": "xyz", "expires_in": 1800}`))
+	}))
+	t.Cleanup(server.Close)
+	x.tokenURL = server.URL
+
+	req := httptest.NewRequest("GET", "http://127.0.0.1:5001/signin/xero?next=/home", nil)
+	w := httptest.NewRecorder()
+	x.HandleStart(w, req)
+	if w.Code != http.StatusFound {
+		t.Fatalf("start: Status code %d != 302", w.Code)
+	}
+	loc, _ := url.Parse(w.Header().Get("Location"))
+	q := loc.Query()
+	if q.Get("scope") != ssoScopes || strings.Contains(q.Get("scope"), "offline_access") {
+		t.Errorf("unexpected scopes %s", q.Get("scope"))
+	}
+	nonce = q.Get("nonce")
+
+	req = httptest.NewRequest("GET", "http://127.0.0.1:5001/signin/xero/callback?code=abc&state="+q.Get("state"), nil)
+	w = httptest.NewRecorder()
+	x.HandleCallback(w, req)
+	return w.Result()
+}
+
+func newTestSSO(t *testing.T) *XeroSSO {
+	t.Helper()
+	x, err := NewXeroSSO(
+		"KW6U8N4BFJ6TJ7W8R2VAHOTD04T4FP0V",
+		"4NmyKEKLGI71pdSQ6xfLGZwoLoDY4Zr4joRjuA5JPxxS3Z7A",
+		"http://localhost:5001/signin/xero/callback",
+		[]string{"ops@example.com", "9b3c2e4a-0d7e-4c55-8a2f-0d1e5c9f6a11"},
+		NewSessions(nil, 0, false),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return x
+}
+
+func claims(nonce, userID, email string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":         XeroIssuer,
+		"aud":         "KW6U8N4BFJ6TJ7W8R2VAHOTD04T4FP0V",
+		"exp":         time.Now().Add(5 * time.Minute).Unix(),
+		"nonce":       nonce,
+		"xero_userid": userID,
+		"email":       email,
+	}
+}
+
+func TestXeroSSOAllowed(t *testing.T) {
+	x := newTestSSO(t)
+	resp := ssoSignIn(t, x, func(nonce string) map[string]interface{} {
+		return claims(nonce, "0c0c0c0c-0000-0000-0000-000000000000", "OPS@example.com")
+	})
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/home" {
+		t.Fatalf("expected redirect to /home, got %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	cookie := sessionCookie(resp)
+	if cookie == nil {
+		t.Fatalf("expected session cookie, got %v", resp.Cookies())
+	}
+	req := httptest.NewRequest("GET", "http://127.0.0.1:5001/home", nil)
+	req.AddCookie(cookie)
+	sess, ok := x.sessions.Get(req)
+	if !ok || sess.User != "xero:OPS@example.com" {
+		t.Errorf("unexpected session %+v", sess)
+	}
+}
+
+func TestXeroSSOAllowedByUserID(t *testing.T) {
+	x := newTestSSO(t)
+	resp := ssoSignIn(t, x, func(nonce string) map[string]interface{} {
+		return claims(nonce, "9b3c2e4a-0d7e-4c55-8a2f-0d1e5c9f6a11", "")
+	})
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("Status code %d != 302", resp.StatusCode)
+	}
+}
+
+func TestXeroSSORejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims func(nonce string) map[string]interface{}
+	}{
+		{"not_allowed", func(n string) map[string]interface{} { return claims(n, "x", "someone@example.com") }},
+		{"bad_nonce", func(n string) map[string]interface{} { return claims("other", "x", "ops@example.com") }},
+		{"bad_audience", func(n string) map[string]interface{} {
+			c := claims(n, "x", "ops@example.com")
+			c["aud"] = "another-app"
+			return c
+		}},
+		{"expired", func(n string) map[string]interface{} {
+			c := claims(n, "x", "ops@example.com")
+			c["exp"] = time.Now().Add(-time.Minute).Unix()
+			return c
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x := newTestSSO(t)
+			var audited []int
+			x.sessions.OnAudit(func(r *http.Request, endpoint string, status int) {
+				audited = append(audited, status)
+			})
+			resp := ssoSignIn(t, x, tt.claims)
+			if resp.StatusCode != http.StatusForbidden {
+				t.Errorf("Status code %d != 403", resp.StatusCode)
+			}
+			if len(audited) != 1 || audited[0] != http.StatusForbidden {
+				t.Errorf("expected one denied sign in audit, got %v", audited)
+			}
+			if sessionCookie(resp) != nil {
+				t.Error("rejected sign in should not set a session cookie")
+			}
+		})
+	}
+}
+
+func TestXeroSSOUnknownState(t *testing.T) {
+	x := newTestSSO(t)
+	req := httptest.NewRequest("GET", "http://127.0.0.1:5001/signin/xero/callback?code=abc&state=forged", nil)
+	w := httptest.NewRecorder()
+	x.HandleCallback(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Status code %d != 403", w.Code)
+	}
+}
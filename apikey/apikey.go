@@ -0,0 +1,234 @@
+/*
+Package apikey provides named, hashed api keys for authenticating
+consumers of the token server.
+
+Keys are presented as bearer tokens in the Authorization header. Only
+the sha256 hash of each key is configured, one key per line, as
+
+	<name> sha256:<hex digest> <permission>[,<permission>...]
+
+Blank lines and lines starting with "#" are ignored.
+*/
+package apikey
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/rorycl/XeroOauthTokenServer/token"
+)
+
+// Permissions which may be granted to a key
+const (
+	TokenRead   = "token:read"
+	StatusRead  = "status:read"
+	Refresh     = "refresh"
+	Revoke      = "revoke"
+	TenantsRead = "tenants:read"
+)
+
+// permissions is the set of valid permissions
+var permissions = map[string]bool{
+	TokenRead:   true,
+	StatusRead:  true,
+	Refresh:     true,
+	Revoke:      true,
+	TenantsRead: true,
+}
+
+// hashPrefix identifies the hashing scheme of a configured key
+const hashPrefix = "sha256:"
+
+// Key is a named api key, stored as a hash, with its permissions
+type Key struct {
+	Name        string
+	Hash        string
+	Permissions []string
+}
+
+// Can reports if the key has been granted permission
+func (k *Key) Can(permission string) bool {
+	for _, p := range k.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Keys is a set of api keys
+type Keys struct {
+	keys   []Key
+	denied func(r *http.Request, status int)
+}
+
+// HashKey returns the configuration form of the hash of key
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hashPrefix + hex.EncodeToString(sum[:])
+}
+
+// Generate returns a new random api key
+func Generate() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Parse reads key definitions from r
+func Parse(r io.Reader) (*Keys, error) {
+	ks := &Keys{}
+	names := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		k, err := parseKey(l)
+		if err != nil {
+			return nil, fmt.Errorf("api key line %d: %w", line, err)
+		}
+		if names[k.Name] {
+			return nil, fmt.Errorf("api key line %d: duplicate key name %s", line, k.Name)
+		}
+		names[k.Name] = true
+		ks.keys = append(ks.keys, k)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// ParseFile reads key definitions from the file at path
+func ParseFile(path string) (*Keys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open api keys file: %w", err)
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// ParseEnv reads key definitions from an environment variable value in
+// which definitions are separated by ";"
+func ParseEnv(s string) (*Keys, error) {
+	return Parse(strings.NewReader(strings.ReplaceAll(s, ";", "\n")))
+}
+
+// parseKey parses a single key definition
+func parseKey(l string) (Key, error) {
+	fields := strings.Fields(l)
+	if len(fields) != 3 {
+		return Key{}, fmt.Errorf("expected <name> <hash> <permissions>, got %d fields", len(fields))
+	}
+	name, hash, perms := fields[0], fields[1], fields[2]
+	if !strings.HasPrefix(hash, hashPrefix) {
+		return Key{}, fmt.Errorf("key %s hash must start with %q", name, hashPrefix)
+	}
+	digest, err := hex.DecodeString(strings.TrimPrefix(hash, hashPrefix))
+	if err != nil || len(digest) != sha256.Size {
+		return Key{}, fmt.Errorf("key %s hash is not a valid sha256 hex digest", name)
+	}
+	k := Key{Name: name, Hash: strings.ToLower(hash)}
+	for _, p := range strings.Split(perms, ",") {
+		if !permissions[p] {
+			return Key{}, fmt.Errorf("key %s has unknown permission %q", name, p)
+		}
+		k.Permissions = append(k.Permissions, p)
+	}
+	return k, nil
+}
+
+// Len returns the number of keys
+func (ks *Keys) Len() int {
+	return len(ks.keys)
+}
+
+// Merge adds the keys in other to ks, rejecting duplicate names
+func (ks *Keys) Merge(other *Keys) error {
+	for _, o := range other.keys {
+		for _, k := range ks.keys {
+			if k.Name == o.Name {
+				return fmt.Errorf("duplicate key name %s", o.Name)
+			}
+		}
+		ks.keys = append(ks.keys, o)
+	}
+	return nil
+}
+
+// Authenticate returns the key matching the presented secret
+func (ks *Keys) Authenticate(secret string) (*Key, bool) {
+	if secret == "" {
+		return nil, false
+	}
+	hash := []byte(HashKey(secret))
+	var found *Key
+	for i := range ks.keys {
+		// compare every key to avoid leaking which keys exist by timing
+		if subtle.ConstantTimeCompare(hash, []byte(ks.keys[i].Hash)) == 1 {
+			found = &ks.keys[i]
+		}
+	}
+	return found, found != nil
+}
+
+// bearer extracts a bearer token from the Authorization header
+func bearer(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(h[7:])
+}
+
+// OnDenied sets a function called with each request rejected by
+// Require and its status, such as to audit the attempt. The request
+// carries the key name as its identity if a valid key lacked the
+// permission.
+func (ks *Keys) OnDenied(f func(r *http.Request, status int)) {
+	ks.denied = f
+}
+
+// Require wraps next so that it may only be called with a key granted
+// permission. The key name is recorded as the request identity for
+// auditing.
+func (ks *Keys) Require(permission string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := ks.Authenticate(bearer(r))
+		if !ok {
+			ks.deny(r, http.StatusUnauthorized)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="xerooauthtokenserver"`)
+			token.WriteProblem(w, http.StatusUnauthorized, token.ErrCodeUnauthorized, "a valid api key is required")
+			return
+		}
+		if !key.Can(permission) {
+			ks.deny(r.WithContext(token.WithIdentity(r.Context(), key.Name)), http.StatusForbidden)
+			token.WriteProblem(w, http.StatusForbidden, token.ErrCodeForbidden, fmt.Sprintf("api key %s lacks permission %s", key.Name, permission))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(token.WithIdentity(r.Context(), key.Name)))
+	})
+}
+
+// deny reports a rejected request to the OnDenied function, if set
+func (ks *Keys) deny(r *http.Request, status int) {
+	if ks.denied != nil {
+		ks.denied(r, status)
+	}
+}
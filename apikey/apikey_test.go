@@ -0,0 +1,123 @@
+package apikey
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/rorycl/XeroOauthTokenServer/token"
+)
+
+func testKeys(t *testing.T) *Keys {
+	t.Helper()
+	defs := `
+# consumer keys
+etl    ` + HashKey("etl-secret") + `    token:read,tenants:read
+admin  ` + HashKey("admin-secret") + `  token:read,status:read,refresh,revoke
+`
+	keys, err := Parse(strings.NewReader(defs))
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	return keys
+}
+
+func TestParse(t *testing.T) {
+	keys := testKeys(t)
+	if keys.Len() != 2 {
+		t.Errorf("expected 2 keys, got %d", keys.Len())
+	}
+
+	bad := []string{
+		"etl sha256:abc token:read",
+		"etl " + HashKey("x") + " token:write",
+		"etl " + HashKey("x"),
+		"etl md5:abc token:read",
+		"etl " + HashKey("x") + " token:read\netl " + HashKey("y") + " token:read",
+	}
+	for _, b := range bad {
+		if _, err := Parse(strings.NewReader(b)); err == nil {
+			t.Errorf("expected error parsing %q", b)
+		}
+	}
+}
+
+func TestParseEnvMerge(t *testing.T) {
+	keys := testKeys(t)
+	env, err := ParseEnv("ci " + HashKey("ci-secret") + " token:read;cron " + HashKey("cron-secret") + " refresh")
+	if err != nil {
+		t.Fatalf("parse env error: %s", err)
+	}
+	if err := keys.Merge(env); err != nil {
+		t.Fatalf("merge error: %s", err)
+	}
+	if keys.Len() != 4 {
+		t.Errorf("expected 4 keys, got %d", keys.Len())
+	}
+	if err := keys.Merge(env); err == nil {
+		t.Error("expected duplicate name error")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	keys := testKeys(t)
+	k, ok := keys.Authenticate("etl-secret")
+	if !ok || k.Name != "etl" {
+		t.Errorf("expected etl key, got %v %v", k, ok)
+	}
+	if _, ok := keys.Authenticate("wrong"); ok {
+		t.Error("wrong key authenticated")
+	}
+	if _, ok := keys.Authenticate(""); ok {
+		t.Error("empty key authenticated")
+	}
+}
+
+func TestRequire(t *testing.T) {
+	keys := testKeys(t)
+
+	var identity string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity = token.IdentityFromContext(r.Context())
+	})
+	handler := keys.Require(Revoke, next)
+	var denied []string
+	keys.OnDenied(func(r *http.Request, status int) {
+		denied = append(denied, fmt.Sprintf("%d %s", status, token.IdentityFromContext(r.Context())))
+	})
+
+	tests := []struct {
+		name   string
+		auth   string
+		status int
+	}{
+		{"no_key", "", 401},
+		{"bad_key", "Bearer nope", 401},
+		{"not_bearer", "Basic admin-secret", 401},
+		{"no_permission", "Bearer etl-secret", 403},
+		{"ok", "Bearer admin-secret", 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://127.0.0.1:5001/revoke", nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Errorf("Status code %d != %d", w.Code, tt.status)
+			}
+		})
+	}
+	if identity != "admin" {
+		t.Errorf("identity want(admin) got(%s)", identity)
+	}
+	want := []string{"401 ", "401 ", "401 ", "403 etl"}
+	if !slices.Equal(denied, want) {
+		t.Errorf("denied want(%q) got(%q)", want, denied)
+	}
+}
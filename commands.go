@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"time"
+
+	flags "github.com/jessevdk/go-flags"
+	"github.com/rorycl/XeroOauthTokenServer/token"
+	"github.com/rorycl/XeroOauthTokenServer/tokenclient"
+)
+
+// addCommands adds the serve and login commands and the commands calling
+// a running server to parser; options are the top-level options they
+// share
+func addCommands(parser *flags.Parser, options *Opts) {
+	commands := []struct {
+		name, short, long string
+		data              any
+	}{
+		{"serve", "run the token server",
+			"Run the token server. This is the default if no command is given.",
+			&serveCommand{opts: options}},
+		{"login", "log in to Xero and save the token",
+			"Log in to Xero from the command line, catching the redirect with a temporary listener on the loopback --redirect address, and save the token to the state file for the server to load.",
+			&loginCommand{opts: options}},
+		{"token", "print the access token",
+			"Print the current access token from a running server or, with --fromstore, from the state file.",
+			&tokenCommand{opts: options}},
+		{"exec-credential", "print a valid access token as json",
+			"Print a valid access token with its expiry and tenant id as json, for tools which run a command to obtain a credential. Tokens are cached between invocations and refreshed when within the margin of expiry.",
+			&execCredentialCommand{opts: options}},
+		{"status", "print the token status",
+			"Print the token status json of a running server.",
+			&statusCommand{opts: options}},
+		{"refresh", "refresh the access token",
+			"Ask a running server to refresh the access token and print the new token.",
+			&refreshCommand{opts: options}},
+		{"revoke", "revoke the token",
+			"Ask a running server to revoke the token and its Xero connections. The server must be logged in again afterwards.",
+			&revokeCommand{opts: options}},
+		{"tenants", "print the tenants",
+			"Print the Xero tenants accessible with the token of a running server as json.",
+			&tenantsCommand{opts: options}},
+	}
+	for _, c := range commands {
+		if _, err := parser.AddCommand(c.name, c.short, c.long, c.data); err != nil {
+			panic(err) // the command definitions are invalid
+		}
+	}
+}
+
+// serveCommand runs the token server
+type serveCommand struct {
+	opts *Opts
+}
+
+// Execute serves
+func (c *serveCommand) Execute([]string) error {
+	serve(*c.opts)
+	return nil
+}
+
+// loginCommand logs in to Xero and saves the token to the state file
+type loginCommand struct {
+	ClientID string `long:"clientid" env:"XEROTOKENSERVER_CLIENT_ID" description:"xero app client id"`
+	Secret   string `long:"clientsecret" env:"XEROTOKENSERVER_CLIENT_SECRET" description:"xero app client secret"`
+	TenantID string `long:"tenantid" env:"XEROTOKENSERVER_TENANT_ID" description:"xero tenant id"`
+	Open     bool   `long:"open" description:"open the authorization url in a browser"`
+	WaitMins int    `long:"waitmins" description:"minutes to wait for consent" default:"5"`
+	opts     *Opts
+}
+
+// Execute logs in, the token being saved to the store by the login
+func (c *loginCommand) Execute([]string) error {
+	if c.opts.StateFile == "" {
+		return errors.New("login requires a state file (--statefile) to save the token to")
+	}
+	ts, err := token.NewToken(c.opts.Redirect, c.opts.Scopes, "", "", "", c.opts.RefreshMins)
+	if err != nil {
+		return err
+	}
+	defer stopToken(ts)
+	if err := ts.AddClientCredentials(c.ClientID, c.Secret, c.TenantID); err != nil {
+		return err
+	}
+	store := token.NewFileStore(c.opts.StateFile)
+	unlock, err := store.Lock("login")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	ts.SetStore(store)
+
+	ctx, cancel := commandContext()
+	defer cancel()
+	ctx, cancelWait := context.WithTimeout(ctx, time.Duration(c.WaitMins)*time.Minute)
+	defer cancelWait()
+	err = ts.LoginLoopback(ctx, func(authURL string) error {
+		fmt.Printf("Please go to the url below and log into Xero\n%s\n\n", authURL)
+		if c.Open {
+			if err := openBrowser(authURL); err != nil {
+				fmt.Fprintf(os.Stderr, "could not open a browser: %s\n", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Logged in; the token is saved to %s\n", c.opts.StateFile)
+	return nil
+}
+
+// stopToken stops the background refresher NewToken starts, for
+// commands which use a Token briefly. The store is unset first so that
+// the state file is only written by a login or refresh.
+func stopToken(ts *token.Token) {
+	ts.SetStore(nil)
+	ts.Shutdown(context.Background())
+}
+
+// openBrowser opens u in the desktop's browser
+func openBrowser(u string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", u)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", u)
+	default:
+		cmd = exec.Command("xdg-open", u)
+	}
+	return cmd.Start()
+}
+
+// clientOptions are the options of commands calling a running server
+type clientOptions struct {
+	Server string `long:"server" description:"url of the token server (default: the address and port, or socket, options)"`
+	APIKey string `long:"apikey" env:"XEROTOKENSERVER_APIKEY" description:"api key for a server requiring api keys"`
+}
+
+// client returns a client for the server at the --server url, or
+// otherwise at the socket or address and port the server is run with
+func (c clientOptions) client(opts *Opts) (*tokenclient.Client, error) {
+	var client *tokenclient.Client
+	var err error
+	switch {
+	case c.Server != "":
+		client, err = tokenclient.New(c.Server)
+	case opts.Socket != "":
+		client, err = tokenclient.NewUnix(opts.Socket)
+	default:
+		client, err = tokenclient.New("http://" + net.JoinHostPort(opts.Addr, opts.Port))
+	}
+	if err != nil {
+		return nil, err
+	}
+	client.SetAPIKey(c.APIKey)
+	return client, nil
+}
+
+// commandContext returns a context cancelled by SIGINT
+func commandContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+// tokenCommand prints the access token
+type tokenCommand struct {
+	clientOptions
+	JSON      bool `long:"json" description:"print the token with its generation, expiry and tenant id as json"`
+	FromStore bool `long:"fromstore" description:"read the token from the state file rather than a running server"`
+	opts      *Opts
+}
+
+// Execute prints the token
+func (c *tokenCommand) Execute([]string) error {
+	if c.FromStore {
+		t, err := storedToken(c.opts.StateFile)
+		if err != nil {
+			return err
+		}
+		return printToken(t, c.JSON)
+	}
+	client, err := c.client(c.opts)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := commandContext()
+	defer cancel()
+	t, err := client.Token(ctx)
+	if err != nil {
+		return err
+	}
+	return printToken(t, c.JSON)
+}
+
+// storedToken returns the unexpired access token saved in the state
+// file
+func storedToken(stateFile string) (*tokenclient.Token, error) {
+	if stateFile == "" {
+		return nil, errors.New("--fromstore requires a state file (--statefile)")
+	}
+	s, err := token.NewFileStore(stateFile).Load()
+	if err != nil {
+		return nil, err
+	}
+	if s == nil || s.AccessToken == "" {
+		return nil, fmt.Errorf("no access token saved in %s", stateFile)
+	}
+	if !time.Now().Before(s.AccessTokenExpiryUTC) {
+		return nil, fmt.Errorf("the access token saved in %s expired at %s", stateFile, s.AccessTokenExpiryUTC.Format(time.RFC3339))
+	}
+	return &tokenclient.Token{
+		AccessToken: s.AccessToken,
+		Expiry:      s.AccessTokenExpiryUTC,
+		TenantID:    s.TenantID,
+	}, nil
+}
+
+// statusCommand prints the token status
+type statusCommand struct {
+	clientOptions
+	opts *Opts
+}
+
+// Execute prints the status
+func (c *statusCommand) Execute([]string) error {
+	client, err := c.client(c.opts)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := commandContext()
+	defer cancel()
+	status, err := client.Status(ctx)
+	if err != nil {
+		return err
+	}
+	return printJSON(status)
+}
+
+// refreshCommand refreshes the access token
+type refreshCommand struct {
+	clientOptions
+	JSON bool `long:"json" description:"print the new token with its generation, expiry and tenant id as json"`
+	opts *Opts
+}
+
+// Execute refreshes the token and prints the new token
+func (c *refreshCommand) Execute([]string) error {
+	client, err := c.client(c.opts)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := commandContext()
+	defer cancel()
+	t, err := client.Refresh(ctx)
+	if err != nil {
+		return err
+	}
+	return printToken(t, c.JSON)
+}
+
+// revokeCommand revokes the token
+type revokeCommand struct {
+	clientOptions
+	opts *Opts
+}
+
+// Execute revokes the token
+func (c *revokeCommand) Execute([]string) error {
+	client, err := c.client(c.opts)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := commandContext()
+	defer cancel()
+	if err := client.Revoke(ctx); err != nil {
+		return err
+	}
+	fmt.Println("revoked")
+	return nil
+}
+
+// tenantsCommand prints the tenants
+type tenantsCommand struct {
+	clientOptions
+	opts *Opts
+}
+
+// Execute prints the tenants
+func (c *tenantsCommand) Execute([]string) error {
+	client, err := c.client(c.opts)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := commandContext()
+	defer cancel()
+	tenants, err := client.Tenants(ctx)
+	if err != nil {
+		return err
+	}
+	return printJSON(tenants)
+}
+
+// printToken prints the access token, or the token as json
+func printToken(t *tokenclient.Token, asJSON bool) error {
+	if asJSON {
+		return printJSON(t)
+	}
+	_, err := fmt.Println(t.AccessToken)
+	return err
+}
+
+// printJSON prints v as indented json
+func printJSON(v any) error {
+	j, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Printf("%s\n", j)
+	return err
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rorycl/XeroOauthTokenServer/token"
+)
+
+// credential is the json printed by the exec-credential command
+type credential struct {
+	AccessToken string    `json:"accessToken"`
+	TokenType   string    `json:"tokenType"`
+	Expiry      time.Time `json:"expiry"`
+	TenantID    string    `json:"tenantId"`
+}
+
+// valid reports if the credential is not within margin of expiry
+func (c *credential) valid(margin time.Duration) bool {
+	return c != nil && c.AccessToken != "" && time.Now().Add(margin).Before(c.Expiry)
+}
+
+// execCredentialCommand prints a valid access token as json for tools
+// which run a command to obtain a credential
+type execCredentialCommand struct {
+	clientOptions
+	FromStore  bool   `long:"fromstore" description:"use the token saved in the state file, refreshing it with Xero if needed, rather than a running server"`
+	MarginSecs int    `long:"marginsecs" description:"refresh tokens expiring within this many seconds" default:"60"`
+	CacheDir   string `long:"cachedir" description:"directory caching credentials between invocations (default: the user cache directory)"`
+	NoCache    bool   `long:"nocache" description:"do not cache credentials between invocations"`
+	opts       *Opts
+}
+
+// Execute prints the credential, from the cache if it holds one which
+// is not within the margin of expiry
+func (c *execCredentialCommand) Execute([]string) error {
+	margin := time.Duration(c.MarginSecs) * time.Second
+	source, err := c.source()
+	if err != nil {
+		return err
+	}
+	cache := c.cachePath(source)
+	if cred := readCredential(cache); cred.valid(margin) {
+		return printJSON(cred)
+	}
+
+	var cred *credential
+	if c.FromStore {
+		cred, err = storeCredential(c.opts, margin)
+	} else {
+		cred, err = c.serverCredential(margin)
+	}
+	if err != nil {
+		return err
+	}
+	if cache != "" {
+		if err := writeCredential(cache, cred); err != nil {
+			fmt.Fprintf(os.Stderr, "could not cache the credential: %s\n", err)
+		}
+	}
+	return printJSON(cred)
+}
+
+// source describes where credentials are obtained from, keying the
+// cache
+func (c *execCredentialCommand) source() (string, error) {
+	switch {
+	case c.FromStore:
+		if c.opts.StateFile == "" {
+			return "", errors.New("--fromstore requires a state file (--statefile)")
+		}
+		path, err := filepath.Abs(c.opts.StateFile)
+		return "file:" + path, err
+	case c.Server != "":
+		return c.Server, nil
+	case c.opts.Socket != "":
+		return "unix:" + c.opts.Socket, nil
+	default:
+		return "http://" + net.JoinHostPort(c.opts.Addr, c.opts.Port), nil
+	}
+}
+
+// cachePath returns the cache file for credentials from source, or ""
+// if caching is disabled or there is no cache directory
+func (c *execCredentialCommand) cachePath(source string) string {
+	if c.NoCache {
+		return ""
+	}
+	dir := c.CacheDir
+	if dir == "" {
+		d, err := os.UserCacheDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(d, "XeroOauthTokenServer")
+	}
+	sum := sha256.Sum256([]byte(source))
+	return filepath.Join(dir, "credential-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+// serverCredential returns the token of a running server, asking the
+// server to refresh it if it is within margin of expiry
+func (c *execCredentialCommand) serverCredential(margin time.Duration) (*credential, error) {
+	client, err := c.client(c.opts)
+	if err != nil {
+		return nil, err
+	}
+	client.SetExpiryMargin(margin)
+	ctx, cancel := commandContext()
+	defer cancel()
+	t, err := client.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Add(margin).Before(t.Expiry) {
+		if t, err = client.Refresh(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return &credential{
+		AccessToken: t.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      t.Expiry,
+		TenantID:    t.TenantID,
+	}, nil
+}
+
+// storeLockWait is how long exec-credential waits for another
+// invocation to finish with the state file
+const storeLockWait = 30 * time.Second
+
+// storeTokenURL is the url at which storeCredential refreshes tokens,
+// or "" for Xero's; it is set by tests
+var storeTokenURL string
+
+// storeCredential returns the token saved in the state file, refreshing
+// it with Xero and saving the new tokens if it is within margin of
+// expiry. The state file is locked throughout, since the refresh
+// rotates the refresh token, and a state file locked by a running
+// server is refused.
+func storeCredential(opts *Opts, margin time.Duration) (*credential, error) {
+	ts, err := token.NewToken(opts.Redirect, opts.Scopes, "", storeTokenURL, "", opts.RefreshMins)
+	if err != nil {
+		return nil, err
+	}
+	defer stopToken(ts)
+	logger, err := newLogger("warn", opts.LogFormat)
+	if err != nil {
+		return nil, err
+	}
+	ts.SetLogger(logger)
+	store := token.NewFileStore(opts.StateFile)
+	unlock, err := lockStore(store)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	ts.SetStore(store)
+	if err := ts.Load(); err != nil {
+		return nil, err
+	}
+	if state := ts.State(); state != token.StateActive {
+		return nil, fmt.Errorf("no usable token saved in %s (%s); log in with Xero again", opts.StateFile, state)
+	}
+	if !time.Now().Add(margin).Before(ts.AccessTokenExpiryUTC) {
+		// the refresh saves the rotated refresh token to the store
+		if err := ts.Refresh(); err != nil {
+			return nil, err
+		}
+	}
+	return &credential{
+		AccessToken: ts.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      ts.AccessTokenExpiryUTC,
+		TenantID:    ts.Snapshot().TenantID,
+	}, nil
+}
+
+// lockStore locks the state file, waiting up to storeLockWait for other
+// invocations but failing at once if a server holds it
+func lockStore(store *token.FileStore) (unlock func(), err error) {
+	deadline := time.Now().Add(storeLockWait)
+	for {
+		unlock, err = store.Lock("exec-credential")
+		var le *token.LockedError
+		switch {
+		case !errors.As(err, &le):
+			return unlock, err
+		case le.Owner == "server":
+			return nil, fmt.Errorf("%w; get the token from the server rather than with --fromstore", err)
+		case time.Now().After(deadline):
+			return nil, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// readCredential reads a cached credential, returning nil if there is
+// none
+func readCredential(path string) *credential {
+	if path == "" {
+		return nil
+	}
+	j, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var cred credential
+	if json.Unmarshal(j, &cred) != nil {
+		return nil
+	}
+	return &cred
+}
+
+// writeCredential caches cred in a file readable only by its owner
+func writeCredential(path string, cred *credential) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	j, err := json.Marshal(cred)
+	if err != nil {
+		return err
+	}
+	return token.WriteFileAtomic(path, j, 0600)
+}
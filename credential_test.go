@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rorycl/XeroOauthTokenServer/token"
+	"github.com/rorycl/XeroOauthTokenServer/xerotest"
+)
+
+// savedToken logs in to the fake Xero x and saves the token to a state
+// file, returning the options to use it and the saved access token
+func savedToken(t *testing.T, x *xerotest.Server) (*Opts, string) {
+	t.Helper()
+	opts := &Opts{
+		Redirect:    "http://localhost:5001/code",
+		Scopes:      []string{"offline_access"},
+		RefreshMins: 72000,
+		LogFormat:   "text",
+		StateFile:   filepath.Join(t.TempDir(), "state.json"),
+	}
+	ts, err := token.NewToken(opts.Redirect, opts.Scopes, x.AuthURL(), x.TokenURL(), x.ConnectionsURL(), opts.RefreshMins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stopToken(ts)
+	ts.SetStore(token.NewFileStore(opts.StateFile))
+	if err := simulateConsent(ts, x); err != nil {
+		t.Fatal(err)
+	}
+	return opts, ts.AccessToken
+}
+
+// stdout returns what f prints to stdout
+func stdout(t *testing.T, f func() error) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := os.Stdout
+	os.Stdout = w
+	err = f()
+	os.Stdout = orig
+	w.Close()
+	out, _ := io.ReadAll(r)
+	return string(out), err
+}
+
+func TestExecCredentialFromStore(t *testing.T) {
+	tests := []struct {
+		name       string
+		cached     string        // cached access token, if any
+		marginSecs int           // refresh tokens expiring within this
+		lockOwner  string        // owner of a lock held on the state file
+		release    time.Duration // when the lock is released
+		want       string        // "cached", "saved" or "refreshed"
+		wantErr    string
+	}{
+		{"cache_hit", "cached-token", 60, "", 0, "cached", ""},
+		{"saved_token", "", 60, "", 0, "saved", ""},
+		{"refresh_within_margin", "", 3600, "", 0, "refreshed", ""},
+		{"cache_within_margin", "cached-token", 3600, "", 0, "refreshed", ""},
+		{"lock_released", "", 60, "exec-credential", 200 * time.Millisecond, "saved", ""},
+		{"locked_by_server", "", 60, "server", 0, "", "get the token from the server"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x := xerotest.NewServer()
+			defer x.Close()
+			storeTokenURL = x.TokenURL()
+			defer func() { storeTokenURL = "" }()
+
+			opts, saved := savedToken(t, x)
+			c := &execCredentialCommand{
+				FromStore:  true,
+				MarginSecs: tt.marginSecs,
+				CacheDir:   t.TempDir(),
+				opts:       opts,
+			}
+			if tt.cached != "" {
+				source, err := c.source()
+				if err != nil {
+					t.Fatal(err)
+				}
+				cred := &credential{
+					AccessToken: tt.cached,
+					TokenType:   "Bearer",
+					Expiry:      time.Now().Add(30 * time.Minute),
+					TenantID:    x.TenantID(),
+				}
+				if err := writeCredential(c.cachePath(source), cred); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.lockOwner != "" {
+				unlock, err := token.NewFileStore(opts.StateFile).Lock(tt.lockOwner)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.release > 0 {
+					time.AfterFunc(tt.release, unlock)
+				} else {
+					defer unlock()
+				}
+			}
+			refreshes := x.Requests(xerotest.EndpointToken)
+
+			out, err := stdout(t, func() error { return c.Execute(nil) })
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var cred credential
+			if err := json.Unmarshal([]byte(out), &cred); err != nil {
+				t.Fatalf("could not decode %q: %s", out, err)
+			}
+
+			refreshed := x.Requests(xerotest.EndpointToken) - refreshes
+			switch tt.want {
+			case "cached":
+				if cred.AccessToken != tt.cached || refreshed != 0 {
+					t.Errorf("expected the cached token, got %s after %d refreshes", cred.AccessToken, refreshed)
+				}
+			case "saved":
+				if cred.AccessToken != saved || refreshed != 0 {
+					t.Errorf("expected the saved token, got %s after %d refreshes", cred.AccessToken, refreshed)
+				}
+			case "refreshed":
+				if cred.AccessToken == saved || cred.AccessToken == tt.cached || refreshed != 1 {
+					t.Errorf("expected a refreshed token, got %s after %d refreshes", cred.AccessToken, refreshed)
+				}
+				// the rotated refresh token is saved
+				s, err := token.NewFileStore(opts.StateFile).Load()
+				if err != nil || s.AccessToken != cred.AccessToken {
+					t.Errorf("refreshed token not saved %v", err)
+				}
+			}
+			if cred.TenantID != x.TenantID() {
+				t.Errorf("tenant id %q != %q", cred.TenantID, x.TenantID())
+			}
+		})
+	}
+}
@@ -20,6 +20,25 @@ def get_token():
     return response.json()['accessToken']
 
 
+def follow_token(generation=0, wait="30s"):
+    """
+    long-poll the xerooauthtoken server for a token newer than
+    generation, returning the (token, generation) pair; if no newer
+    token is issued within wait the current token is returned
+    """
+    response = requests.get(
+        "http://127.0.0.1:5001/token",
+        params={"after": generation, "wait": wait},
+        timeout=90,
+    )
+    if response.status_code != 200:
+        raise IntegrationException(
+            "response %d received; bailing" % response.status_code
+        )
+    data = response.json()
+    return data['accessToken'], data['generation']
+
+
 def tenants(access_token):
     """retrieve first tenant id"""
     tenants_url = 'https://api.xero.com/connections'
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/gorilla/handlers"
+	"github.com/rorycl/XeroOauthTokenServer/token"
+)
+
+// newLogger returns a redacting structured logger writing to stderr at
+// the given level in either "text" or "json" format
+func newLogger(level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+	return slog.New(token.NewRedactHandler(h)), nil
+}
+
+// accessLogger returns a gorilla handlers.LogFormatter which writes
+// access log entries to logger with sensitive query parameters such as
+// the oauth2 code and state masked
+func accessLogger(logger *slog.Logger) handlers.LogFormatter {
+	return func(_ io.Writer, p handlers.LogFormatterParams) {
+		logger.Info(
+			"request",
+			"remote", p.Request.RemoteAddr,
+			"method", p.Request.Method,
+			"url", token.RedactURL(&p.URL),
+			"proto", p.Request.Proto,
+			"status", p.StatusCode,
+			"size", p.Size,
+			"user_agent", p.Request.UserAgent(),
+		)
+	}
+}
@@ -1,18 +1,26 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/braintree/manners"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	flags "github.com/jessevdk/go-flags"
+	"github.com/rorycl/XeroOauthTokenServer/admin"
+	"github.com/rorycl/XeroOauthTokenServer/apikey"
 	"github.com/rorycl/XeroOauthTokenServer/token"
+	"github.com/rorycl/XeroOauthTokenServer/xerotest"
 )
 
 const description = "Xero oauth token server"
@@ -23,9 +31,41 @@ const usage = " <options>" + "\n\n  " + description
 type Opts struct {
 	Port        string   `short:"p" long:"port" description:"port to run on" default:"5001"`
 	Addr        string   `short:"n" long:"address" description:"network address to run on" default:"127.0.0.1"`
+	Socket      string   `long:"socket" description:"unix socket to serve on instead of the network address and port"`
 	Redirect    string   `short:"r" long:"redirect" description:"oauth2 redirect address" default:"http://localhost:5001/code"`
 	Scopes      []string `short:"o" long:"scopes" description:"oauth2 scopes" default:"offline_access" default:"accounting.transactions" default:"accounting.reports.read"`
-	RefreshMins int      `short:"m" long:"refreshmins" description:"set lifetime of refresh token (default 50 days)" default:"72000"`
+	RefreshMins int      `short:"m" long:"refreshmins" description:"lifetime of the refresh token in minutes (default 50 days)" default:"72000"`
+	LogLevel    string   `short:"l" long:"loglevel" description:"log level" choice:"debug" choice:"info" choice:"warn" choice:"error" default:"info"`
+	LogFormat   string   `long:"logformat" description:"log output format" choice:"text" choice:"json" default:"text"`
+	AuditLog    string   `long:"auditlog" description:"append token access and administrative actions to this json lines file"`
+	AuditChain  bool     `long:"auditchain" description:"hash chain audit log entries for tamper evidence"`
+	APIKeys     string   `short:"k" long:"apikeys" description:"file of hashed api keys required by consumer endpoints"`
+	APIKeysEnv  string   `long:"apikeys-env" env:"XEROTOKENSERVER_APIKEYS" description:"semicolon separated hashed api keys required by consumer endpoints"`
+	AdminUsers  string   `short:"u" long:"adminusers" description:"htpasswd style file of bcrypt hashed admin accounts required for the web pages"`
+	SessionMins int      `long:"sessionmins" description:"admin session lifetime in minutes" default:"480"`
+	SSOClientID string   `long:"ssoclientid" env:"XEROTOKENSERVER_SSO_CLIENT_ID" description:"xero app client id for admin \"Sign in with Xero\""`
+	SSOSecret   string   `long:"ssoclientsecret" env:"XEROTOKENSERVER_SSO_CLIENT_SECRET" description:"xero app client secret for admin \"Sign in with Xero\""`
+	SSORedirect string   `long:"ssoredirect" description:"oauth2 redirect address for admin \"Sign in with Xero\"" default:"http://localhost:5001/signin/xero/callback"`
+	SSOAllow    []string `long:"ssoallow" description:"xero user id or email permitted to sign in as an admin (repeatable)"`
+	ReadyFails  int      `long:"readyfailures" description:"consecutive refresh failures after which the token is degraded" default:"3"`
+	ReadyExpiry int      `long:"readyexpiryhours" description:"hours before refresh token expiry from which it is expiring soon" default:"24"`
+	BackoffMins int      `long:"backoffmins" description:"initial delay in minutes before retrying a failed background refresh, doubling with each failure" default:"1"`
+	BackoffMax  int      `long:"backoffmaxmins" description:"maximum delay in minutes between background refresh retries" default:"60"`
+	Proactive   int      `long:"proactivemins" description:"refresh the access token in the background this many minutes before it expires (0 to refresh on demand)" default:"0"`
+	JitterSecs  int      `long:"proactivejitter" description:"maximum random seconds subtracted from the proactive refresh time" default:"60"`
+	Policy      string   `long:"refreshpolicy" description:"when to refresh the refresh token to keep it alive" choice:"before-expiry" choice:"interval" choice:"fraction" default:"before-expiry"`
+	PolicyMins  int      `long:"refreshinterval" description:"minutes between refreshes for the interval refresh policy" default:"1440"`
+	PolicyFrac  float64  `long:"refreshfraction" description:"fraction of the refresh token lifetime after which the fraction refresh policy refreshes" default:"0.5"`
+	Window      string   `long:"refreshwindow" description:"only refresh within these daily local hours, as HH:MM-HH:MM, unless the refresh token would expire first"`
+	StateFile   string   `short:"s" long:"statefile" description:"save token state to this file on shutdown and restore it on start"`
+	Sinks       []string `long:"sink" description:"write the access token to a file on every refresh, as path[,format=raw|env|json|header][,template=file][,mode=0600][,owner=user[:group]] (repeatable)"`
+	Hooks       []string `long:"hook" description:"run a shell command on a token event, as event:command where event is refreshed, refresh_failed, revoked or expiring (repeatable)"`
+	HookTimeout int      `long:"hooktimeoutsecs" description:"seconds after which a hook command is killed" default:"30"`
+	HookConc    int      `long:"hookconcurrency" description:"maximum number of hook commands running at once" default:"2"`
+	DrainSecs   int      `long:"drainsecs" description:"seconds to wait for requests and refreshes to finish on shutdown" default:"30"`
+	Simulate    bool     `long:"simulate" description:"run against an embedded simulated Xero, logged in automatically, for offline development"`
+	SimExpiry   int      `long:"simulateexpirysecs" description:"lifetime in seconds of simulated access tokens" default:"300"`
+	NotReady    []string `long:"notready" description:"health state reported as not ready by /readyz (repeatable)" choice:"unconfigured" choice:"awaiting_consent" choice:"active" choice:"degraded" choice:"refresh_token_expiring_soon" choice:"revoked" default:"unconfigured" default:"awaiting_consent" default:"degraded" default:"revoked"`
 }
 
 func main() {
@@ -33,20 +73,61 @@ func main() {
 	var options Opts
 	var parser = flags.NewParser(&options, flags.Default)
 	parser.Usage = fmt.Sprintf("%s : %s", usage, version)
+	parser.SubcommandsOptional = true
+	addCommands(parser, &options)
 
-	if _, err := parser.Parse(); err != nil {
-		flagError := err.(*flags.Error)
-		if flagError.Type != flags.ErrHelp {
+	args, err := parser.Parse()
+	if err != nil {
+		// errors are printed by the parser; show the help for flag errors
+		var flagError *flags.Error
+		if errors.As(err, &flagError) && flagError.Type != flags.ErrHelp {
+			parser.WriteHelp(os.Stdout)
+		}
+		os.Exit(1)
+	}
+
+	// serve unless another command was run
+	if parser.Active == nil {
+		if len(args) > 0 {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
 			parser.WriteHelp(os.Stdout)
+			os.Exit(1)
 		}
+		serve(options)
+	}
+}
+
+// serve runs the token server until it fails or receives SIGINT or
+// SIGTERM, exiting on error
+func serve(options Opts) {
+
+	logger, err := newLogger(options.LogLevel, options.LogFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	slog.SetDefault(logger)
 
 	if options.RefreshMins < 20 {
-		log.Printf("It is inadvisable to set the refresh interval to less than 20 minutes in production")
+		logger.Warn("It is inadvisable to set the refresh interval to less than 20 minutes in production")
 	}
 
 	authURL, tokenURL, tenantURL := "", "", "" // use Xero default urls
+	var sim *xerotest.Server
+	if options.Simulate {
+		if options.SimExpiry <= token.DefaultExpirySecs {
+			logger.Error("simulated access tokens must last longer than the expiry margin", "margin_secs", token.DefaultExpirySecs)
+			os.Exit(1)
+		}
+		sim = xerotest.NewServer()
+		defer sim.Close()
+		sim.SetLifetimes(
+			time.Duration(options.SimExpiry)*time.Second,
+			xerotest.DefaultRefreshLifetime,
+			xerotest.DefaultGracePeriod,
+		)
+		authURL, tokenURL, tenantURL = sim.AuthURL(), sim.TokenURL(), sim.ConnectionsURL()
+	}
 	ts, err := token.NewToken(
 		options.Redirect,
 		options.Scopes,
@@ -57,50 +138,371 @@ func main() {
 	)
 
 	if err != nil {
-		log.Printf("new token server error %s\n", err)
+		logger.Error("new token server error", "error", err)
+		os.Exit(1)
+	}
+	ts.SetLogger(logger)
+	if sim != nil {
+		ts.SetRevokeURL(sim.RevokeURL())
+	}
+	ts.SetReadiness(token.Readiness{
+		DegradedFailures: options.ReadyFails,
+		ExpiryWarning:    time.Duration(options.ReadyExpiry) * time.Hour,
+		NotReady:         options.NotReady,
+	})
+	if options.Proactive > 0 {
+		lifetime := token.AccessTokenLifetime
+		if sim != nil {
+			lifetime = time.Duration(options.SimExpiry) * time.Second
+		}
+		lead := time.Duration(options.Proactive)*time.Minute + time.Duration(options.JitterSecs)*time.Second
+		if lead >= lifetime {
+			logger.Error("proactive refresh lead and jitter must be less than the access token lifetime", "lifetime", lifetime)
+			os.Exit(1)
+		}
+		ts.SetProactiveRefresh(
+			time.Duration(options.Proactive)*time.Minute,
+			time.Duration(options.JitterSecs)*time.Second,
+		)
+	}
+	ts.SetBackoff(
+		time.Duration(options.BackoffMins)*time.Minute,
+		time.Duration(options.BackoffMax)*time.Minute,
+	)
+	policy, err := newRefreshPolicy(options)
+	if err != nil {
+		logger.Error("refresh policy error", "error", err)
 		os.Exit(1)
 	}
+	if policy != nil {
+		ts.SetRefreshPolicy(policy)
+		logger.Info("refresh policy", "policy", policy.String())
+	}
 
-	// endpoint routing; gorilla mux is used because "/" in http.NewServeMux
-	// is a catch-all pattern
-	r := mux.NewRouter()
-	r.HandleFunc("/", ts.HandleLogin)
-	r.HandleFunc("/login", ts.HandleLogin)
-	r.HandleFunc("/home", ts.HandleHome)
-	r.HandleFunc("/code", ts.HandleCode)
-	r.HandleFunc("/livez", ts.HandleLivez)
-	r.HandleFunc("/status", ts.HandleStatus)
-	r.HandleFunc("/token", ts.HandleAccessToken)
-	r.HandleFunc("/refresh", ts.HandleRefresh)
-	r.HandleFunc("/tenants", ts.HandleTenants)
-	r.HandleFunc("/revoke", ts.HandleRevoke)
-	r.HandleFunc("/logout", ts.HandleLogout)
-
-	// create a handler wrapped in a recovery handler and logging handler
+	for _, spec := range options.Sinks {
+		sink, err := parseSink(spec)
+		if err != nil {
+			logger.Error("token sink error", "error", err)
+			os.Exit(1)
+		}
+		ts.AddSink(sink)
+		logger.Info("token sink", "path", sink.Path())
+	}
+
+	ts.SetHookConcurrency(options.HookConc)
+	for _, spec := range options.Hooks {
+		event, command, _ := strings.Cut(spec, ":")
+		err := ts.AddHook(token.Hook{
+			Event:   event,
+			Command: command,
+			Timeout: time.Duration(options.HookTimeout) * time.Second,
+		})
+		if err != nil {
+			logger.Error("hook error", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("hook", "event", event, "command", command)
+	}
+
+	if options.StateFile != "" && sim != nil {
+		logger.Warn("the state file is not used when simulating Xero")
+	} else if options.StateFile != "" {
+		store := token.NewFileStore(options.StateFile)
+		// the lock is held while serving so that other servers and the
+		// --fromstore commands leave the saved refresh token alone
+		unlock, err := store.Lock("server")
+		if err != nil {
+			logger.Error("token state error", "error", err)
+			os.Exit(1)
+		}
+		defer unlock()
+		ts.SetStore(store)
+		if err := ts.Load(); err != nil {
+			logger.Error("token state error", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if sim != nil {
+		if err := simulateConsent(ts, sim); err != nil {
+			logger.Error("simulated login error", "error", err)
+			os.Exit(1)
+		}
+		logger.Warn(
+			"simulating Xero; tokens are not valid for the Xero API",
+			"client_id", sim.ClientID,
+			"tenant_id", sim.TenantID(),
+			"access_expiry", time.Duration(options.SimExpiry)*time.Second,
+		)
+	}
+
+	if options.AuditLog != "" {
+		auditor, err := token.NewFileAuditor(options.AuditLog, options.AuditChain)
+		if err != nil {
+			logger.Error("audit log error", "error", err)
+			os.Exit(1)
+		}
+		defer auditor.Close()
+		ts.SetAuditor(auditor)
+	}
+
+	keys, err := loadAPIKeys(options.APIKeys, options.APIKeysEnv)
+	if err != nil {
+		logger.Error("api key error", "error", err)
+		os.Exit(1)
+	}
+	if keys == nil {
+		logger.Warn("no api keys configured; consumer endpoints are unauthenticated")
+	} else {
+		// audit rejected calls; consumer endpoints are named by the
+		// last path element, as /token and /api/v1/token
+		keys.OnDenied(func(r *http.Request, status int) {
+			ts.AuditRejected(r, path.Base(r.URL.Path), status)
+		})
+	}
+
+	var sessions *admin.Sessions
+	secure := strings.HasPrefix(options.Redirect, "https://")
+	lifetime := time.Duration(options.SessionMins) * time.Minute
+	if options.AdminUsers != "" {
+		users, err := admin.ParseUsersFile(options.AdminUsers)
+		if err != nil {
+			logger.Error("admin users error", "error", err)
+			os.Exit(1)
+		}
+		sessions = admin.NewSessions(users, lifetime, secure)
+	}
+	var sso *admin.XeroSSO
+	if options.SSOClientID != "" {
+		if sessions == nil {
+			sessions = admin.NewSessions(nil, lifetime, secure)
+		}
+		sso, err = admin.NewXeroSSO(
+			options.SSOClientID,
+			options.SSOSecret,
+			options.SSORedirect,
+			options.SSOAllow,
+			sessions,
+		)
+		if err != nil {
+			logger.Error("xero sign in error", "error", err)
+			os.Exit(1)
+		}
+	}
+	if sessions == nil {
+		logger.Warn("no admin users or xero sign in configured; web pages are unauthenticated")
+	} else {
+		sessions.SetLogger(logger)
+		sessions.OnAudit(ts.Audit)
+	}
+
+	r := newRouter(ts, keys, sessions, sso)
+
+	// create a handler wrapped in a recovery handler, a redacting access
+	// logging handler and csrf protection for state-changing requests
 	hdl := handlers.RecoveryHandler()(
-		handlers.LoggingHandler(os.Stdout, r))
+		handlers.CustomLoggingHandler(os.Stdout, token.CSRFProtect(r), accessLogger(logger)))
 
 	// configure server options
 	server := &http.Server{
 		Addr:         options.Addr + ":" + options.Port,
 		ReadTimeout:  1 * time.Second,
-		WriteTimeout: 3 * time.Second,
+		WriteTimeout: 3*time.Second + token.MaxTokenWait, // allow for /token long-polls
 		Handler:      hdl,
 	}
-	log.Printf("serving on %s:%s", options.Addr, options.Port)
+	// finish /token long-polls when shutting down, rather than waiting
+	// for their wait period to elapse
+	server.RegisterOnShutdown(ts.ReleaseWaiters)
+	var listener net.Listener
+	if options.Socket != "" {
+		listener, err = net.Listen("unix", options.Socket)
+		logger.Info("serving", "socket", options.Socket)
+	} else {
+		listener, err = net.Listen("tcp", server.Addr)
+		logger.Info("serving", "address", options.Addr, "port", options.Port)
+	}
+	if err != nil {
+		logger.Error("listen error", "error", err)
+		os.Exit(1)
+	}
+
+	// serve until the server fails or a signal is received
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+	failed := false
+	select {
+	case err := <-serveErr:
+		logger.Error("server error", "error", err)
+		failed = true
+	case <-ctx.Done():
+		stop()
+	}
+
+	// drain requests then stop refreshing and save the token state
+	logger.Info("shutting down", "drain", time.Duration(options.DrainSecs)*time.Second)
+	drain, cancel := context.WithTimeout(context.Background(), time.Duration(options.DrainSecs)*time.Second)
+	defer cancel()
+	if err := server.Shutdown(drain); err != nil {
+		logger.Warn("requests did not finish before shutdown", "error", err)
+	}
+	if err := ts.Shutdown(drain); err != nil {
+		logger.Error("token shutdown error", "error", err)
+		failed = true
+	}
+	logger.Info("closed the server")
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// newRouter returns the endpoint routing. Consumer endpoints require
+// an api key with the relevant permission if keys is not nil, and web
+// pages an admin session if sessions is not nil; an admin session is
+// also accepted in place of an api key.
+func newRouter(ts *token.Token, keys *apikey.Keys, sessions *admin.Sessions, sso *admin.XeroSSO) *mux.Router {
+
+	// protect requires an api key with permission for consumer endpoints
+	// if api keys are configured
+	protect := func(permission string, h http.HandlerFunc) http.HandlerFunc {
+		if keys == nil {
+			return h
+		}
+		return keys.Require(permission, h).ServeHTTP
+	}
+
+	// ui requires an admin session for web pages if admin users are
+	// configured
+	ui := func(h http.HandlerFunc) http.HandlerFunc {
+		if sessions == nil {
+			return h
+		}
+		return sessions.Require(h).ServeHTTP
+	}
+
+	// uiOr serves h to requests with an admin session and to consumers
+	// otherwise, such as for /status and /token; without api keys
+	// consumers cannot authenticate, so only admin sessions are served
+	uiOr := func(h, consumer http.HandlerFunc) http.HandlerFunc {
+		switch {
+		case sessions == nil:
+			return consumer
+		case keys == nil:
+			return sessions.RequireAPI(h).ServeHTTP
+		}
+		return sessions.Or(h, consumer).ServeHTTP
+	}
+
+	// gorilla mux is used because "/" in http.NewServeMux is a catch-all
+	// pattern
+	r := mux.NewRouter()
+	route := func(path string, h http.HandlerFunc) {
+		r.Handle(path, ts.InstrumentHandler(path, h))
+	}
+	route("/", ui(ts.HandleLogin))
+	route("/login", ui(ts.HandleLogin))
+	route("/home", ui(ts.HandleHome))
+	route("/code", ui(ts.HandleCode))
+	route("/livez", ts.HandleLivez)
+	route("/readyz", ts.HandleReadyz)
+	route("/status", uiOr(ts.HandleStatus, protect(apikey.StatusRead, ts.HandleStatus)))
+	route("/token", uiOr(ts.HandleAccessToken, protect(apikey.TokenRead, ts.HandleAccessToken)))
+	route("/refresh", uiOr(ts.HandleRefresh, protect(apikey.Refresh, ts.HandleRefresh)))
+	route("/tenants", uiOr(ts.HandleTenants, protect(apikey.TenantsRead, ts.HandleTenants)))
+	route("/revoke", uiOr(ts.HandleRevoke, protect(apikey.Revoke, ts.HandleRevoke)))
+	route("/logout", ui(ts.HandleLogout))
 
-	// wrap server with manners
-	manners.ListenAndServe(options.Addr+":"+options.Port, server.Handler)
+	// the versioned json api; the unversioned routes above are retained
+	// as aliases for existing consumers
+	api := token.APIPrefix
+	route(api+"/livez", ts.HandleLivez)
+	route(api+"/readyz", ts.HandleReadyz)
+	route(api+"/status", uiOr(ts.HandleStatus, protect(apikey.StatusRead, ts.HandleStatus)))
+	route(api+"/token", uiOr(ts.HandleAccessToken, protect(apikey.TokenRead, ts.HandleAccessToken)))
+	route(api+"/refresh", uiOr(ts.HandleRefresh, protect(apikey.Refresh, ts.HandleRefresh)))
+	route(api+"/tenants", uiOr(ts.HandleTenants, protect(apikey.TenantsRead, ts.HandleTenants)))
+	route(api+"/revoke", uiOr(ts.HandleRevoke, protect(apikey.Revoke, ts.HandleRevoke)))
+	route(api+"/logout", uiOr(ts.HandleLogout, protect(apikey.Revoke, ts.HandleLogout)))
+	if sessions != nil {
+		route(admin.SignInPath, sessions.HandleSignIn)
+		route("/signout", sessions.HandleSignOut)
+	}
+	if sso != nil {
+		route(admin.SSOStartPath, sso.HandleStart)
+		route(admin.SSOCallbackPath, sso.HandleCallback)
+	}
+	r.HandleFunc("/metrics", ts.HandleMetrics)
+	r.HandleFunc("/openapi.json", ts.HandleOpenAPI)
+	return r
+}
 
-	// catch signals
-	ch := make(chan os.Signal)
-	signal.Notify(ch, os.Interrupt, os.Kill)
-	go listenForShutdown(ch)
+// simulateConsent logs ts in to the simulated Xero sim, giving consent
+// without a browser
+func simulateConsent(ts *token.Token, sim *xerotest.Server) error {
+	if err := ts.AddClientCredentials(sim.ClientID, sim.ClientSecret, sim.TenantID()); err != nil {
+		return err
+	}
+	code, _, err := sim.Consent(ts.AuthURL())
+	if err != nil {
+		return err
+	}
+	return ts.GetToken(code)
+}
 
+// newRefreshPolicy returns the refresh policy selected by options, or
+// nil for the token default
+func newRefreshPolicy(options Opts) (token.RefreshPolicy, error) {
+	var policy token.RefreshPolicy
+	switch options.Policy {
+	case "interval":
+		if options.PolicyMins < 1 {
+			return nil, errors.New("refresh interval must be at least 1 minute")
+		}
+		policy = token.FixedInterval(time.Duration(options.PolicyMins) * time.Minute)
+	case "fraction":
+		p, err := token.FractionOfLifetime(options.PolicyFrac)
+		if err != nil {
+			return nil, err
+		}
+		policy = p
+	}
+	if options.Window == "" {
+		return policy, nil
+	}
+	if policy == nil {
+		policy = token.BeforeExpiry(time.Duration(token.DefaultExpirySecs) * time.Second)
+	}
+	return token.MaintenanceWindow(policy, options.Window, time.Local)
 }
 
-func listenForShutdown(ch <-chan os.Signal) {
-	<-ch
-	log.Print("Closing the server")
-	manners.Close()
+// loadAPIKeys loads api keys from a file and/or environment variable
+// value, returning nil if neither is set
+func loadAPIKeys(file, env string) (*apikey.Keys, error) {
+	if file == "" && env == "" {
+		return nil, nil
+	}
+	keys := &apikey.Keys{}
+	if file != "" {
+		k, err := apikey.ParseFile(file)
+		if err != nil {
+			return nil, err
+		}
+		keys = k
+	}
+	if env != "" {
+		k, err := apikey.ParseEnv(env)
+		if err != nil {
+			return nil, err
+		}
+		if err := keys.Merge(k); err != nil {
+			return nil, err
+		}
+	}
+	if keys.Len() == 0 {
+		return nil, errors.New("no api keys found")
+	}
+	return keys, nil
 }
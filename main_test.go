@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/rorycl/XeroOauthTokenServer/admin"
+	"github.com/rorycl/XeroOauthTokenServer/apikey"
+	"github.com/rorycl/XeroOauthTokenServer/token"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testSessions returns admin sessions for the user alice
+func testSessions(t *testing.T) *admin.Sessions {
+	t.Helper()
+	h, err := bcrypt.GenerateFromPassword([]byte("alice-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := admin.ParseUsers(strings.NewReader("alice:" + string(h) + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return admin.NewSessions(users, 0, false)
+}
+
+// signIn signs alice in through r, returning the session cookie
+func signIn(t *testing.T, r http.Handler) *http.Cookie {
+	t.Helper()
+	form := url.Values{"username": {"alice"}, "password": {"alice-password"}}
+	req := httptest.NewRequest("POST", "http://127.0.0.1:5001"+admin.SignInPath, strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	for _, c := range w.Result().Cookies() {
+		if c.Name == admin.CookieName {
+			return c
+		}
+	}
+	t.Fatalf("sign in failed with status %d", w.Code)
+	return nil
+}
+
+func TestRouterAuthentication(t *testing.T) {
+	keys, err := apikey.Parse(strings.NewReader(
+		"etl " + apikey.HashKey("etl-secret") + " token:read\n" +
+			"ops " + apikey.HashKey("ops-secret") + " token:read,refresh,revoke\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		keys   *apikey.Keys
+		method string
+		path   string
+		key    string
+		signIn bool
+		status int
+	}{
+		// api keys and admin users; the unconfigured token is reported
+		// as unavailable to authorised callers
+		{"keys_anonymous_revoke", keys, "POST", "/revoke", "", false, http.StatusUnauthorized},
+		{"keys_forbidden_revoke", keys, "POST", "/api/v1/revoke", "etl-secret", false, http.StatusForbidden},
+		{"keys_key_revoke", keys, "POST", "/revoke", "ops-secret", false, http.StatusServiceUnavailable},
+		{"keys_session_revoke", keys, "POST", "/api/v1/revoke", "", true, http.StatusServiceUnavailable},
+		{"keys_session_refresh", keys, "POST", "/refresh", "", true, http.StatusServiceUnavailable},
+		{"keys_session_token", keys, "GET", "/api/v1/token", "", true, http.StatusServiceUnavailable},
+		{"keys_key_token", keys, "GET", "/token", "etl-secret", false, http.StatusServiceUnavailable},
+
+		// admin users without api keys require a session
+		{"admin_anonymous_revoke", nil, "POST", "/revoke", "", false, http.StatusUnauthorized},
+		{"admin_anonymous_refresh", nil, "POST", "/api/v1/refresh", "", false, http.StatusUnauthorized},
+		{"admin_anonymous_token", nil, "GET", "/token", "", false, http.StatusUnauthorized},
+		{"admin_session_revoke", nil, "POST", "/api/v1/revoke", "", true, http.StatusServiceUnavailable},
+		{"admin_session_refresh", nil, "POST", "/refresh", "", true, http.StatusServiceUnavailable},
+		{"admin_session_token", nil, "GET", "/api/v1/token", "", true, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, err := token.NewToken("http://127.0.0.1:5001/code", []string{"offline_access"}, "", "", "", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := newRouter(ts, tt.keys, testSessions(t), nil)
+
+			req := httptest.NewRequest(tt.method, "http://127.0.0.1:5001"+tt.path, nil)
+			if tt.key != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.key)
+			}
+			if tt.signIn {
+				req.AddCookie(signIn(t, r))
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Errorf("Status code %d != %d: %s", w.Code, tt.status, w.Body.String())
+			}
+		})
+	}
+}
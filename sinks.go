@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/rorycl/XeroOauthTokenServer/token"
+)
+
+// parseSink returns the token file sink described by spec, of the form
+// path[,format=raw|env|json|header][,template=file][,mode=0600][,owner=user[:group]]
+func parseSink(spec string) (*token.Sink, error) {
+	parts := strings.Split(spec, ",")
+	path := parts[0]
+	if path == "" {
+		return nil, fmt.Errorf("sink %q has no path", spec)
+	}
+	tmpl, mode := "raw", os.FileMode(0600)
+	owner := ""
+	for _, p := range parts[1:] {
+		k, v, ok := strings.Cut(p, "=")
+		if !ok {
+			return nil, fmt.Errorf("sink %q option %q should be key=value", spec, p)
+		}
+		switch k {
+		case "format":
+			if _, ok := token.SinkFormats[v]; !ok {
+				return nil, fmt.Errorf("sink %q has unknown format %q", spec, v)
+			}
+			tmpl = v
+		case "template":
+			b, err := os.ReadFile(v)
+			if err != nil {
+				return nil, fmt.Errorf("sink %q template: %w", spec, err)
+			}
+			tmpl = string(b)
+		case "mode":
+			m, err := strconv.ParseUint(v, 8, 32)
+			if err != nil || m > 0777 {
+				return nil, fmt.Errorf("sink %q has invalid mode %q", spec, v)
+			}
+			mode = os.FileMode(m)
+		case "owner":
+			owner = v
+		default:
+			return nil, fmt.Errorf("sink %q has unknown option %q", spec, k)
+		}
+	}
+	sink, err := token.NewSink(path, tmpl, mode)
+	if err != nil {
+		return nil, err
+	}
+	if owner != "" {
+		uid, gid, err := lookupOwner(owner)
+		if err != nil {
+			return nil, fmt.Errorf("sink %q owner: %w", spec, err)
+		}
+		sink.SetOwner(uid, gid)
+	}
+	return sink, nil
+}
+
+// lookupOwner returns the uid and gid of owner, as user[:group] names
+// or numeric ids; the gid is -1 if no group is given
+func lookupOwner(owner string) (uid, gid int, err error) {
+	name, group, _ := strings.Cut(owner, ":")
+	uid, gid = -1, -1
+	if name != "" {
+		if uid, err = strconv.Atoi(name); err != nil {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return 0, 0, err
+			}
+			if uid, err = strconv.Atoi(u.Uid); err != nil {
+				return 0, 0, fmt.Errorf("user %s has no numeric uid", name)
+			}
+		}
+	}
+	if group != "" {
+		if gid, err = strconv.Atoi(group); err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return 0, 0, err
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return 0, 0, fmt.Errorf("group %s has no numeric gid", group)
+			}
+		}
+	}
+	return uid, gid, nil
+}
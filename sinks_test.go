@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/rorycl/XeroOauthTokenServer/token"
+)
+
+func TestParseSink(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token")
+
+	tests := []struct {
+		spec    string
+		wantErr string
+	}{
+		{path, ""},
+		{path + ",format=env,mode=0640", ""},
+		{path + ",owner=" + strconv.Itoa(os.Getuid()), ""},
+		{",format=env", "has no path"},
+		{path + ",format", "should be key=value"},
+		{path + ",format=xml", "unknown format"},
+		{path + ",mode=0999", "invalid mode"},
+		{path + ",mode=01777", "invalid mode"},
+		{path + ",colour=red", "unknown option"},
+		{path + ",template=" + filepath.Join(dir, "missing.tmpl"), "template"},
+		{path + ",owner=no-such-user-xts", "owner"},
+		{path + ",owner=0:no-such-group-xts", "owner"},
+	}
+	for _, tt := range tests {
+		sink, err := parseSink(tt.spec)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: expected error %q, got %v", tt.spec, tt.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.spec, err)
+			continue
+		}
+		if sink.Path() != path {
+			t.Errorf("%s: path %s != %s", tt.spec, sink.Path(), path)
+		}
+	}
+}
+
+func TestParseSinkMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix file modes on windows")
+	}
+	path := filepath.Join(t.TempDir(), "token.env")
+	sink, err := parseSink(path + ",format=env,mode=0640")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(token.SinkData{AccessToken: "abc", TenantID: "def"}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("sink mode %s, want 0640", info.Mode().Perm())
+	}
+	got, _ := os.ReadFile(path)
+	if !strings.Contains(string(got), "XERO_ACCESS_TOKEN=abc\n") {
+		t.Errorf("unexpected env sink %q", got)
+	}
+}
+
+func TestLookupOwner(t *testing.T) {
+	type ownerTest struct {
+		owner    string
+		uid, gid int
+		wantErr  bool
+	}
+	tests := []ownerTest{
+		{"0", 0, -1, false},
+		{"0:0", 0, 0, false},
+		{":0", -1, 0, false},
+		{"1000:", 1000, -1, false},
+		{"no-such-user-xts", 0, 0, true},
+		{"0:no-such-group-xts", 0, 0, true},
+	}
+	if u, err := user.Current(); err == nil && runtime.GOOS != "windows" {
+		uid, _ := strconv.Atoi(u.Uid)
+		tests = append(tests, ownerTest{u.Username, uid, -1, false})
+	}
+	for _, tt := range tests {
+		uid, gid, err := lookupOwner(tt.owner)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.owner)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.owner, err)
+			continue
+		}
+		if uid != tt.uid || gid != tt.gid {
+			t.Errorf("%s: got %d:%d want %d:%d", tt.owner, uid, gid, tt.uid, tt.gid)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package token
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit outcomes
+const (
+	AuditSuccess = "success"
+	AuditDenied  = "denied"
+	AuditFailure = "failure"
+)
+
+// AuditEvent records a call to an endpoint which retrieves a token or
+// performs an administrative action. PrevHash and Hash are only set
+// when hash chaining is enabled.
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	Endpoint   string    `json:"endpoint"`
+	Method     string    `json:"method"`
+	RemoteAddr string    `json:"remote_addr"`
+	Identity   string    `json:"identity,omitempty"`
+	Outcome    string    `json:"outcome"`
+	Status     int       `json:"status"`
+	Generation uint64    `json:"generation"`
+	PrevHash   string    `json:"prev_hash,omitempty"`
+	Hash       string    `json:"hash,omitempty"`
+}
+
+// Auditor records audit events
+type Auditor interface {
+	Audit(e AuditEvent) error
+}
+
+// identityKey is the context key for the authenticated identity of a
+// request
+type identityKey struct{}
+
+// WithIdentity returns a context carrying the authenticated identity
+// of the caller, for recording in the audit log
+func WithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext returns the authenticated identity set by
+// WithIdentity, or ""
+func IdentityFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(identityKey{}).(string)
+	return id
+}
+
+// SetAuditor sets the Auditor used to record calls to the token and
+// administrative endpoints
+func (t *Token) SetAuditor(a Auditor) {
+	t.locker.Lock()
+	t.auditor = a
+	t.locker.Unlock()
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// getAuditor returns the Auditor set by SetAuditor, or nil
+func (t *Token) getAuditor() Auditor {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	return t.auditor
+}
+
+// auditRequest wraps w to capture the response status and returns a
+// function which records the audit event for endpoint once the handler
+// has finished. If no Auditor is set w is returned unchanged.
+func (t *Token) auditRequest(w http.ResponseWriter, r *http.Request, endpoint string) (http.ResponseWriter, func()) {
+	a := t.getAuditor()
+	if a == nil {
+		return w, func() {}
+	}
+	rec := &statusRecorder{ResponseWriter: w}
+	return rec, func() {
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		t.audit(a, r, endpoint, status)
+	}
+}
+
+// AuditRejected records a request to endpoint which was rejected with
+// status before reaching its handler, such as by api key
+// authentication. It does nothing if no Auditor is set.
+func (t *Token) AuditRejected(r *http.Request, endpoint string, status int) {
+	t.Audit(r, endpoint, status)
+}
+
+// Audit records a request to endpoint handled outside the Token, such
+// as an administrator signing in, with the status of its response. It
+// does nothing if no Auditor is set.
+func (t *Token) Audit(r *http.Request, endpoint string, status int) {
+	if a := t.getAuditor(); a != nil {
+		t.audit(a, r, endpoint, status)
+	}
+}
+
+// audit records the audit event for a request to endpoint with auditor
+func (t *Token) audit(auditor Auditor, r *http.Request, endpoint string, status int) {
+	e := AuditEvent{
+		Time:       time.Now().UTC(),
+		Endpoint:   endpoint,
+		Method:     r.Method,
+		RemoteAddr: r.RemoteAddr,
+		Identity:   IdentityFromContext(r.Context()),
+		Outcome:    auditOutcome(status),
+		Status:     status,
+		Generation: t.Generation(),
+	}
+	if err := auditor.Audit(e); err != nil {
+		t.logger().Error("audit log write failed", "endpoint", endpoint, "error", err)
+	}
+}
+
+// auditOutcome classifies an http status code
+func auditOutcome(status int) string {
+	switch {
+	case status < 400:
+		return AuditSuccess
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return AuditDenied
+	}
+	return AuditFailure
+}
+
+// FileAuditor is an Auditor which appends events as json lines to a
+// file. If chaining is enabled each event includes the hash of the
+// previous event and its own hash, making tampering evident.
+type FileAuditor struct {
+	mu       sync.Mutex
+	file     *os.File
+	chain    bool
+	lastHash string
+}
+
+// NewFileAuditor opens (or creates) the append-only audit log at path.
+// When chain is true the hash of the last existing event is recovered
+// so that the chain continues across restarts; an existing log whose
+// last event is not chained is refused, as appending to it would
+// leave a chain that cannot be verified.
+func NewFileAuditor(path string, chain bool) (*FileAuditor, error) {
+	a := &FileAuditor{chain: chain}
+	if chain {
+		last, err := lastAuditHash(path)
+		if err != nil {
+			return nil, err
+		}
+		a.lastHash = last
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log: %w", err)
+	}
+	a.file = f
+	return a, nil
+}
+
+// Audit appends e to the audit log
+func (a *FileAuditor) Audit(e AuditEvent) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.chain {
+		e.PrevHash = a.lastHash
+		e.Hash = ""
+		h, err := auditHash(e)
+		if err != nil {
+			return err
+		}
+		e.Hash = h
+	}
+	j, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := a.file.Write(append(j, '\n')); err != nil {
+		return err
+	}
+	a.lastHash = e.Hash
+	return nil
+}
+
+// Close closes the audit log file
+func (a *FileAuditor) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// auditHash returns the hex encoded sha256 hash of the json encoding
+// of e, which must have an empty Hash field
+func auditHash(e AuditEvent) (string, error) {
+	j, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(j)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// lastAuditHash returns the hash of the last event in the audit log at
+// path, or "" if the file does not exist or is empty. It is an error
+// for the last event to have no hash.
+func lastAuditHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not read audit log: %w", err)
+	}
+	defer f.Close()
+	var last string
+	events := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return "", fmt.Errorf("could not decode audit log: %w", err)
+		}
+		last = e.Hash
+		events++
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("could not read audit log: %w", err)
+	}
+	if events > 0 && last == "" {
+		return "", fmt.Errorf("audit log %s is not hash chained; start a new log to enable chaining", path)
+	}
+	return last, nil
+}
+
+// VerifyAuditChain checks the hash chain of a json lines audit log,
+// returning an error describing the first broken link
+func VerifyAuditChain(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	prev := ""
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if e.PrevHash != prev {
+			return fmt.Errorf("line %d: previous hash mismatch", line)
+		}
+		want := e.Hash
+		e.Hash = ""
+		got, err := auditHash(e)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if got != want {
+			return fmt.Errorf("line %d: hash mismatch", line)
+		}
+		prev = want
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,145 @@
+package token
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memAuditor collects audit events in memory
+type memAuditor struct {
+	events []AuditEvent
+}
+
+func (m *memAuditor) Audit(e AuditEvent) error {
+	m.events = append(m.events, e)
+	return nil
+}
+
+func TestAuditHandlers(t *testing.T) {
+	token := initToken()
+	auditor := &memAuditor{}
+	token.SetAuditor(auditor)
+
+	// not logged in
+	req := httptest.NewRequest("GET", "http://127.0.0.1:5001/token", nil)
+	req = req.WithContext(WithIdentity(req.Context(), "etl-runner"))
+	token.HandleAccessToken(httptest.NewRecorder(), req)
+
+	err := loadCredentials(token)
+	if err != nil {
+		t.Fatalf("could not add client credentials %s", err)
+	}
+	token.AccessToken = "abc"
+	token.RefreshToken = "def"
+	activate(token)
+	token.AccessTokenExpiryUTC = time.Now().UTC().Add(time.Minute * 10)
+
+	req = httptest.NewRequest("GET", "http://127.0.0.1:5001/status", nil)
+	token.HandleStatus(httptest.NewRecorder(), req)
+
+	if len(auditor.events) != 2 {
+		t.Fatalf("expected 2 audit events, got %d", len(auditor.events))
+	}
+	e := auditor.events[0]
+	if e.Endpoint != "token" || e.Outcome != AuditFailure || e.Status != 503 || e.Identity != "etl-runner" {
+		t.Errorf("unexpected first audit event %+v", e)
+	}
+	e = auditor.events[1]
+	if e.Endpoint != "status" || e.Outcome != AuditSuccess || e.Status != 200 || e.RemoteAddr == "" {
+		t.Errorf("unexpected second audit event %+v", e)
+	}
+}
+
+func TestAuditRejected(t *testing.T) {
+	token := initToken()
+	req := httptest.NewRequest("GET", "http://127.0.0.1:5001/api/v1/token", nil)
+	token.AuditRejected(req, "token", 401) // no auditor
+
+	auditor := &memAuditor{}
+	token.SetAuditor(auditor)
+	token.AuditRejected(req.WithContext(WithIdentity(req.Context(), "etl-runner")), "token", 403)
+	if len(auditor.events) != 1 {
+		t.Fatalf("expected 1 audit event, got %d", len(auditor.events))
+	}
+	e := auditor.events[0]
+	if e.Endpoint != "token" || e.Outcome != AuditDenied || e.Status != 403 || e.Identity != "etl-runner" {
+		t.Errorf("unexpected audit event %+v", e)
+	}
+}
+
+func TestFileAuditorChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	a, err := NewFileAuditor(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ep := range []string{"login", "token"} {
+		if err := a.Audit(AuditEvent{Time: time.Now().UTC(), Endpoint: ep, Outcome: AuditSuccess}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Close()
+
+	// the chain continues after reopening
+	a, err = NewFileAuditor(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Audit(AuditEvent{Time: time.Now().UTC(), Endpoint: "revoke", Outcome: AuditSuccess}); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+
+	f, _ := os.Open(path)
+	defer f.Close()
+	if err := VerifyAuditChain(f); err != nil {
+		t.Errorf("audit chain verification failed: %s", err)
+	}
+
+	// tamper with the second event
+	b, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 audit lines, got %d", len(lines))
+	}
+	var e AuditEvent
+	json.Unmarshal([]byte(lines[1]), &e)
+	e.Identity = "someone-else"
+	j, _ := json.Marshal(e)
+	lines[1] = string(j)
+	err = VerifyAuditChain(bufio.NewReader(strings.NewReader(strings.Join(lines, "\n"))))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected line 2 hash mismatch, got %v", err)
+	}
+}
+
+func TestFileAuditorUnchainedTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	// a chained log followed by an unchained event
+	for _, chain := range []bool{true, false} {
+		a, err := NewFileAuditor(path, chain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Audit(AuditEvent{Time: time.Now().UTC(), Endpoint: "token", Outcome: AuditSuccess}); err != nil {
+			t.Fatal(err)
+		}
+		a.Close()
+	}
+
+	_, err := NewFileAuditor(path, true)
+	if err == nil || !strings.Contains(err.Error(), "not hash chained") {
+		t.Errorf("expected an unchained log error, got %v", err)
+	}
+	if _, err := NewFileAuditor(path, false); err != nil {
+		t.Errorf("unchained auditor should open the log: %s", err)
+	}
+}
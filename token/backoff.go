@@ -0,0 +1,163 @@
+package token
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Default backoff between background refresh attempts after a refresh
+// failure; the delay doubles with each consecutive failure up to the
+// maximum
+const (
+	DefaultBackoffBase = time.Minute
+	DefaultBackoffMax  = time.Hour
+)
+
+// OAuth2 error codes returned by Xero for which a refresh cannot
+// succeed by retrying
+var permanentOAuthErrors = map[string]bool{
+	"invalid_grant":  true,
+	"invalid_client": true,
+}
+
+// RefreshFailures describes recent refresh failures
+type RefreshFailures struct {
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastFailureUTC      *time.Time `json:"last_failure_utc,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	NextRetryUTC        *time.Time `json:"next_retry_utc,omitempty"`
+	Permanent           bool       `json:"permanent_failure"`
+}
+
+// oauthError returns the oauth2 "error" code from the body of a Xero
+// error response, if any
+func (e *HTTPClientError) oauthError() string {
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal([]byte(e.message), &body) != nil {
+		return ""
+	}
+	return body.Error
+}
+
+// IsPermanent reports if err is a refresh failure which retrying cannot
+// fix, such as an expired or revoked refresh token (invalid_grant) or
+// invalid client credentials (invalid_client), so that the client must
+// log in with Xero again
+func IsPermanent(err error) bool {
+	var httpErr *HTTPClientError
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+	switch httpErr.code {
+	case http.StatusBadRequest, http.StatusUnauthorized:
+		return permanentOAuthErrors[httpErr.oauthError()]
+	}
+	return false
+}
+
+// SetBackoff sets the base and maximum delay between background refresh
+// attempts after failures
+func (t *Token) SetBackoff(base, max time.Duration) {
+	t.locker.Lock()
+	t.backoffBase, t.backoffMax = base, max
+	t.locker.Unlock()
+}
+
+// backoff returns the delay before retrying after failures consecutive
+// failures; the caller must hold the lock
+func (t *Token) backoff(failures int) time.Duration {
+	base, max := t.backoffBase, t.backoffMax
+	if base <= 0 {
+		base = DefaultBackoffBase
+	}
+	if max <= 0 {
+		max = DefaultBackoffMax
+	}
+	d := base
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// recordRefresh records the outcome of a refresh attempt, scheduling
+// the next background retry after a failure. Refreshes which could not
+// be attempted because the token is not usable are not recorded, which
+// is reported by returning false.
+func (t *Token) recordRefresh(err error) bool {
+	if errors.Is(err, ErrNotLoggedIn) || errors.Is(err, ErrNotInitialised) {
+		return false
+	}
+	var te *TransitionError
+	if errors.As(err, &te) {
+		return false
+	}
+
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	if err == nil {
+		t.resetRefreshFailures()
+		return true
+	}
+	now := time.Now().UTC()
+	t.refreshFailures++
+	t.lastRefreshFailure = now
+	t.lastRefreshError = Redact(err.Error())
+	t.refreshPermanent = IsPermanent(err)
+	t.nextRefreshRetry = now.Add(t.backoff(t.refreshFailures))
+	return true
+}
+
+// resetRefreshFailures clears the refresh failures; the caller must hold
+// the lock
+func (t *Token) resetRefreshFailures() {
+	t.refreshFailures = 0
+	t.lastRefreshError = ""
+	t.refreshPermanent = false
+	t.nextRefreshRetry = time.Time{}
+}
+
+// retryDue reports if a background refresh may be attempted: refreshes
+// are not retried after a permanent failure, and otherwise not before
+// the backoff delay has elapsed
+func (t *Token) retryDue() bool {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	if t.refreshPermanent {
+		return false
+	}
+	return !time.Now().UTC().Before(t.nextRefreshRetry)
+}
+
+// refreshFailureStatus describes recent refresh failures; the caller
+// must hold the lock
+func (t *Token) refreshFailureStatus() RefreshFailures {
+	f := RefreshFailures{
+		ConsecutiveFailures: t.refreshFailures,
+		LastError:           t.lastRefreshError,
+		Permanent:           t.refreshPermanent,
+	}
+	if !t.lastRefreshFailure.IsZero() {
+		l := t.lastRefreshFailure
+		f.LastFailureUTC = &l
+	}
+	if t.refreshFailures > 0 && !t.refreshPermanent {
+		n := t.nextRefreshRetry
+		f.NextRetryUTC = &n
+	}
+	return f
+}
+
+// RefreshFailureStatus describes recent refresh failures
+func (t *Token) RefreshFailureStatus() RefreshFailures {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	return t.refreshFailureStatus()
+}
@@ -0,0 +1,131 @@
+package token
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIsPermanent(t *testing.T) {
+	tests := []struct {
+		err       error
+		permanent bool
+	}{
+		{&HTTPClientError{code: 400, message: `{"error":"invalid_grant"}`}, true},
+		{&HTTPClientError{code: 401, message: `{"error": "invalid_client"}`}, true},
+		{fmt.Errorf("wrapped: %w", &HTTPClientError{code: 400, message: `{"error":"invalid_grant"}`}), true},
+		{&HTTPClientError{code: 400, message: `{"error":"unsupported_grant_type"}`}, false},
+		{&HTTPClientError{code: 503, message: `{"error":"invalid_grant"}`}, false},
+		{&HTTPClientError{code: 400, message: `not json`}, false},
+		{errors.New("network down"), false},
+	}
+	for _, tt := range tests {
+		if got := IsPermanent(tt.err); got != tt.permanent {
+			t.Errorf("IsPermanent(%s) want(%t) got(%t)", tt.err, tt.permanent, got)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	token := &Token{}
+	token.SetBackoff(time.Second, 10*time.Second)
+	for failures, want := range map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		3:  4 * time.Second,
+		4:  8 * time.Second,
+		5:  10 * time.Second,
+		50: 10 * time.Second,
+	} {
+		if got := token.backoff(failures); got != want {
+			t.Errorf("backoff(%d) want(%s) got(%s)", failures, want, got)
+		}
+	}
+}
+
+func TestRecordRefreshBackoff(t *testing.T) {
+	token := &Token{}
+	token.SetBackoff(time.Hour, 2*time.Hour)
+
+	if !token.retryDue() {
+		t.Error("retry should be due without failures")
+	}
+
+	token.recordRefresh(errors.New("network down"))
+	f := token.RefreshFailureStatus()
+	if f.ConsecutiveFailures != 1 || f.Permanent || f.NextRetryUTC == nil {
+		t.Errorf("unexpected failures %+v", f)
+	}
+	if token.retryDue() {
+		t.Error("retry should not be due during backoff")
+	}
+
+	// failures that could not be attempted are not recorded
+	token.recordRefresh(ErrNotInitialised)
+	if f := token.RefreshFailureStatus(); f.ConsecutiveFailures != 1 {
+		t.Errorf("unexpected failures %+v", f)
+	}
+
+	token.recordRefresh(nil)
+	if f := token.RefreshFailureStatus(); f.ConsecutiveFailures != 0 || f.NextRetryUTC != nil {
+		t.Errorf("failures should be reset, got %+v", f)
+	}
+	if !token.retryDue() {
+		t.Error("retry should be due after success")
+	}
+}
+
+func TestPermanentRefreshFailure(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+	}))
+	defer server.Close()
+
+	token := initToken()
+	token.tokenURL = server.URL
+	token.AccessToken = "abc"
+	token.RefreshToken = "def"
+	token.RefreshTokenExpiryUTC = time.Now().UTC().Add(time.Hour)
+	if err := loadCredentials(token); err != nil {
+		t.Fatalf("could not add client credentials %s", err)
+	}
+
+	if err := token.Refresh(); !IsPermanent(err) {
+		t.Fatalf("expected a permanent error, got %v", err)
+	}
+	f := token.RefreshFailureStatus()
+	if !f.Permanent || f.NextRetryUTC != nil {
+		t.Errorf("unexpected failures %+v", f)
+	}
+	if token.retryDue() {
+		t.Error("background refresh should not be retried after a permanent failure")
+	}
+	if h := token.Health(); h.State != HealthDegraded || !h.Permanent {
+		t.Errorf("expected degraded health, got %+v", h)
+	}
+
+	// Get does not call Xero again
+	if _, err := token.Get(); err == nil {
+		t.Error("expected Get to fail")
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("expected 1 call to Xero, got %d", n)
+	}
+
+	// the failure is reported in the status
+	j, err := token.AsJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(j), `"permanent_failure":true`) {
+		t.Errorf("status does not report the permanent failure: %s", j)
+	}
+}
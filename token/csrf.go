@@ -0,0 +1,123 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// CSRFCookieName is the name of the cookie holding the csrf token
+const CSRFCookieName = "xts_csrf"
+
+// CSRFFieldName is the name of the form field (and CSRFHeaderName the
+// header) in which the csrf token must be submitted
+const (
+	CSRFFieldName  = "csrf_token"
+	CSRFHeaderName = "X-CSRF-Token"
+)
+
+// CSRFToken returns the csrf token for the request, setting a new csrf
+// cookie on w if the request has none. The token should be included in
+// every html form as the CSRFFieldName hidden field. secure marks the
+// cookie https only, and should follow the rule used for the server's
+// other cookies. The cookie is SameSite=Lax, as is the admin session
+// cookie, so that it is kept on the redirect back from Xero.
+func CSRFToken(w http.ResponseWriter, r *http.Request, secure bool) string {
+	if c, err := r.Cookie(CSRFCookieName); err == nil && len(c.Value) >= 32 {
+		return c.Value
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	tok := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookieName,
+		Value:    tok,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return tok
+}
+
+// secureCookies reports if cookies set by the Token's pages should be
+// https only, which they are if Xero redirects to an https url
+func (t *Token) secureCookies() bool {
+	return strings.HasPrefix(t.redirectURL, "https://")
+}
+
+// VerifyCSRF reports if the request carries a csrf token, in the form
+// or header, matching its csrf cookie
+func VerifyCSRF(r *http.Request) bool {
+	c, err := r.Cookie(CSRFCookieName)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	submitted := r.Header.Get(CSRFHeaderName)
+	if submitted == "" {
+		submitted = r.PostFormValue(CSRFFieldName)
+	}
+	return subtle.ConstantTimeCompare([]byte(c.Value), []byte(submitted)) == 1
+}
+
+// csrfExempt reports if a state-changing request cannot have been
+// forged by a cross-site html form or link: api requests carrying an
+// Authorization header or a json body require a cors preflight which
+// the server never grants
+func csrfExempt(r *http.Request) bool {
+	if r.Header.Get("Authorization") != "" {
+		return true
+	}
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return ct == "application/json"
+}
+
+// CSRFProtect wraps next so that requests using methods other than GET,
+// HEAD and OPTIONS must carry a valid csrf token, unless they are json
+// or bearer authenticated api requests
+func CSRFProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if !csrfExempt(r) && !VerifyCSRF(r) {
+				WriteProblem(w, http.StatusForbidden, ErrCodeInvalidCSRF, "invalid or missing csrf token")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requirePost rejects requests not using the POST method, returning
+// false if the request was rejected
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodPost {
+		return true
+	}
+	w.Header().Set("Allow", http.MethodPost)
+	WriteProblem(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "method not allowed; use POST")
+	return false
+}
+
+// wantsJSON reports if the client prefers a json response to a
+// redirect, as api clients posting json or accepting json do
+func wantsJSON(r *http.Request) bool {
+	if csrfExempt(r) {
+		return true
+	}
+	for _, h := range r.Header.Values("Accept") {
+		for _, a := range strings.Split(h, ",") {
+			mt, _, _ := mime.ParseMediaType(strings.TrimSpace(a))
+			if mt == "application/json" {
+				return true
+			}
+		}
+	}
+	return false
+}
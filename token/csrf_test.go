@@ -0,0 +1,154 @@
+package token
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestStateChangingHandlersRequirePost(t *testing.T) {
+	token := initToken()
+	token.AccessToken = "abc"
+	token.RefreshToken = "def"
+	err := loadCredentials(token)
+	if err != nil {
+		t.Fatalf("could not add client credentials %s", err)
+	}
+
+	for name, handler := range map[string]http.HandlerFunc{
+		"refresh": token.HandleRefresh,
+		"revoke":  token.HandleRevoke,
+		"logout":  token.HandleLogout,
+	} {
+		req := httptest.NewRequest("GET", "http://127.0.0.1:5001/"+name, nil)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s: Status code %d != 405", name, w.Code)
+		}
+		if w.Header().Get("Allow") != "POST" {
+			t.Errorf("%s: Allow header %q != POST", name, w.Header().Get("Allow"))
+		}
+	}
+	if token.AccessToken != "abc" || token.State() != StateActive {
+		t.Error("GET requests should not change token state")
+	}
+}
+
+func TestHandleRefreshJSON(t *testing.T) {
+	token := initToken()
+	token.AccessToken = "abc"
+	token.RefreshToken = "def"
+	err := loadCredentials(token)
+	if err != nil {
+		t.Fatalf("could not add client credentials %s", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"access_token": "hij", "refresh_token": "klm", "expires_in": 1800}`))
+	}))
+	defer server.Close()
+	token.tokenURL = server.URL
+
+	req := httptest.NewRequest("POST", "http://127.0.0.1:5001/refresh", nil)
+	req.Header.Set("Accept", "text/plain, application/json")
+	w := httptest.NewRecorder()
+	token.HandleRefresh(w, req)
+
+	resp := w.Result()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		t.Errorf("Status code %d != 200", resp.StatusCode)
+	}
+	var r map[string]interface{}
+	json.Unmarshal(body, &r)
+	if r["status"] != "refreshed" || r["generation"] != float64(1) {
+		t.Errorf("unexpected json response %s", body)
+	}
+}
+
+func TestCSRFProtect(t *testing.T) {
+	handler := CSRFProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// obtain a csrf token and cookie
+	w := httptest.NewRecorder()
+	csrf := CSRFToken(w, httptest.NewRequest("GET", "http://127.0.0.1:5001/", nil), true)
+	cookies := w.Result().Cookies()
+	if csrf == "" || len(cookies) != 1 || cookies[0].Name != CSRFCookieName {
+		t.Fatalf("expected a csrf cookie, got %v", cookies)
+	}
+	if !cookies[0].Secure || cookies[0].SameSite != http.SameSiteLaxMode {
+		t.Errorf("csrf cookie attributes incorrect %+v", cookies[0])
+	}
+
+	form := func(tok string) *http.Request {
+		f := url.Values{}
+		if tok != "" {
+			f.Add(CSRFFieldName, tok)
+		}
+		req := httptest.NewRequest("POST", "http://127.0.0.1:5001/logout", strings.NewReader(f.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookies[0])
+		return req
+	}
+	jsonReq := httptest.NewRequest("POST", "http://127.0.0.1:5001/logout", strings.NewReader("{}"))
+	jsonReq.Header.Set("Content-Type", "application/json")
+	bearerReq := httptest.NewRequest("POST", "http://127.0.0.1:5001/revoke", nil)
+	bearerReq.Header.Set("Authorization", "Bearer abc")
+	headerReq := form("")
+	headerReq.Header.Set(CSRFHeaderName, csrf)
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"get", httptest.NewRequest("GET", "http://127.0.0.1:5001/", nil), 200},
+		{"form_no_token", form(""), 403},
+		{"form_bad_token", form("forged"), 403},
+		{"form_ok", form(csrf), 200},
+		{"header_ok", headerReq, 200},
+		{"json", jsonReq, 200},
+		{"bearer", bearerReq, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, tt.req)
+			if w.Code != tt.status {
+				t.Errorf("Status code %d != %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestHomeFormsHaveCSRF(t *testing.T) {
+	token := initToken()
+	err := loadCredentials(token)
+	if err != nil {
+		t.Fatalf("could not add client credentials %s", err)
+	}
+	token.AccessToken = "abc"
+	token.RefreshToken = "def"
+	activate(token)
+
+	req := httptest.NewRequest("GET", "http://127.0.0.1:5001/home", nil)
+	w := httptest.NewRecorder()
+	token.HandleHome(w, req)
+
+	body := w.Body.String()
+	if strings.Contains(body, `href="/refresh"`) || strings.Contains(body, `href="/logout"`) {
+		t.Error("home page should not link to state-changing endpoints")
+	}
+	forms := strings.Count(body, "<form")
+	if forms != 4 || strings.Count(body, `name="csrf_token"`) != forms {
+		t.Errorf("expected 4 forms with csrf tokens, body: %s", body)
+	}
+}
@@ -0,0 +1,146 @@
+package token
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rorycl/XeroOauthTokenServer/xerotest"
+)
+
+// xeroToken returns a Token using the fake Xero x with its client
+// credentials
+func xeroToken(t *testing.T, x *xerotest.Server) *Token {
+	t.Helper()
+	token, err := NewToken(
+		"http://localhost:5001/code",
+		[]string{"offline_access", "accounting.transactions"},
+		x.AuthURL(),
+		x.TokenURL(),
+		x.ConnectionsURL(),
+		0,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token.SetRevokeURL(x.RevokeURL())
+	if err := token.AddClientCredentials(x.ClientID, x.ClientSecret, x.TenantID()); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// consent follows the authorization url to the fake Xero and passes the
+// redirect it returns to HandleCode
+func consent(t *testing.T, token *Token) {
+	t.Helper()
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(token.AuthURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("unexpected authorize status %d", resp.StatusCode)
+	}
+	w := httptest.NewRecorder()
+	token.HandleCode(w, httptest.NewRequest("GET", resp.Header.Get("Location"), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("code exchange failed %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestXeroEndToEnd(t *testing.T) {
+	x := xerotest.NewServer()
+	defer x.Close()
+	token := xeroToken(t, x)
+
+	consent(t, token)
+	if token.State() != StateActive {
+		t.Fatalf("expected active, got %s", token.State())
+	}
+	if err := token.VerifyScopes(); err != nil {
+		t.Error(err)
+	}
+	tenants, err := token.Tenants()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*tenants) != 1 || (*tenants)[0].TenantID != x.TenantID() {
+		t.Errorf("unexpected tenants %+v", tenants)
+	}
+
+	// xero expires the access token; a refresh rotates both tokens
+	x.Advance(xerotest.DefaultAccessLifetime + time.Minute)
+	if _, err := token.Tenants(); err == nil {
+		t.Error("expected the access token to have expired")
+	}
+	access, refresh := token.AccessToken, token.RefreshToken
+	if err := token.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken == access || token.RefreshToken == refresh {
+		t.Error("tokens were not rotated")
+	}
+	if _, err := token.Tenants(); err != nil {
+		t.Errorf("unexpected error after refresh %s", err)
+	}
+
+	// revocation removes the connection
+	access = token.AccessToken
+	if err := token.Revoke(); err != nil {
+		t.Fatal(err)
+	}
+	if token.State() != StateRevoked {
+		t.Errorf("expected revoked, got %s", token.State())
+	}
+	token.AccessToken = access
+	if _, err := token.Tenants(); err == nil {
+		t.Error("expected the revoked access token to be refused")
+	}
+	if n := x.Requests(xerotest.EndpointToken); n != 2 {
+		t.Errorf("expected 2 token requests, got %d", n)
+	}
+}
+
+func TestXeroRefreshTokenExpiry(t *testing.T) {
+	x := xerotest.NewServer()
+	defer x.Close()
+	token := xeroToken(t, x)
+	consent(t, token)
+
+	x.Advance(xerotest.DefaultRefreshLifetime + time.Minute)
+	err := token.Refresh()
+	if !IsPermanent(err) {
+		t.Fatalf("expected a permanent failure, got %v", err)
+	}
+	if h := token.Health(); h.State != HealthDegraded {
+		t.Errorf("expected degraded, got %s", h.State)
+	}
+}
+
+func TestXeroTransientFailure(t *testing.T) {
+	x := xerotest.NewServer()
+	defer x.Close()
+	token := xeroToken(t, x)
+	consent(t, token)
+
+	x.Fail(xerotest.EndpointToken, xerotest.Fault{Status: http.StatusServiceUnavailable}, 1)
+	err := token.Refresh()
+	var he *HTTPClientError
+	if !errors.As(err, &he) || IsPermanent(err) {
+		t.Fatalf("expected a transient failure, got %v", err)
+	}
+	if err := token.Refresh(); err != nil {
+		t.Fatalf("expected the retry to succeed, got %s", err)
+	}
+	if token.State() != StateActive {
+		t.Errorf("expected active, got %s", token.State())
+	}
+}
@@ -0,0 +1,59 @@
+package token
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// LockedError is returned by FileStore.Lock when another process holds
+// the lock, describing that process
+type LockedError struct {
+	Path  string
+	Owner string
+	PID   int
+}
+
+func (e *LockedError) Error() string {
+	if e.Owner == "" {
+		return fmt.Sprintf("%s is locked by another process", e.Path)
+	}
+	return fmt.Sprintf("%s is locked by %s (pid %d)", e.Path, e.Owner, e.PID)
+}
+
+// Lock takes an exclusive lock on the state file, so that only one
+// process refreshes Xero's rotating refresh token and saves it. The
+// lock is held on a ".lock" file beside the state file until unlock is
+// called or the process exits. owner, such as "server", describes the
+// process to others which find the file locked; they receive a
+// *LockedError.
+func (f *FileStore) Lock(owner string) (unlock func(), err error) {
+	path := f.path + ".lock"
+	lf, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open state lock file: %w", err)
+	}
+	locked, err := tryLock(lf)
+	if err != nil {
+		lf.Close()
+		return nil, fmt.Errorf("could not lock %s: %w", f.path, err)
+	}
+	if !locked {
+		le := &LockedError{Path: f.path}
+		if b, err := os.ReadFile(path); err == nil {
+			if o, pid, ok := strings.Cut(strings.TrimSpace(string(b)), " "); ok {
+				le.Owner = o
+				le.PID, _ = strconv.Atoi(pid)
+			}
+		}
+		lf.Close()
+		return nil, le
+	}
+	// record the owner for processes which find the file locked
+	if err := lf.Truncate(0); err == nil {
+		fmt.Fprintf(lf, "%s %d\n", owner, os.Getpid())
+	}
+	// closing the file releases the lock
+	return func() { lf.Close() }, nil
+}
@@ -0,0 +1,10 @@
+//go:build !(darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd || windows)
+
+package token
+
+import "os"
+
+// tryLock always succeeds on platforms without file locking
+func tryLock(f *os.File) (bool, error) {
+	return true, nil
+}
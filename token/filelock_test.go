@@ -0,0 +1,31 @@
+package token
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStoreLock(t *testing.T) {
+	store := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+	unlock, err := store.Lock("server")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var le *LockedError
+	if _, err := store.Lock("exec-credential"); !errors.As(err, &le) {
+		t.Fatalf("expected a locked error, got %v", err)
+	}
+	if le.Owner != "server" || le.PID != os.Getpid() {
+		t.Errorf("unexpected lock owner %+v", le)
+	}
+
+	unlock()
+	unlock, err = store.Lock("exec-credential")
+	if err != nil {
+		t.Fatalf("expected the lock after unlocking, got %v", err)
+	}
+	unlock()
+}
@@ -0,0 +1,74 @@
+package token
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultTokenWait is the default period a long-poll /token request
+// will block for if "after" is given without "wait"
+const DefaultTokenWait = 30 * time.Second
+
+// MaxTokenWait is the maximum period a long-poll /token request may
+// block for; servers should allow for this in their write timeouts
+const MaxTokenWait = 60 * time.Second
+
+// bumpGeneration increments the token generation and wakes any
+// goroutines waiting for a newer token. The caller must hold t.locker.
+func (t *Token) bumpGeneration() {
+	t.generation++
+	if t.generationChan != nil {
+		close(t.generationChan)
+	}
+	t.generationChan = make(chan struct{})
+}
+
+// Generation returns the token generation, which is incremented on
+// every successful token acquisition by GetToken or Refresh
+func (t *Token) Generation() uint64 {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	return t.generation
+}
+
+// WaitGeneration blocks until the token generation is greater than
+// after, the wait period elapses, ctx is cancelled or ReleaseWaiters
+// is called. The current generation is returned in each case.
+func (t *Token) WaitGeneration(ctx context.Context, after uint64, wait time.Duration) uint64 {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		t.locker.Lock()
+		if t.generation > after || t.waitersReleased {
+			g := t.generation
+			t.locker.Unlock()
+			return g
+		}
+		if t.generationChan == nil {
+			t.generationChan = make(chan struct{})
+		}
+		ch := t.generationChan
+		t.locker.Unlock()
+
+		select {
+		case <-ch:
+		case <-timer.C:
+			return t.Generation()
+		case <-ctx.Done():
+			return t.Generation()
+		}
+	}
+}
+
+// ReleaseWaiters wakes goroutines blocked in WaitGeneration and stops
+// further calls from blocking, so that long-poll requests finish
+// promptly on shutdown, such as by http.Server.RegisterOnShutdown
+func (t *Token) ReleaseWaiters() {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	t.waitersReleased = true
+	if t.generationChan != nil {
+		close(t.generationChan)
+	}
+	t.generationChan = make(chan struct{})
+}
@@ -1,11 +1,10 @@
 package token
 
 import (
-	"encoding/json"
 	"fmt"
 	"html/template"
-	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -15,7 +14,10 @@ import (
 // have been, redirect to the home page
 func (t *Token) HandleLogin(w http.ResponseWriter, r *http.Request) {
 
-	if t.clientLoggedIn {
+	w, audit := t.auditRequest(w, r, "login")
+	defer audit()
+
+	if t.State() != StateUnconfigured {
 		// redirect to the /home endpoint
 		w.Header().Set("Location", "/home")
 		w.WriteHeader(302)
@@ -49,8 +51,9 @@ func (t *Token) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	<h3>XeroOauthTokenServer Login</h3>
 	<p>Use this form to proceed to the next stage of login via Xero.</p>
 	<h4>Xero client credentials</h4>
-	{{ if . }}<p class="error">Error: {{ . }}{{ end }}
+	{{ if .Error }}<p class="error">Error: {{ .Error }}{{ end }}
     <form method="POST">
+        <input type="hidden" name="csrf_token" value="{{ .CSRF }}">
         <label>ClientID:</label>
         <input size=32 type="text" name="client"><br />
         <label>Secret:</label>
@@ -63,26 +66,38 @@ func (t *Token) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	</html>
 	`)
 	if err != nil {
-		log.Printf("form error: %s", err)
+		t.logger().Error("form error", "error", err)
 		http.Error(w, errorMsg, http.StatusInternalServerError)
 	}
-	tmpl.Execute(w, errorMsg)
+	tmpl.Execute(w, struct {
+		Error string
+		CSRF  string
+	}{errorMsg, CSRFToken(w, r, t.secureCookies())})
 }
 
 // HandleHome provides the home page
 func (t *Token) HandleHome(w http.ResponseWriter, r *http.Request) {
 
-	if !t.clientLoggedIn {
+	if t.State() == StateUnconfigured {
 		// redirect to the /login endpoint
 		w.Header().Set("Location", "/login")
 		w.WriteHeader(302)
 		return
 	}
 
+	// a POST starts consent again for a token already in use; this is
+	// not offered as a link, as generating the authorization url stops
+	// the current token being served
+	if r.Method == http.MethodPost {
+		http.Redirect(w, r, t.AuthURL(), http.StatusFound)
+		return
+	}
+
 	tpl := template.New("inline")
 	tmpl, err := tpl.Parse(`
 	<html><title>XeroOauthTokenServer : Xero login</title>
 	<style>
+	p.warning { color: red }
 	body { margin: 5% }
 	label { display: inline-block; margin-bottom: 4px; width: 120px }
 	</style>
@@ -90,28 +105,54 @@ func (t *Token) HandleHome(w http.ResponseWriter, r *http.Request) {
 	<h3>Xero Login</h3>
 	<p>As you have now provided the client credentials, you can proceed
 	to the next stage of logging in with Xero</p>
-	{{if .AccessToken }}
+	{{if .Usable }}
 		<h4>Server initialised</h4>
-		<p>The server is already initialised. However you can re-login using the
-		code generation link below.</p>
+		<p>The server is already initialised. However you can log in to Xero
+		again, such as to change the granted scopes or organisation.</p>
+		<form method="POST" action="/home">
+			<input type="hidden" name="csrf_token" value="{{ .CSRF }}">
+			<p class="warning">Warning: once you continue to Xero the current token
+			is no longer served until consent is completed.</p>
+			<input type="submit" value="Log in to Xero again">
+		</form>
 		<p>View or extract the server token, refresh token and other details at the
 		<a href="/status">/status</a> json endpoint.</p>
 		<p>View or extract the current token at <a href="/token">/token</a></p>
-		<p>Force a refresh at <a href="/refresh">/refresh</a></p>
-		<p>Revoke a token using <a href="/refresh">/logout</a></p>
-		<p>Logout and revoke the token using <a href="/refresh">/logout</a></p>
+		<form method="POST" action="/refresh">
+			<input type="hidden" name="csrf_token" value="{{ .CSRF }}">
+			<input type="submit" value="Force a refresh">
+		</form>
+		<form method="POST" action="/revoke">
+			<input type="hidden" name="csrf_token" value="{{ .CSRF }}">
+			<input type="submit" value="Revoke the token">
+		</form>
+		<form method="POST" action="/logout">
+			<input type="hidden" name="csrf_token" value="{{ .CSRF }}">
+			<input type="submit" value="Logout and revoke the token">
+		</form>
 	{{else}}
 		<h4>Code generation</h4>
 		<p>Generate a code by <a href={{ .AuthURL }}>logging into Xero</a></p>
 		<p>The code will then be swapped for a token and refresh token.</p>
 	{{end}}
+	{{if .SignedIn }}
+		<form method="POST" action="/signout">
+			<input type="hidden" name="csrf_token" value="{{ .CSRF }}">
+			<input type="submit" value="Sign out">
+		</form>
+	{{end}}
 	</body></html>
 	`)
 	if err != nil {
-		log.Printf("home page template error: %s", err)
+		t.logger().Error("home page template error", "error", err)
 		http.Error(w, "template error", http.StatusInternalServerError)
 	}
-	tmpl.Execute(w, t)
+	tmpl.Execute(w, struct {
+		*Token
+		Usable   bool
+		CSRF     string
+		SignedIn bool
+	}{t, t.State().usable(), CSRFToken(w, r, t.secureCookies()), strings.HasPrefix(IdentityFromContext(r.Context()), "admin:")})
 }
 
 // HandleCode is the code endpoint processes the code received from Xero
@@ -121,9 +162,16 @@ func (t *Token) HandleHome(w http.ResponseWriter, r *http.Request) {
 // measure to avoid spoofed callouts.
 func (t *Token) HandleCode(w http.ResponseWriter, r *http.Request) {
 
-	if !t.clientLoggedIn {
+	switch t.State() {
+	case StateUnconfigured:
 		msg := "client has not logged in"
-		log.Println(msg)
+		t.logger().Warn(msg)
+		http.Error(w, msg, http.StatusForbidden)
+		return
+	case StateAwaitingConsent:
+	default:
+		msg := "no authorization is awaiting consent"
+		t.logger().Warn(msg)
 		http.Error(w, msg, http.StatusForbidden)
 		return
 	}
@@ -131,18 +179,15 @@ func (t *Token) HandleCode(w http.ResponseWriter, r *http.Request) {
 	code := r.URL.Query().Get("code")
 	if code == "" {
 		msg := fmt.Sprint("No code to extract")
-		log.Println(msg)
+		t.logger().Warn(msg)
 		http.Error(w, msg, http.StatusForbidden)
 		return
 	}
 
 	state := r.URL.Query().Get("state")
 	if state != t.state {
-		msg := fmt.Sprintf(
-			"url state != saved state: %s %s",
-			r.URL.RawQuery, t.state,
-		)
-		log.Println(msg)
+		msg := "url state does not match saved state"
+		t.logger().Warn(msg)
 		http.Error(w, msg, http.StatusForbidden)
 		return
 	}
@@ -156,134 +201,126 @@ func (t *Token) HandleCode(w http.ResponseWriter, r *http.Request) {
 		} else {
 			msg = fmt.Sprintf("token retrieval error: %s", err)
 		}
-		log.Println(msg)
+		t.logger().Warn(msg)
 		http.Error(w, msg, http.StatusNotFound)
 		return
 	}
 
+	csrf := CSRFToken(w, r, t.secureCookies())
 	fmt.Fprint(w, "<html><title>Code extraction</title><body>")
 	fmt.Fprint(w, "<h4>Code extraction succeeded</h4>")
-	fmt.Fprint(w, `<p>View the <a href="/token">token</a>, `)
-	fmt.Fprint(w, `<a href="/refresh">refresh the token</a> `)
+	fmt.Fprint(w, `<p>View the <a href="/token">token</a> `)
 	fmt.Fprint(w, `or view the service <a href="/status">status</a>.</p>`)
-}
-
-// HandleLivez checks if the application is healthy
-func (t *Token) HandleLivez(w http.ResponseWriter, r *http.Request) {
-	if !t.clientLoggedIn {
-		msg := "client has not logged in"
-		log.Println(msg)
-		http.Error(w, msg, http.StatusUnauthorized)
-		return
-	}
-	if t.AccessToken == "" || t.RefreshToken == "" {
-		msg := "system has not been initialised or is in an error state"
-		log.Println(msg)
-		http.Error(w, msg, http.StatusMethodNotAllowed)
-		return
-	}
-	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, `<form method="POST" action="/refresh">`)
+	fmt.Fprintf(w, `<input type="hidden" name="csrf_token" value="%s">`, template.HTMLEscapeString(csrf))
+	fmt.Fprint(w, `<input type="submit" value="Refresh the token"></form>`)
 }
 
 // HandleStatus shows the status of the server/tokenserver struct
 func (t *Token) HandleStatus(w http.ResponseWriter, r *http.Request) {
 
-	if !t.clientLoggedIn {
-		msg := "client has not logged in"
-		log.Println(msg)
-		http.Error(w, msg, http.StatusUnauthorized)
-		return
-	}
+	w, audit := t.auditRequest(w, r, "status")
+	defer audit()
 
-	if t.AccessToken == "" || t.RefreshToken == "" {
-		msg := "system has not been initialised or is in an error state"
-		log.Println(msg)
-		http.Error(w, msg, http.StatusMethodNotAllowed)
+	if !t.ready(w) {
 		return
 	}
 
 	j, err := t.AsJSON()
 	if err != nil {
-		msg := fmt.Sprintf("status json encoding error: %s", err)
-		log.Println(msg)
-		http.Error(w, msg, http.StatusInternalServerError)
+		t.problem(w, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("status json encoding error: %s", err))
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(j)
 }
 
-// HandleRefresh handles refreshing a token, redirecting to the /token
-// endpoint if successful
+// HandleRefresh handles a POST to refresh a token, redirecting to the
+// /token endpoint if successful, or returning a json status to api
+// clients
 func (t *Token) HandleRefresh(w http.ResponseWriter, r *http.Request) {
 
-	if !t.clientLoggedIn {
-		msg := "client has not logged in"
-		log.Println(msg)
-		http.Error(w, msg, http.StatusUnauthorized)
+	w, audit := t.auditRequest(w, r, "refresh")
+	defer audit()
+
+	if !requirePost(w, r) {
 		return
 	}
 
-	if t.AccessToken == "" || t.RefreshToken == "" {
-		msg := "system has not been initialised or is in an error state"
-		log.Println(msg)
-		http.Error(w, msg, http.StatusMethodNotAllowed)
+	if !t.ready(w) {
 		return
 	}
 
 	n := time.Now()
 	err := t.Refresh()
 	if err != nil {
-		e, ok := err.(*HTTPClientError)
-		var msg string
-		if ok {
-			msg = fmt.Sprintf("refresh failed: %d : %s", e.code, e.message)
-		} else {
-			msg = fmt.Sprintf("refresh error: %s", err)
-		}
-		log.Println(msg)
-		http.Error(w, msg, http.StatusNotFound)
+		status, code := xeroProblem(w, err, ErrCodeRefreshFailed)
+		t.problem(w, status, code, fmt.Sprintf("refresh failed: %s", err))
 		return
 	}
 
-	a := time.Since(n)
-	log.Printf("Refresh took: %s\n", a)
+	t.logger().Info("refresh completed", "duration", time.Since(n))
+	if isAPI(r) {
+		t.writeJSON(w, map[string]interface{}{
+			"status":     "refreshed",
+			"generation": t.Generation(),
+		})
+		return
+	}
 	w.Header().Set("Location", "/token")
 	w.WriteHeader(302)
-	return
 }
 
-// HandleAccessToken returns a json token
+// HandleAccessToken returns a json token and its generation. If the
+// "after" query parameter is provided the request blocks until a token
+// with a newer generation is available or the "wait" duration (default
+// DefaultTokenWait, at most MaxTokenWait) elapses, in which case the
+// current token is returned.
 func (t *Token) HandleAccessToken(w http.ResponseWriter, r *http.Request) {
 
-	if !t.clientLoggedIn {
-		msg := "client has not logged in"
-		log.Println(msg)
-		http.Error(w, msg, http.StatusUnauthorized)
+	w, audit := t.auditRequest(w, r, "token")
+	defer audit()
+
+	if !t.ready(w) {
 		return
 	}
 
-	if t.AccessToken == "" || t.RefreshToken == "" {
-		msg := "system has not been initialised or is in an error state"
-		log.Println(msg)
-		http.Error(w, msg, http.StatusMethodNotAllowed)
-		return
+	// long-poll for a newer generation if requested
+	if after := r.URL.Query().Get("after"); after != "" {
+		generation, err := strconv.ParseUint(after, 10, 64)
+		if err != nil {
+			t.problem(w, http.StatusBadRequest, ErrCodeBadRequest, fmt.Sprintf("invalid after parameter: %s", after))
+			return
+		}
+		wait := DefaultTokenWait
+		if ws := r.URL.Query().Get("wait"); ws != "" {
+			wait, err = time.ParseDuration(ws)
+			if err != nil || wait < 0 {
+				t.problem(w, http.StatusBadRequest, ErrCodeBadRequest, fmt.Sprintf("invalid wait parameter: %s", ws))
+				return
+			}
+		}
+		if wait > MaxTokenWait {
+			wait = MaxTokenWait
+		}
+		t.WaitGeneration(r.Context(), generation, wait)
+		// the token may have been revoked or logged out while waiting
+		if !t.ready(w) {
+			return
+		}
 	}
 
 	// Get or refresh the token
 	_, err := t.Get()
 	if err != nil {
-		msg := fmt.Sprintf("token get or refresh error: %s", err)
-		log.Println(msg)
-		http.Error(w, msg, http.StatusInternalServerError)
+		status, code := xeroProblem(w, err, ErrCodeRefreshFailed)
+		t.problem(w, status, code, fmt.Sprintf("token get or refresh error: %s", err))
 		return
 	}
 	// jsonify
 	j, err := t.TokenJSON()
 	if err != nil {
-		msg := fmt.Sprintf("token json encoding error: %s", err)
-		log.Println(msg)
-		http.Error(w, msg, http.StatusInternalServerError)
+		t.problem(w, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("token json encoding error: %s", err))
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -293,25 +330,13 @@ func (t *Token) HandleAccessToken(w http.ResponseWriter, r *http.Request) {
 // HandleRefreshToken returns a json refresh token
 func (t *Token) HandleRefreshToken(w http.ResponseWriter, r *http.Request) {
 
-	if !t.clientLoggedIn {
-		msg := "client has not logged in"
-		log.Println(msg)
-		http.Error(w, msg, http.StatusUnauthorized)
-		return
-	}
-
-	if t.AccessToken == "" || t.RefreshToken == "" {
-		msg := "system has not been initialised or is in an error state"
-		log.Println(msg)
-		http.Error(w, msg, http.StatusMethodNotAllowed)
+	if !t.ready(w) {
 		return
 	}
 
 	j, err := t.RefreshTokenJSON()
 	if err != nil {
-		msg := fmt.Sprintf("refresh token json encoding error: %s", err)
-		log.Println(msg)
-		http.Error(w, msg, http.StatusInternalServerError)
+		t.problem(w, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("refresh token json encoding error: %s", err))
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -322,77 +347,61 @@ func (t *Token) HandleRefreshToken(w http.ResponseWriter, r *http.Request) {
 // token has expired refresh has to be handled manually
 func (t *Token) HandleTenants(w http.ResponseWriter, r *http.Request) {
 
-	if !t.clientLoggedIn {
-		msg := "client has not logged in"
-		log.Println(msg)
-		http.Error(w, msg, http.StatusUnauthorized)
-		return
-	}
-
-	if t.AccessToken == "" || t.RefreshToken == "" {
-		msg := "system has not been initialised or is in an error state"
-		log.Println(msg)
-		http.Error(w, msg, http.StatusMethodNotAllowed)
+	if !t.ready(w) {
 		return
 	}
 
 	tenants, err := t.Tenants()
 	if err != nil {
-		msg := fmt.Sprintf("tenant retrieval error: %s", err)
-		msg = msg + "\nyou may need to run /refresh"
-		log.Println(msg)
-		http.Error(w, msg, http.StatusInternalServerError)
+		status, code := xeroProblem(w, err, ErrCodeXeroError)
+		t.problem(w, status, code, fmt.Sprintf("tenant retrieval error: %s; you may need to refresh", err))
 		return
 	}
-
-	output, err := json.Marshal(tenants)
-	if err != nil {
-		msg := fmt.Sprintf("tenant encoding error: %s", err)
-		log.Println(msg)
-		http.Error(w, msg, http.StatusInternalServerError)
-		return
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(output)
+	t.writeJSON(w, tenants)
 }
 
 // HandleRevoke runs the revocation function for revoking a token and
-// all of its connections
+// all of its connections on a POST
 func (t *Token) HandleRevoke(w http.ResponseWriter, r *http.Request) {
 
-	if !t.clientLoggedIn {
-		msg := "client has not logged in"
-		log.Println(msg)
-		http.Error(w, msg, http.StatusUnauthorized)
+	w, audit := t.auditRequest(w, r, "revoke")
+	defer audit()
+
+	if !requirePost(w, r) {
 		return
 	}
 
-	if t.AccessToken == "" || t.RefreshToken == "" {
-		msg := "system has not been initialised or is in an error state"
-		log.Println(msg)
-		http.Error(w, msg, http.StatusMethodNotAllowed)
+	if !t.ready(w) {
 		return
 	}
 	err := t.Revoke()
 	if err != nil {
-		msg := fmt.Sprintf("error: %s", err)
-		log.Println(msg)
-		http.Error(w, msg, http.StatusInternalServerError)
+		status, code := xeroProblem(w, err, ErrCodeRevokeFailed)
+		t.problem(w, status, code, fmt.Sprintf("revoke error: %s", err))
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	j, _ := json.Marshal(map[string]string{"status": "revoked"})
-	w.Write(j)
+	t.writeJSON(w, map[string]string{"status": "revoked"})
 }
 
 // HandleLogout runs the revocation function and removes the login
-// details; this is a client facing call
+// details on a POST; this is a client facing call
 func (t *Token) HandleLogout(w http.ResponseWriter, r *http.Request) {
 
+	w, audit := t.auditRequest(w, r, "logout")
+	defer audit()
+
+	if !requirePost(w, r) {
+		return
+	}
+
 	// ignore errors for revocation and client credentials clearing
 	t.Revoke()
 	t.Logout()
 
+	if isAPI(r) {
+		t.writeJSON(w, map[string]string{"status": "logged out"})
+		return
+	}
 	w.Header().Set("Location", "/")
 	w.WriteHeader(302)
 }
@@ -31,13 +31,38 @@ func initToken() *Token {
 	return token
 }
 
-// load some example credentials
+// load some example credentials; if the test has set tokens the token
+// is made active as if consent had been given
 func loadCredentials(t *Token) error {
-	return t.AddClientCredentials(
+	err := t.AddClientCredentials(
 		"KW6U8N4BFJ6TJ7W8R2VAHOTD04T4FP0V",
 		"4NmyKEKLGI71pdSQ6xfLGZwoLoDY4Zr4joRjuA5JPxxS3Z7A",
 		"0b31b5f0-c947-11ec-a2f0-5f41836897f7",
 	)
+	if err != nil {
+		return err
+	}
+	if t.AccessToken != "" && t.RefreshToken != "" {
+		activate(t)
+	}
+	return nil
+}
+
+// awaitConsent moves a token with client credentials to
+// StateAwaitingConsent without changing its oauth2 state string
+func awaitConsent(t *Token) {
+	t.locker.Lock()
+	t.transition(StateAwaitingConsent)
+	t.locker.Unlock()
+}
+
+// activate moves a token with client credentials to StateActive, for
+// tests which set tokens directly rather than by the oauth2 flow
+func activate(t *Token) {
+	awaitConsent(t)
+	t.locker.Lock()
+	t.transition(StateActive)
+	t.locker.Unlock()
 }
 
 func TestExampleFromDocs(t *testing.T) {
@@ -196,6 +221,7 @@ func TestHandleHomeAlreadyInited(t *testing.T) {
 	handler := token.HandleHome
 	token.AccessToken = "abc"
 	token.RefreshToken = "def"
+	activate(token)
 
 	req := httptest.NewRequest("GET", "http://127.0.0.1:5001/", nil)
 	w := httptest.NewRecorder()
@@ -217,6 +243,22 @@ func TestHandleHomeAlreadyInited(t *testing.T) {
 	if !strings.Contains(bodyString, "The server is already initialised") {
 		t.Errorf("the server should report being initialised")
 	}
+	if !strings.Contains(bodyString, `action="/home"`) || !strings.Contains(bodyString, "no longer served") {
+		t.Errorf("the page should offer consent again with a warning")
+	}
+	if token.State() != StateActive {
+		t.Errorf("viewing the page changed the state to %s", token.State())
+	}
+
+	// consenting again redirects to Xero, stopping the token being served
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "http://127.0.0.1:5001/home", nil))
+	if w.Code != http.StatusFound || !strings.HasPrefix(w.Header().Get("Location"), token.authURL) {
+		t.Errorf("expected a redirect to Xero, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	if token.State() != StateAwaitingConsent {
+		t.Errorf("state %s != %s", token.State(), StateAwaitingConsent)
+	}
 }
 
 // Test code an incorrect state
@@ -229,6 +271,7 @@ func TestHandleHomeCodeErrorState(t *testing.T) {
 	if err != nil {
 		t.Fatalf("could not add client credentials %s", err)
 	}
+	awaitConsent(token)
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -261,6 +304,7 @@ func TestHandleCodeOK(t *testing.T) {
 	if err != nil {
 		t.Fatalf("could not add client credentials %s", err)
 	}
+	awaitConsent(token)
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -295,6 +339,7 @@ func TestHandleCode(t *testing.T) {
 	if err != nil {
 		t.Fatalf("could not add client credentials %s", err)
 	}
+	awaitConsent(token)
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -341,6 +386,7 @@ func TestHandleCodeFail(t *testing.T) {
 	if err != nil {
 		t.Fatalf("could not add client credentials %s", err)
 	}
+	awaitConsent(token)
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -384,7 +430,7 @@ func TestHandleRefresh(t *testing.T) {
 	token.tokenURL = server.URL
 	handler := token.HandleRefresh
 
-	req := httptest.NewRequest("GET", "http://127.0.0.1:5001/refresh", nil)
+	req := httptest.NewRequest("POST", "http://127.0.0.1:5001/refresh", nil)
 	w := httptest.NewRecorder()
 	handler(w, req)
 
@@ -418,7 +464,7 @@ func TestHandleRefreshFail(t *testing.T) {
 	token.tokenURL = server.URL
 	handler := token.HandleRefresh
 
-	req := httptest.NewRequest("GET", "http://127.0.0.1:5001/refresh", nil)
+	req := httptest.NewRequest("POST", "http://127.0.0.1:5001/refresh", nil)
 	w := httptest.NewRecorder()
 	handler(w, req)
 
@@ -426,8 +472,11 @@ func TestHandleRefreshFail(t *testing.T) {
 
 	statusCode := resp.StatusCode
 
-	if statusCode != 404 {
-		t.Errorf("Status code %d != 404", statusCode)
+	if statusCode != 502 {
+		t.Errorf("Status code %d != 502", statusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != ProblemContentType {
+		t.Errorf("Content type unexpected: %s", ct)
 	}
 }
 
@@ -496,8 +545,8 @@ func TestHandleTokenFailOld(t *testing.T) {
 	body, _ := io.ReadAll(resp.Body)
 	statusCode := resp.StatusCode
 
-	if statusCode != 500 {
-		t.Errorf("Status code %d != 500", statusCode)
+	if statusCode != 502 && statusCode != 504 {
+		t.Errorf("Status code %d not a gateway error", statusCode)
 		t.Errorf("body: %s", body)
 	}
 }
@@ -562,8 +611,8 @@ func TestHandleRefreshTokenFail(t *testing.T) {
 
 	statusCode := resp.StatusCode
 
-	if statusCode != 405 {
-		t.Errorf("Status code %d != 200", statusCode)
+	if statusCode != 503 {
+		t.Errorf("Status code %d != 503", statusCode)
 	}
 }
 
@@ -648,11 +697,10 @@ func TestHandleTenantsFail(t *testing.T) {
 	contentType := resp.Header.Get("Content-Type")
 	body, _ := io.ReadAll(resp.Body)
 
-	if statusCode != 500 {
-		t.Errorf("Status code %d != 500", statusCode)
+	if statusCode != 502 {
+		t.Errorf("Status code %d != 502", statusCode)
 	}
-	// if contentType != "application/json"
-	if contentType != "text/plain; charset=utf-8" {
+	if contentType != ProblemContentType {
 		t.Errorf("Content type unexpected: %s\n", contentType)
 	}
 	if !strings.Contains(string(body), "Tenant callout http error, 401") {
@@ -777,10 +825,10 @@ func TestHandleTenantsMalformedJSON(t *testing.T) {
 	contentType := resp.Header.Get("Content-Type")
 	body, _ := io.ReadAll(resp.Body)
 
-	if statusCode != 500 {
-		t.Errorf("Status code %d != 500", statusCode)
+	if statusCode != 502 {
+		t.Errorf("Status code %d != 502", statusCode)
 	}
-	if contentType != "text/plain; charset=utf-8" {
+	if contentType != ProblemContentType {
 		t.Errorf("Content type unexpected: %s\n", contentType)
 	}
 
@@ -812,7 +860,7 @@ func TestHandleRevokeOk(t *testing.T) {
 	token.revokeURL = server.URL
 	handler := token.HandleRevoke
 
-	req := httptest.NewRequest("GET", server.URL, nil)
+	req := httptest.NewRequest("POST", server.URL, nil)
 	w := httptest.NewRecorder()
 	handler(w, req)
 
@@ -856,7 +904,7 @@ func TestHandleRevokeFail(t *testing.T) {
 	token.revokeURL = server.URL
 	handler := token.HandleRevoke
 
-	req := httptest.NewRequest("GET", server.URL, nil)
+	req := httptest.NewRequest("POST", server.URL, nil)
 	w := httptest.NewRecorder()
 	handler(w, req)
 
@@ -865,10 +913,10 @@ func TestHandleRevokeFail(t *testing.T) {
 	contentType := resp.Header.Get("Content-Type")
 	body, _ := io.ReadAll(resp.Body)
 
-	if statusCode != 500 {
-		t.Errorf("Status code %d != 500", statusCode)
+	if statusCode != 502 {
+		t.Errorf("Status code %d != 502", statusCode)
 	}
-	if contentType != "text/plain; charset=utf-8" {
+	if contentType != ProblemContentType {
 		t.Errorf("Content type unexpected: %s\n", contentType)
 	}
 	if !strings.Contains(string(body), "failed") {
@@ -882,7 +930,7 @@ func TestLogout(t *testing.T) {
 
 	handler := token.HandleLogout
 
-	req := httptest.NewRequest("GET", "http://127.0.0.1:5001/logout", nil)
+	req := httptest.NewRequest("POST", "http://127.0.0.1:5001/logout", nil)
 	w := httptest.NewRecorder()
 	handler(w, req)
 
@@ -894,3 +942,132 @@ func TestLogout(t *testing.T) {
 	}
 
 }
+
+func TestHandleTokenLongPoll(t *testing.T) {
+	token := initToken()
+	token.AccessToken = "xyz123"
+	token.AccessTokenExpiryUTC = time.Now().UTC().Add(time.Minute * 10)
+	token.RefreshToken = "abc987"
+	token.RefreshTokenExpiryUTC = time.Now().UTC().Add(time.Hour * 10)
+
+	err := loadCredentials(token)
+	if err != nil {
+		t.Fatalf("could not add client credentials %s", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"access_token": "new456", "refresh_token": "def", "expires_in": 1800}`))
+	}))
+	defer server.Close()
+	token.tokenURL = server.URL
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		token.Refresh()
+	}()
+
+	handler := token.HandleAccessToken
+	req := httptest.NewRequest("GET", "http://127.0.0.1:5001/token?after=0&wait=5s", nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	resp := w.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Status code %d != 200", resp.StatusCode)
+	}
+
+	var r struct {
+		AccessToken string `json:"accessToken"`
+		Generation  uint64 `json:"generation"`
+	}
+	json.Unmarshal(body, &r)
+	if r.AccessToken != "new456" {
+		t.Errorf("AccessToken is %s should be %s", r.AccessToken, "new456")
+	}
+	if r.Generation != 1 {
+		t.Errorf("Generation is %d should be 1", r.Generation)
+	}
+}
+
+func TestHandleTokenLongPollTimeout(t *testing.T) {
+	token := initToken()
+	token.AccessToken = "xyz123"
+	token.AccessTokenExpiryUTC = time.Now().UTC().Add(time.Minute * 10)
+	token.RefreshToken = "abc987"
+	token.RefreshTokenExpiryUTC = time.Now().UTC().Add(time.Hour * 10)
+
+	err := loadCredentials(token)
+	if err != nil {
+		t.Fatalf("could not add client credentials %s", err)
+	}
+
+	handler := token.HandleAccessToken
+	req := httptest.NewRequest("GET", "http://127.0.0.1:5001/token?after=0&wait=50ms", nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	resp := w.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Status code %d != 200", resp.StatusCode)
+	}
+	if !strings.Contains(string(body), `"generation":0`) {
+		t.Errorf("unexpected body %s", body)
+	}
+}
+
+func TestHandleTokenLongPollLogout(t *testing.T) {
+	token := initToken()
+	token.AccessToken = "xyz123"
+	token.AccessTokenExpiryUTC = time.Now().UTC().Add(time.Minute * 10)
+	token.RefreshToken = "abc987"
+	token.RefreshTokenExpiryUTC = time.Now().UTC().Add(time.Hour * 10)
+
+	err := loadCredentials(token)
+	if err != nil {
+		t.Fatalf("could not add client credentials %s", err)
+	}
+
+	// the token is logged out while the request waits
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		token.Logout()
+	}()
+
+	req := httptest.NewRequest("GET", "http://127.0.0.1:5001/token?after=0&wait=100ms", nil)
+	w := httptest.NewRecorder()
+	token.HandleAccessToken(w, req)
+
+	resp := w.Result()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Status code %d != 503", resp.StatusCode)
+	}
+	if !strings.Contains(string(body), ErrCodeNotLoggedIn) {
+		t.Errorf("unexpected body %s", body)
+	}
+}
+
+func TestHandleTokenLongPollBadParams(t *testing.T) {
+	token := initToken()
+	token.AccessToken = "xyz123"
+	token.RefreshToken = "abc987"
+
+	err := loadCredentials(token)
+	if err != nil {
+		t.Fatalf("could not add client credentials %s", err)
+	}
+
+	for _, q := range []string{"after=x", "after=1&wait=soon"} {
+		req := httptest.NewRequest("GET", "http://127.0.0.1:5001/token?"+q, nil)
+		w := httptest.NewRecorder()
+		token.HandleAccessToken(w, req)
+		if w.Result().StatusCode != 400 {
+			t.Errorf("%s: Status code %d != 400", q, w.Result().StatusCode)
+		}
+	}
+}
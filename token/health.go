@@ -0,0 +1,135 @@
+package token
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Health states reported by Health and the /readyz endpoint
+const (
+	HealthUnconfigured             = "unconfigured"
+	HealthAwaitingConsent          = "awaiting_consent"
+	HealthActive                   = "active"
+	HealthDegraded                 = "degraded"
+	HealthRefreshTokenExpiringSoon = "refresh_token_expiring_soon"
+	HealthRevoked                  = "revoked"
+)
+
+// HealthStates lists the health states
+var HealthStates = []string{
+	HealthUnconfigured,
+	HealthAwaitingConsent,
+	HealthActive,
+	HealthDegraded,
+	HealthRefreshTokenExpiringSoon,
+	HealthRevoked,
+}
+
+// Readiness configures the thresholds used to determine the health
+// state and which states are not ready
+type Readiness struct {
+	// DegradedFailures is the number of consecutive refresh failures
+	// after which the token is degraded
+	DegradedFailures int
+	// ExpiryWarning is the period before the refresh token expires
+	// during which it is expiring soon
+	ExpiryWarning time.Duration
+	// NotReady lists the health states reported as not ready
+	NotReady []string
+}
+
+// DefaultReadiness is the Readiness used unless SetReadiness is called
+var DefaultReadiness = Readiness{
+	DegradedFailures: 3,
+	ExpiryWarning:    24 * time.Hour,
+	NotReady: []string{
+		HealthUnconfigured,
+		HealthAwaitingConsent,
+		HealthDegraded,
+		HealthRevoked,
+	},
+}
+
+// Health describes the state of the token server
+type Health struct {
+	State string `json:"state"`
+	Ready bool   `json:"ready"`
+	RefreshFailures
+	AccessTokenExpiryUTC  *time.Time `json:"access_token_expiry_utc,omitempty"`
+	RefreshTokenExpiryUTC *time.Time `json:"refresh_token_expiry_utc,omitempty"`
+}
+
+// SetReadiness sets the thresholds used to determine health
+func (t *Token) SetReadiness(r Readiness) {
+	t.locker.Lock()
+	t.readiness = &r
+	t.locker.Unlock()
+}
+
+// Health reports the health state of the token
+func (t *Token) Health() Health {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+
+	r := DefaultReadiness
+	if t.readiness != nil {
+		r = *t.readiness
+	}
+
+	h := Health{RefreshFailures: t.refreshFailureStatus()}
+	if t.AccessToken != "" && t.RefreshToken != "" {
+		a, rt := t.AccessTokenExpiryUTC, t.RefreshTokenExpiryUTC
+		h.AccessTokenExpiryUTC, h.RefreshTokenExpiryUTC = &a, &rt
+	}
+
+	switch t.lifecycleState() {
+	case StateUnconfigured:
+		h.State = HealthUnconfigured
+	case StateCredentialsSet, StateAwaitingConsent:
+		h.State = HealthAwaitingConsent
+	case StateRevoked:
+		h.State = HealthRevoked
+	default:
+		switch {
+		case t.refreshPermanent:
+			h.State = HealthDegraded
+		case r.DegradedFailures > 0 && t.refreshFailures >= r.DegradedFailures:
+			h.State = HealthDegraded
+		case time.Now().UTC().Add(r.ExpiryWarning).After(t.RefreshTokenExpiryUTC):
+			h.State = HealthRefreshTokenExpiringSoon
+		default:
+			h.State = HealthActive
+		}
+	}
+
+	h.Ready = true
+	for _, s := range r.NotReady {
+		if s == h.State {
+			h.Ready = false
+		}
+	}
+	return h
+}
+
+// HandleLivez reports that the process is alive; it does not depend on
+// the state of the token, for which see HandleReadyz
+func (t *Token) HandleLivez(w http.ResponseWriter, r *http.Request) {
+	t.writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// HandleReadyz reports the health of the token, with a 503 status if
+// the health state is not ready
+func (t *Token) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	h := t.Health()
+	j, err := json.Marshal(h)
+	if err != nil {
+		t.problem(w, http.StatusInternalServerError, ErrCodeInternal, "health json encoding error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !h.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(j)
+}
@@ -0,0 +1,119 @@
+package token
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthStates(t *testing.T) {
+	token := initToken()
+
+	if h := token.Health(); h.State != HealthUnconfigured || h.Ready {
+		t.Errorf("expected unconfigured and not ready, got %+v", h)
+	}
+
+	if err := loadCredentials(token); err != nil {
+		t.Fatalf("could not add client credentials %s", err)
+	}
+	if h := token.Health(); h.State != HealthAwaitingConsent || h.Ready {
+		t.Errorf("expected awaiting_consent and not ready, got %+v", h)
+	}
+
+	token.AccessToken = "abc"
+	token.RefreshToken = "def"
+	activate(token)
+	token.AccessTokenExpiryUTC = time.Now().UTC().Add(30 * time.Minute)
+	token.RefreshTokenExpiryUTC = time.Now().UTC().Add(30 * 24 * time.Hour)
+	if h := token.Health(); h.State != HealthActive || !h.Ready {
+		t.Errorf("expected active and ready, got %+v", h)
+	}
+
+	token.RefreshTokenExpiryUTC = time.Now().UTC().Add(time.Hour)
+	if h := token.Health(); h.State != HealthRefreshTokenExpiringSoon || !h.Ready {
+		t.Errorf("expected refresh_token_expiring_soon and ready, got %+v", h)
+	}
+
+	for i := 0; i < DefaultReadiness.DegradedFailures; i++ {
+		token.recordRefresh(errors.New("refresh_token=secret rejected"))
+	}
+	h := token.Health()
+	if h.State != HealthDegraded || h.Ready {
+		t.Errorf("expected degraded and not ready, got %+v", h)
+	}
+	if h.ConsecutiveFailures != 3 || h.LastFailureUTC == nil || h.LastError == "" {
+		t.Errorf("expected failure details, got %+v", h)
+	}
+	if h.LastError != "refresh_token="+Redacted+" rejected" {
+		t.Errorf("last error not redacted: %s", h.LastError)
+	}
+
+	token.recordRefresh(nil)
+	if h := token.Health(); h.State != HealthRefreshTokenExpiringSoon || h.ConsecutiveFailures != 0 {
+		t.Errorf("expected failures to be reset, got %+v", h)
+	}
+
+	token.locker.Lock()
+	token.transition(StateRevoked)
+	token.clearTokens()
+	token.locker.Unlock()
+	if h := token.Health(); h.State != HealthRevoked || h.Ready {
+		t.Errorf("expected revoked and not ready, got %+v", h)
+	}
+
+	token.Logout()
+	if h := token.Health(); h.State != HealthUnconfigured {
+		t.Errorf("expected unconfigured after logout, got %+v", h)
+	}
+}
+
+func TestHealthReadiness(t *testing.T) {
+	token := initToken()
+	if err := loadCredentials(token); err != nil {
+		t.Fatalf("could not add client credentials %s", err)
+	}
+	token.AccessToken = "abc"
+	token.RefreshToken = "def"
+	activate(token)
+	token.RefreshTokenExpiryUTC = time.Now().UTC().Add(time.Hour)
+
+	token.SetReadiness(Readiness{
+		DegradedFailures: 1,
+		ExpiryWarning:    2 * time.Hour,
+		NotReady:         []string{HealthRefreshTokenExpiringSoon, HealthDegraded},
+	})
+	if h := token.Health(); h.State != HealthRefreshTokenExpiringSoon || h.Ready {
+		t.Errorf("expected refresh_token_expiring_soon and not ready, got %+v", h)
+	}
+	token.recordRefresh(errors.New("failed"))
+	if h := token.Health(); h.State != HealthDegraded {
+		t.Errorf("expected degraded after one failure, got %+v", h)
+	}
+}
+
+func TestHandleReadyz(t *testing.T) {
+	token := initToken()
+
+	w := httptest.NewRecorder()
+	token.HandleReadyz(w, httptest.NewRequest("GET", "http://127.0.0.1:5001/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Status code %d != 503", w.Code)
+	}
+	var h Health
+	if err := json.Unmarshal(w.Body.Bytes(), &h); err != nil {
+		t.Fatalf("could not decode health %s", w.Body.String())
+	}
+	if h.State != HealthUnconfigured {
+		t.Errorf("unexpected state %s", h.State)
+	}
+
+	// liveness does not depend on the token
+	w = httptest.NewRecorder()
+	token.HandleLivez(w, httptest.NewRequest("GET", "http://127.0.0.1:5001/livez", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Status code %d != 200", w.Code)
+	}
+}
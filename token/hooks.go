@@ -0,0 +1,242 @@
+package token
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Hook events
+const (
+	// HookRefreshed occurs when a token is obtained or refreshed
+	HookRefreshed = "refreshed"
+	// HookRefreshFailed occurs when a refresh with Xero fails
+	HookRefreshFailed = "refresh_failed"
+	// HookRevoked occurs when the token is revoked
+	HookRevoked = "revoked"
+	// HookExpiring occurs once for each refresh token when it comes
+	// within the Readiness ExpiryWarning of expiry
+	HookExpiring = "expiring"
+)
+
+// HookEvents lists the hook events
+var HookEvents = []string{HookRefreshed, HookRefreshFailed, HookRevoked, HookExpiring}
+
+// Hook defaults
+const (
+	DefaultHookTimeout     = 30 * time.Second
+	DefaultHookConcurrency = 2
+)
+
+// maxHookRuns is the number of recent hook runs retained
+const maxHookRuns = 20
+
+// maxHookOutput is the amount of hook output logged on failure
+const maxHookOutput = 1024
+
+// Hook is a shell command run when an event occurs, such as to reload
+// a service or push the token to a secret manager. The command receives
+// the access token on stdin and the token metadata in XERO_ environment
+// variables; of the server's environment only PATH, HOME and, on
+// Windows, SystemRoot are passed.
+type Hook struct {
+	Event   string
+	Command string
+	// Timeout bounds the run, DefaultHookTimeout if 0
+	Timeout time.Duration
+}
+
+// HookRun is the outcome of a hook run, reported by /status
+type HookRun struct {
+	Event      string    `json:"event"`
+	Command    string    `json:"command"`
+	StartedUTC time.Time `json:"started_utc"`
+	DurationMS int64     `json:"duration_ms"`
+	ExitCode   int       `json:"exit_code"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// AddHook adds a hook run on its event
+func (t *Token) AddHook(h Hook) error {
+	if !slices.Contains(HookEvents, h.Event) {
+		return fmt.Errorf("unknown hook event %q, should be one of %s", h.Event, strings.Join(HookEvents, ", "))
+	}
+	if strings.TrimSpace(h.Command) == "" {
+		return fmt.Errorf("%s hook has no command", h.Event)
+	}
+	if h.Timeout <= 0 {
+		h.Timeout = DefaultHookTimeout
+	}
+	t.locker.Lock()
+	t.hooks = append(t.hooks, h)
+	t.locker.Unlock()
+	return nil
+}
+
+// SetHookConcurrency limits the number of hooks running at once, by
+// default DefaultHookConcurrency; further runs wait for a running hook
+// to finish. It should be called before any hook runs.
+func (t *Token) SetHookConcurrency(n int) {
+	t.locker.Lock()
+	t.hookSlots = make(chan struct{}, max(n, 1))
+	t.locker.Unlock()
+}
+
+// HookRuns returns the recent hook runs, oldest first
+func (t *Token) HookRuns() []HookRun {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	return append([]HookRun{}, t.hookRuns...)
+}
+
+// runHooks starts the hooks for event in the background, with cause
+// being the error of a failed refresh
+func (t *Token) runHooks(event string, cause error) {
+	t.locker.Lock()
+	var hooks []Hook
+	for _, h := range t.hooks {
+		if h.Event == event {
+			hooks = append(hooks, h)
+		}
+	}
+	if len(hooks) == 0 {
+		t.locker.Unlock()
+		return
+	}
+	if t.hookSlots == nil {
+		t.hookSlots = make(chan struct{}, DefaultHookConcurrency)
+	}
+	slots := t.hookSlots
+	env := t.hookEnv(event, cause)
+	stdin := t.AccessToken
+	t.locker.Unlock()
+
+	for _, h := range hooks {
+		t.hooksRunning.Add(1)
+		go func() {
+			defer t.hooksRunning.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			t.recordHookRun(t.runHook(h, env, stdin))
+		}()
+	}
+}
+
+// hookInherited are the environment variables hooks inherit from the
+// server, whose environment may hold secrets such as the api keys;
+// SystemRoot is needed by Windows programs
+var hookInherited = []string{"PATH", "HOME", "SystemRoot"}
+
+// hookEnv returns the environment of hooks for event; the caller must
+// hold the lock
+func (t *Token) hookEnv(event string, cause error) []string {
+	var env []string
+	for _, k := range hookInherited {
+		if v, ok := os.LookupEnv(k); ok {
+			env = append(env, k+"="+v)
+		}
+	}
+	env = append(env,
+		"XERO_HOOK_EVENT="+event,
+		"XERO_TENANT_ID="+t.tenantID,
+		"XERO_STATE="+string(t.lifecycleState()),
+		"XERO_GENERATION="+strconv.FormatUint(t.generation, 10),
+		"XERO_REFRESH_FAILURES="+strconv.Itoa(t.refreshFailures),
+	)
+	if !t.AccessTokenExpiryUTC.IsZero() {
+		env = append(env, "XERO_ACCESS_TOKEN_EXPIRY="+t.AccessTokenExpiryUTC.UTC().Format(time.RFC3339))
+	}
+	if !t.RefreshTokenExpiryUTC.IsZero() {
+		env = append(env, "XERO_REFRESH_TOKEN_EXPIRY="+t.RefreshTokenExpiryUTC.UTC().Format(time.RFC3339))
+	}
+	if cause != nil {
+		env = append(env, "XERO_ERROR="+Redact(cause.Error()))
+	}
+	return env
+}
+
+// runHook runs h through the shell
+func (t *Token) runHook(h Hook, env []string, stdin string) HookRun {
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", h.Command)
+	} else {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", h.Command)
+	}
+	cmd.Env = env
+	cmd.Stdin = strings.NewReader(stdin)
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	cmd.WaitDelay = time.Second
+
+	run := HookRun{Event: h.Event, Command: h.Command, StartedUTC: time.Now().UTC()}
+	err := cmd.Run()
+	run.DurationMS = time.Since(run.StartedUTC).Milliseconds()
+	run.ExitCode = cmd.ProcessState.ExitCode()
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		run.Error = fmt.Sprintf("timed out after %s", h.Timeout)
+	case err != nil && !errors.As(err, &exitErr):
+		run.Error = err.Error()
+	}
+
+	if err == nil {
+		t.logger().Info("hook succeeded", "event", h.Event, "command", h.Command, "duration_ms", run.DurationMS)
+		return run
+	}
+	output := out.String()
+	if len(output) > maxHookOutput {
+		output = output[:maxHookOutput]
+	}
+	t.logger().Warn(
+		"hook failed",
+		"event", h.Event,
+		"command", h.Command,
+		"exit_code", run.ExitCode,
+		"error", err,
+		"output", Redact(strings.TrimSpace(output)),
+	)
+	return run
+}
+
+// recordHookRun records run, retaining the most recent runs
+func (t *Token) recordHookRun(run HookRun) {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	t.hookRuns = append(t.hookRuns, run)
+	if len(t.hookRuns) > maxHookRuns {
+		t.hookRuns = t.hookRuns[len(t.hookRuns)-maxHookRuns:]
+	}
+}
+
+// checkExpiring runs the expiring hooks once for each refresh token
+// within the Readiness ExpiryWarning of expiry
+func (t *Token) checkExpiring() {
+	t.locker.Lock()
+	r := DefaultReadiness
+	if t.readiness != nil {
+		r = *t.readiness
+	}
+	due := t.lifecycleState().usable() &&
+		!t.RefreshTokenExpiryUTC.IsZero() &&
+		time.Now().UTC().Add(r.ExpiryWarning).After(t.RefreshTokenExpiryUTC) &&
+		!t.expiringNotified.Equal(t.RefreshTokenExpiryUTC)
+	if due {
+		t.expiringNotified = t.RefreshTokenExpiryUTC
+	}
+	t.locker.Unlock()
+	if due {
+		t.runHooks(HookExpiring, nil)
+	}
+}
@@ -0,0 +1,140 @@
+package token
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rorycl/XeroOauthTokenServer/xerotest"
+)
+
+func TestAddHook(t *testing.T) {
+	token, err := NewToken("http://localhost:5001/code", []string{"offline_access"}, "", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := token.AddHook(Hook{Event: "renewed", Command: "true"}); err == nil {
+		t.Error("expected an error for an unknown event")
+	}
+	if err := token.AddHook(Hook{Event: HookRefreshed, Command: " "}); err == nil {
+		t.Error("expected an error for an empty command")
+	}
+	if err := token.AddHook(Hook{Event: HookRefreshed, Command: "true"}); err != nil {
+		t.Error(err)
+	}
+	if token.hooks[0].Timeout != DefaultHookTimeout {
+		t.Errorf("unexpected default timeout %s", token.hooks[0].Timeout)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook commands use the unix shell")
+	}
+	x := xerotest.NewServer()
+	defer x.Close()
+	token := xeroToken(t, x)
+	dir := t.TempDir()
+	// the server's environment is not passed to hooks
+	t.Setenv("XEROTOKENSERVER_APIKEYS", "secret")
+	for _, h := range []Hook{
+		{Event: HookRefreshed, Command: `cat > ` + dir + `/stdin; env > ` + dir + `/env`},
+		{Event: HookRefreshFailed, Command: `echo "$XERO_ERROR" > ` + dir + `/error; exit 3`},
+		{Event: HookRevoked, Command: `sleep 5`, Timeout: 100 * time.Millisecond},
+		{Event: HookExpiring, Command: `echo "$XERO_REFRESH_TOKEN_EXPIRY" >> ` + dir + `/expiring`},
+	} {
+		if err := token.AddHook(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	consent(t, token)
+	token.hooksRunning.Wait()
+	stdin, _ := os.ReadFile(filepath.Join(dir, "stdin"))
+	if string(stdin) != token.AccessToken {
+		t.Errorf("hook did not receive the access token on stdin: %q", stdin)
+	}
+	env, _ := os.ReadFile(filepath.Join(dir, "env"))
+	for _, want := range []string{"XERO_HOOK_EVENT=refreshed", "XERO_TENANT_ID=" + x.TenantID(), "XERO_GENERATION=1", "XERO_ACCESS_TOKEN_EXPIRY=", "PATH="} {
+		if !strings.Contains(string(env), want) {
+			t.Errorf("hook environment lacks %s: %s", want, env)
+		}
+	}
+	if strings.Contains(string(env), "XEROTOKENSERVER_APIKEYS") {
+		t.Errorf("hook inherited the server's environment: %s", env)
+	}
+
+	x.Fail(xerotest.EndpointToken, xerotest.Fault{Status: http.StatusServiceUnavailable}, 1)
+	if err := token.Refresh(); err == nil {
+		t.Fatal("expected the refresh to fail")
+	}
+	token.hooksRunning.Wait()
+	if e, _ := os.ReadFile(filepath.Join(dir, "error")); !strings.Contains(string(e), "503") {
+		t.Errorf("unexpected XERO_ERROR %q", e)
+	}
+
+	// expiring runs once for each refresh token
+	token.SetReadiness(Readiness{ExpiryWarning: 365 * 24 * time.Hour})
+	token.checkExpiring()
+	token.checkExpiring()
+	token.hooksRunning.Wait()
+	if e, _ := os.ReadFile(filepath.Join(dir, "expiring")); strings.Count(string(e), "\n") != 1 {
+		t.Errorf("expected one expiring run, got %q", e)
+	}
+
+	if err := token.Revoke(); err != nil {
+		t.Fatal(err)
+	}
+	token.hooksRunning.Wait()
+
+	runs := token.HookRuns()
+	var events []string
+	for _, r := range runs {
+		events = append(events, r.Event)
+	}
+	want := []string{HookRefreshed, HookRefreshFailed, HookExpiring, HookRevoked}
+	if !slices.Equal(events, want) {
+		t.Fatalf("unexpected hook runs %v", events)
+	}
+	if runs[0].ExitCode != 0 || runs[0].Error != "" {
+		t.Errorf("unexpected refreshed run %+v", runs[0])
+	}
+	if runs[1].ExitCode != 3 || runs[1].Error != "" {
+		t.Errorf("unexpected refresh_failed run %+v", runs[1])
+	}
+	if runs[3].ExitCode != -1 || !strings.Contains(runs[3].Error, "timed out") {
+		t.Errorf("unexpected revoked run %+v", runs[3])
+	}
+}
+
+func TestHookConcurrency(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook commands use the unix shell")
+	}
+	x := xerotest.NewServer()
+	defer x.Close()
+	token := xeroToken(t, x)
+	token.SetHookConcurrency(1)
+	for i := 0; i < 2; i++ {
+		if err := token.AddHook(Hook{Event: HookRefreshed, Command: "sleep 0.1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	consent(t, token)
+	token.hooksRunning.Wait()
+
+	runs := token.HookRuns()
+	if len(runs) != 2 {
+		t.Fatalf("expected 2 runs, got %d", len(runs))
+	}
+	slices.SortFunc(runs, func(a, b HookRun) int { return a.StartedUTC.Compare(b.StartedUTC) })
+	firstEnd := runs[0].StartedUTC.Add(time.Duration(runs[0].DurationMS) * time.Millisecond)
+	if runs[1].StartedUTC.Before(firstEnd) {
+		t.Errorf("hooks ran concurrently %+v", runs)
+	}
+}
@@ -2,12 +2,20 @@ package token
 
 import "fmt"
 
-// HTTPClientError reports errors reaching the remote service
+// HTTPClientError reports errors reaching the remote service. Secrets
+// in the message are redacted.
 type HTTPClientError struct {
-	code    int
-	message string
+	code       int
+	message    string
+	retryAfter string
+}
+
+// StatusCode returns the http status code returned by the remote
+// service
+func (e *HTTPClientError) StatusCode() int {
+	return e.code
 }
 
 func (e *HTTPClientError) Error() string {
-	return fmt.Sprintf("status: %d message: %s", e.code, e.message)
+	return fmt.Sprintf("status: %d message: %s", e.code, Redact(e.message))
 }
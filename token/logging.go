@@ -0,0 +1,44 @@
+package token
+
+import (
+	"log/slog"
+	"slices"
+)
+
+// SetLogger sets the structured logger used by the Token, wrapping it
+// in a redaction layer so that tokens, secrets and authorization codes
+// are masked. If SetLogger is not called slog.Default() is used.
+func (t *Token) SetLogger(l *slog.Logger) {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	if l == nil {
+		t.slogger = nil
+		return
+	}
+	t.slogger = slog.New(NewRedactHandler(l.Handler()))
+}
+
+// logger returns the Token's logger, falling back to a redacting
+// wrapper around slog.Default()
+func (t *Token) logger() *slog.Logger {
+	if t.slogger != nil {
+		return t.slogger
+	}
+	return slog.New(NewRedactHandler(slog.Default().Handler()))
+}
+
+// LogValue implements slog.LogValuer, summarising the Token without
+// its secrets. It takes the Token's lock, so must not be resolved by a
+// caller holding it.
+func (t *Token) LogValue() slog.Value {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	return slog.GroupValue(
+		slog.String("access_token", Mask(t.AccessToken)),
+		slog.Time("access_token_expiry_utc", t.AccessTokenExpiryUTC),
+		slog.String("refresh_token", Mask(t.RefreshToken)),
+		slog.Time("refresh_token_expiry_utc", t.RefreshTokenExpiryUTC),
+		slog.Any("scopes", slices.Clone(t.Scopes)),
+		slog.Uint64("generation", t.generation),
+	)
+}
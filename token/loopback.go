@@ -0,0 +1,132 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// loopbackPage is the page shown in the browser after a loopback login
+var loopbackPage = template.Must(template.New("loopback").Parse(
+	`<html><title>Xero login</title><body><h4>{{.}}</h4><p>You may close this window.</p></body></html>`,
+))
+
+// LoginLoopback logs in to Xero without the server's web pages, for
+// command line use. It listens on the redirect url, which must be an
+// http url on a loopback address, passes the authorization url to open
+// to print it or open a browser, then waits for Xero to redirect back
+// with the authorization code, which is exchanged for tokens. The tokens
+// are only kept, and so saved or written to sinks, if they have all the
+// requested scopes. Client credentials must have been added. ctx bounds
+// the wait for consent.
+func (t *Token) LoginLoopback(ctx context.Context, open func(authURL string) error) error {
+
+	redirect, err := url.Parse(t.redirectURL)
+	if err != nil {
+		return fmt.Errorf("invalid redirect url: %w", err)
+	}
+	if redirect.Scheme != "http" {
+		return fmt.Errorf("redirect url %s should be http for a loopback login", t.redirectURL)
+	}
+	port := redirect.Port()
+	if port == "" {
+		port = "80"
+	}
+	listeners, err := loopbackListeners(redirect.Hostname(), port)
+	if err != nil {
+		return err
+	}
+
+	result := make(chan error, 1)
+	path := redirect.Path
+	if path == "" {
+		path = "/"
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		t.locker.Lock()
+		state := t.state
+		t.locker.Unlock()
+		if q.Get("state") != state {
+			// not our redirect; keep waiting
+			t.logger().Warn("url state does not match saved state")
+			http.Error(w, "url state does not match saved state", http.StatusForbidden)
+			return
+		}
+		var err error
+		switch {
+		case q.Get("error") != "":
+			err = fmt.Errorf("authorization failed: %s", strings.TrimSpace(q.Get("error")+" "+q.Get("error_description")))
+		case q.Get("code") == "":
+			err = errors.New("no code to extract")
+		default:
+			err = t.getToken(strings.TrimSpace(q.Get("code")), t.verifyScopes)
+		}
+		msg := "Login succeeded"
+		if err != nil {
+			msg = "Login failed: " + err.Error()
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		loopbackPage.Execute(w, msg)
+		select {
+		case result <- err:
+		default:
+		}
+	})
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	for _, l := range listeners {
+		go server.Serve(l)
+	}
+	defer func() {
+		// let the browser receive its page
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	if err := open(t.AuthURL()); err != nil {
+		return err
+	}
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for consent: %w", ctx.Err())
+	}
+	return err
+}
+
+// loopbackListeners listens on port on the loopback address host, or
+// on each of the IPv4 and IPv6 loopback addresses for "localhost" since
+// the browser may use either
+func loopbackListeners(host, port string) ([]net.Listener, error) {
+	var addrs []string
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		addrs = []string{ip.String()}
+	} else if strings.EqualFold(host, "localhost") {
+		addrs = []string{"127.0.0.1", "::1"}
+	} else {
+		return nil, fmt.Errorf("redirect host %s is not a loopback address", host)
+	}
+	var listeners []net.Listener
+	var errs []error
+	for _, a := range addrs {
+		l, err := net.Listen("tcp", net.JoinHostPort(a, port))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("could not listen for the redirect: %w", errors.Join(errs...))
+	}
+	return listeners, nil
+}
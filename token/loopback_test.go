@@ -0,0 +1,112 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rorycl/XeroOauthTokenServer/xerotest"
+)
+
+// loopbackToken returns a Token using the fake Xero x with a redirect
+// to a free loopback port
+func loopbackToken(t *testing.T, x *xerotest.Server, scopes []string) *Token {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	redirect := "http://" + l.Addr().String() + "/code"
+	l.Close()
+	token, err := NewToken(redirect, scopes, x.AuthURL(), x.TokenURL(), x.ConnectionsURL(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := token.AddClientCredentials(x.ClientID, x.ClientSecret, x.TenantID()); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// browse follows the authorization url and the redirect to the loopback
+// listener, as a browser would
+func browse(authURL string) error {
+	resp, err := http.Get(authURL)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func TestLoginLoopback(t *testing.T) {
+	x := xerotest.NewServer()
+	defer x.Close()
+	token := loopbackToken(t, x, []string{"offline_access", "accounting.transactions"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := token.LoginLoopback(ctx, browse); err != nil {
+		t.Fatal(err)
+	}
+	if token.State() != StateActive || token.AccessToken == "" {
+		t.Errorf("expected an active token, got %s", token.State())
+	}
+}
+
+func TestLoginLoopbackFailures(t *testing.T) {
+	x := xerotest.NewServer()
+	defer x.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// xero refuses unknown scopes
+	token := loopbackToken(t, x, []string{"offline_access", "payroll.everything"})
+	err := token.LoginLoopback(ctx, browse)
+	if err == nil || !strings.Contains(err.Error(), "invalid_scope") {
+		t.Errorf("expected invalid_scope, got %v", err)
+	}
+
+	// a token lacking a requested scope is not kept or saved
+	token = loopbackToken(t, x, []string{"offline_access", "accounting.transactions"})
+	path := filepath.Join(t.TempDir(), "state.json")
+	token.SetStore(NewFileStore(path))
+	err = token.LoginLoopback(ctx, func(authURL string) error {
+		return browse(strings.Replace(authURL, "+accounting.transactions", "", 1))
+	})
+	if err == nil || !strings.Contains(err.Error(), "accounting.transactions not found") {
+		t.Errorf("expected a missing scope error, got %v", err)
+	}
+	if token.State() == StateActive || token.AccessToken != "" {
+		t.Errorf("token without its scopes should not be held, got %s", token.State())
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("token without its scopes should not be saved: %v", err)
+	}
+
+	// a redirect with the wrong state is ignored
+	token = loopbackToken(t, x, []string{"offline_access"})
+	short, cancelShort := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancelShort()
+	err = token.LoginLoopback(short, func(authURL string) error {
+		return browse(strings.Replace(authURL, "state=", "state=x", 1))
+	})
+	if err == nil || !strings.Contains(err.Error(), "waiting for consent") {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+
+	// the redirect must be to a loopback address
+	token, err = NewToken("https://example.com/code", []string{"offline_access"}, "", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := token.LoginLoopback(ctx, browse); err == nil {
+		t.Error("expected an error for a non loopback redirect")
+	}
+}
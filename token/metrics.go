@@ -0,0 +1,192 @@
+package token
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsNamespace prefixes all metric names
+const metricsNamespace = "xerotokenserver"
+
+// metrics holds the prometheus collectors for a Token. Each Token has
+// its own registry so that library users may run more than one Token
+// in a process. All methods are safe to call on a nil *metrics, which
+// allows Token structs to be constructed without NewToken in tests.
+type metrics struct {
+	registry         *prometheus.Registry
+	refreshAttempts  prometheus.Counter
+	refreshSuccesses prometheus.Counter
+	refreshFailures  *prometheus.CounterVec
+	refreshDuration  prometheus.Histogram
+	xeroResponses    *prometheus.CounterVec
+	requests         *prometheus.CounterVec
+}
+
+// newMetrics registers the token metrics, including gauges computed
+// from t at scrape time
+func newMetrics(t *Token) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		refreshAttempts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "refresh_attempts_total",
+			Help:      "Number of token refreshes attempted.",
+		}),
+		refreshSuccesses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "refresh_successes_total",
+			Help:      "Number of successful token refreshes.",
+		}),
+		refreshFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "refresh_failures_total",
+			Help:      "Number of failed token refreshes by cause.",
+		}, []string{"cause"}),
+		refreshDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "refresh_duration_seconds",
+			Help:      "Latency of token refreshes.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		xeroResponses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "xero_responses_total",
+			Help:      "Xero http responses by endpoint and status code.",
+		}, []string{"endpoint", "code"}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "Requests to the token server by endpoint and status code.",
+		}, []string{"endpoint", "code"}),
+	}
+
+	accessExpiry := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "access_token_expiry_seconds",
+		Help:      "Seconds until the access token expires (0 if not initialised).",
+	}, func() float64 {
+		t.locker.Lock()
+		defer t.locker.Unlock()
+		return secondsUntil(t.AccessToken, t.AccessTokenExpiryUTC)
+	})
+	refreshExpiry := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "refresh_token_expiry_seconds",
+		Help:      "Seconds until the refresh token expires (0 if not initialised).",
+	}, func() float64 {
+		t.locker.Lock()
+		defer t.locker.Unlock()
+		return secondsUntil(t.RefreshToken, t.RefreshTokenExpiryUTC)
+	})
+	failures := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "consecutive_refresh_failures",
+		Help:      "Number of consecutive failed refreshes.",
+	}, func() float64 {
+		return float64(t.RefreshFailureStatus().ConsecutiveFailures)
+	})
+	loggedIn := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "logged_in",
+		Help:      "1 if client credentials have been provided, otherwise 0.",
+	}, func() float64 {
+		if t.State() != StateUnconfigured {
+			return 1
+		}
+		return 0
+	})
+
+	m.registry.MustRegister(
+		m.refreshAttempts,
+		m.refreshSuccesses,
+		m.refreshFailures,
+		m.refreshDuration,
+		m.xeroResponses,
+		m.requests,
+		accessExpiry,
+		refreshExpiry,
+		failures,
+		loggedIn,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// secondsUntil reports the seconds until expiry, or 0 if token is empty
+func secondsUntil(token string, expiry time.Time) float64 {
+	if token == "" {
+		return 0
+	}
+	return time.Until(expiry).Seconds()
+}
+
+// refreshed records the outcome and duration of a refresh attempt
+func (m *metrics) refreshed(started time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.refreshAttempts.Inc()
+	m.refreshDuration.Observe(time.Since(started).Seconds())
+	if err == nil {
+		m.refreshSuccesses.Inc()
+		return
+	}
+	m.refreshFailures.WithLabelValues(failureCause(err)).Inc()
+}
+
+// xeroResponse records the status code of a response from a Xero
+// endpoint
+func (m *metrics) xeroResponse(endpoint string, code int) {
+	if m == nil {
+		return
+	}
+	m.xeroResponses.WithLabelValues(endpoint, strconv.Itoa(code)).Inc()
+}
+
+// failureCause classifies an error for the refresh_failures_total
+// cause label
+func failureCause(err error) string {
+	var httpErr *HTTPClientError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &httpErr):
+		return "http_" + strconv.Itoa(httpErr.code)
+	case errors.As(err, &netErr):
+		return "network"
+	case errors.Is(err, ErrNotLoggedIn):
+		return "not_logged_in"
+	case errors.Is(err, ErrNotInitialised):
+		return "not_initialised"
+	case err.Error() == "empty response received from server":
+		return "empty_response"
+	}
+	return "other"
+}
+
+// HandleMetrics serves the token metrics in the prometheus exposition
+// format
+func (t *Token) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	if t.metrics == nil {
+		http.Error(w, "metrics not initialised", http.StatusInternalServerError)
+		return
+	}
+	promhttp.HandlerFor(t.metrics.registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// InstrumentHandler wraps next to count requests to endpoint by status
+// code in the token metrics
+func (t *Token) InstrumentHandler(endpoint string, next http.Handler) http.Handler {
+	if t.metrics == nil {
+		return next
+	}
+	counter := t.metrics.requests.MustCurryWith(prometheus.Labels{"endpoint": endpoint})
+	return promhttp.InstrumentHandlerCounter(counter, next)
+}
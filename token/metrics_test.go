@@ -0,0 +1,103 @@
+package token
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rorycl/XeroOauthTokenServer/xerotest"
+)
+
+func TestHandleMetrics(t *testing.T) {
+	token := initToken()
+	token.AccessToken = "abc"
+	token.RefreshToken = "def"
+
+	err := loadCredentials(token)
+	if err != nil {
+		t.Fatalf("could not add client credentials %s", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error": "invalid_grant"}`))
+	}))
+	defer server.Close()
+	token.tokenURL = server.URL
+
+	_ = token.Refresh()
+
+	handler := token.InstrumentHandler("/metrics", http.HandlerFunc(token.HandleMetrics))
+	req := httptest.NewRequest("GET", "http://127.0.0.1:5001/metrics", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	resp := w.Result()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Status code %d != 200", resp.StatusCode)
+	}
+	for _, want := range []string{
+		"xerotokenserver_refresh_attempts_total 1",
+		`xerotokenserver_refresh_failures_total{cause="http_401"} 1`,
+		`xerotokenserver_xero_responses_total{code="401",endpoint="token"} 1`,
+		"xerotokenserver_refresh_duration_seconds_count 1",
+		"xerotokenserver_logged_in 1",
+		"xerotokenserver_access_token_expiry_seconds",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics output does not contain %q", want)
+		}
+	}
+}
+
+// TestMetricsDuringRefresh scrapes the metrics while the token is
+// refreshed, for the race detector
+func TestMetricsDuringRefresh(t *testing.T) {
+	x := xerotest.NewServer()
+	defer x.Close()
+	token := xeroToken(t, x)
+	consent(t, token)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			if err := token.Refresh(); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		w := httptest.NewRecorder()
+		token.HandleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+		if !strings.Contains(w.Body.String(), "xerotokenserver_refresh_token_expiry_seconds") {
+			t.Fatal("metrics output does not contain the refresh token expiry")
+		}
+	}
+	wg.Wait()
+}
+
+func TestFailureCause(t *testing.T) {
+	tests := []struct {
+		err   error
+		cause string
+	}{
+		{&HTTPClientError{code: 400}, "http_400"},
+		{ErrNotLoggedIn, "not_logged_in"},
+		{ErrNotInitialised, "not_initialised"},
+		{errors.New("empty response received from server"), "empty_response"},
+		{errors.New("something else"), "other"},
+	}
+	for _, tt := range tests {
+		if got := failureCause(tt.err); got != tt.cause {
+			t.Errorf("failureCause(%s) want(%s) got(%s)", tt.err, tt.cause, got)
+		}
+	}
+}
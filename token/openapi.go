@@ -0,0 +1,17 @@
+package token
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// OpenAPI is the OpenAPI 3 description of the json api
+//
+//go:embed openapi.json
+var OpenAPI []byte
+
+// HandleOpenAPI serves the OpenAPI document describing the json api
+func (t *Token) HandleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(OpenAPI)
+}
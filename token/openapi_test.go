@@ -0,0 +1,307 @@
+package token
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadOpenAPI decodes the embedded OpenAPI document
+func loadOpenAPI(t *testing.T) map[string]interface{} {
+	t.Helper()
+	var doc map[string]interface{}
+	if err := json.Unmarshal(OpenAPI, &doc); err != nil {
+		t.Fatalf("openapi document is not valid json: %v", err)
+	}
+	return doc
+}
+
+// resolve follows a local "#/..." $ref in the document
+func resolve(doc map[string]interface{}, node map[string]interface{}) map[string]interface{} {
+	ref, ok := node["$ref"].(string)
+	if !ok {
+		return node
+	}
+	var n interface{} = doc
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		n = n.(map[string]interface{})[part]
+	}
+	return resolve(doc, n.(map[string]interface{}))
+}
+
+// validate checks value against the subset of json schema used by the
+// OpenAPI document
+func validate(doc, schema map[string]interface{}, value interface{}, at string) error {
+	schema = resolve(doc, schema)
+	if value == nil {
+		if schema["nullable"] == true {
+			return nil
+		}
+		return fmt.Errorf("%s: unexpected null", at)
+	}
+	switch schema["type"] {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %v is not an object", at, value)
+		}
+		if req, ok := schema["required"].([]interface{}); ok {
+			for _, r := range req {
+				if _, ok := obj[r.(string)]; !ok {
+					return fmt.Errorf("%s: missing required property %s", at, r)
+				}
+			}
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		for k, v := range obj {
+			p, ok := props[k]
+			if !ok {
+				return fmt.Errorf("%s: undocumented property %s", at, k)
+			}
+			if err := validate(doc, p.(map[string]interface{}), v, at+"."+k); err != nil {
+				return err
+			}
+		}
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %v is not an array", at, value)
+		}
+		for i, v := range arr {
+			if err := validate(doc, schema["items"].(map[string]interface{}), v, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: %v is not a string", at, value)
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+				return fmt.Errorf("%s: %s is not a date-time", at, s)
+			}
+		}
+	case "integer":
+		n, ok := value.(float64)
+		if !ok || n != float64(int64(n)) {
+			return fmt.Errorf("%s: %v is not an integer", at, value)
+		}
+		if min, ok := schema["minimum"].(float64); ok && n < min {
+			return fmt.Errorf("%s: %v is less than %v", at, n, min)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: %v is not a boolean", at, value)
+		}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		for _, e := range enum {
+			if e == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: %v is not one of %v", at, value, enum)
+	}
+	return nil
+}
+
+// fakeXero serves the Xero token, connections and revocation endpoints
+func fakeXero() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			w.Write([]byte(`{"access_token": "abc", "refresh_token": "def", "expires_in": 1800}`))
+		case "/connections":
+			w.Write([]byte(`[{
+				"id": "5010b97c-1d4f-11ec-821e-4756fdf46484",
+				"authEventId": "55c8fb68-1d4f-11ec-aeb7-3b421a2838d0",
+				"tenantId": "87d9664c-1d4f-11ec-ba64-af1d5e634f86",
+				"tenantType": "ORGANISATION",
+				"tenantName": "My Glorious Organization",
+				"createdDateUtc": "2021-07-01T20:55:00.5717400",
+				"updatedDateUtc": "2021-09-21T19:44:35.5610020"
+			}]`))
+		case "/revocation":
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_grant"}`))
+		}
+	}))
+}
+
+// TestOpenAPIRoutes exercises each documented operation and validates
+// the responses against the OpenAPI document
+func TestOpenAPIRoutes(t *testing.T) {
+	doc := loadOpenAPI(t)
+	if doc["openapi"] != "3.0.3" {
+		t.Errorf("unexpected openapi version %v", doc["openapi"])
+	}
+
+	xero := fakeXero()
+	defer xero.Close()
+
+	ready := func(token *Token) {
+		if err := loadCredentials(token); err != nil {
+			t.Fatalf("could not add client credentials %s", err)
+		}
+		token.AccessToken = "abc"
+		token.RefreshToken = "def"
+		token.AccessTokenExpiryUTC = time.Now().UTC().Add(10 * time.Minute)
+		token.RefreshTokenExpiryUTC = time.Now().UTC().Add(24 * time.Hour)
+		token.tokenURL = xero.URL + "/token"
+		token.tenantURL = xero.URL + "/connections"
+		token.revokeURL = xero.URL + "/revocation"
+		activate(token)
+	}
+	failing := func(token *Token) {
+		ready(token)
+		token.AccessTokenExpiryUTC = time.Now().UTC().Add(-time.Minute)
+		token.tokenURL = xero.URL + "/fail"
+		token.tenantURL = xero.URL + "/fail"
+		token.revokeURL = xero.URL + "/fail"
+	}
+	notLoggedIn := func(token *Token) {}
+
+	// handlers for each documented path; these are the handlers routed
+	// under APIPrefix in main.go
+	handlers := func(token *Token) map[string]http.HandlerFunc {
+		return map[string]http.HandlerFunc{
+			"/api/v1/livez":   token.HandleLivez,
+			"/api/v1/readyz":  token.HandleReadyz,
+			"/api/v1/status":  token.HandleStatus,
+			"/api/v1/token":   token.HandleAccessToken,
+			"/api/v1/refresh": token.HandleRefresh,
+			"/api/v1/tenants": token.HandleTenants,
+			"/api/v1/revoke":  token.HandleRevoke,
+			"/api/v1/logout":  token.HandleLogout,
+		}
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		query  string
+		setup  func(*Token)
+		status int
+	}{
+		{"GET", "/api/v1/livez", "", ready, 200},
+		{"GET", "/api/v1/livez", "", notLoggedIn, 200},
+		{"GET", "/api/v1/readyz", "", ready, 200},
+		{"GET", "/api/v1/readyz", "", notLoggedIn, 503},
+		{"GET", "/api/v1/status", "", ready, 200},
+		{"GET", "/api/v1/status", "", notLoggedIn, 503},
+		{"GET", "/api/v1/token", "", ready, 200},
+		{"GET", "/api/v1/token", "?after=0&wait=1ms", ready, 200},
+		{"GET", "/api/v1/token", "?after=x", ready, 400},
+		{"GET", "/api/v1/token", "", failing, 502},
+		{"GET", "/api/v1/token", "", notLoggedIn, 503},
+		{"POST", "/api/v1/refresh", "", ready, 200},
+		{"GET", "/api/v1/refresh", "", ready, 405},
+		{"POST", "/api/v1/refresh", "", failing, 502},
+		{"POST", "/api/v1/refresh", "", notLoggedIn, 503},
+		{"GET", "/api/v1/tenants", "", ready, 200},
+		{"GET", "/api/v1/tenants", "", failing, 502},
+		{"GET", "/api/v1/tenants", "", notLoggedIn, 503},
+		{"POST", "/api/v1/revoke", "", ready, 200},
+		{"GET", "/api/v1/revoke", "", ready, 405},
+		{"POST", "/api/v1/revoke", "", failing, 502},
+		{"POST", "/api/v1/revoke", "", notLoggedIn, 503},
+		{"POST", "/api/v1/logout", "", ready, 200},
+		{"GET", "/api/v1/logout", "", ready, 405},
+	}
+
+	paths := doc["paths"].(map[string]interface{})
+	exercised := map[string]bool{}
+
+	for _, tt := range tests {
+		name := fmt.Sprintf("%s %s%s %d", tt.method, tt.path, tt.query, tt.status)
+		token := initToken()
+		tt.setup(token)
+		handler, ok := handlers(token)[tt.path]
+		if !ok {
+			t.Fatalf("%s: no handler", name)
+		}
+
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(tt.method, "http://127.0.0.1:5001"+tt.path+tt.query, nil))
+		if w.Code != tt.status {
+			t.Errorf("%s: Status code %d != %d: %s", name, w.Code, tt.status, w.Body.String())
+			continue
+		}
+
+		// the documented operation, or any documented operation on the
+		// path for 405 responses
+		item, ok := paths[tt.path].(map[string]interface{})
+		if !ok {
+			t.Errorf("%s: path not documented", name)
+			continue
+		}
+		var op map[string]interface{}
+		for m, o := range item {
+			if strings.EqualFold(m, tt.method) || tt.status == http.StatusMethodNotAllowed {
+				op = o.(map[string]interface{})
+			}
+		}
+		if op == nil {
+			t.Errorf("%s: operation not documented", name)
+			continue
+		}
+		exercised[tt.path+" "+strings.ToLower(tt.method)] = true
+
+		responses := op["responses"].(map[string]interface{})
+		response, ok := responses[strconv.Itoa(w.Code)].(map[string]interface{})
+		if !ok {
+			t.Errorf("%s: response status not documented", name)
+			continue
+		}
+		response = resolve(doc, response)
+		ct, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+		media, ok := response["content"].(map[string]interface{})[ct].(map[string]interface{})
+		if !ok {
+			t.Errorf("%s: content type %s not documented", name, ct)
+			continue
+		}
+		var body interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s: invalid json response %s", name, w.Body.String())
+			continue
+		}
+		if err := validate(doc, media["schema"].(map[string]interface{}), body, "body"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	// every documented operation must be exercised
+	for path, item := range paths {
+		for method := range item.(map[string]interface{}) {
+			if !exercised[path+" "+method] {
+				t.Errorf("documented operation %s %s is not tested", method, path)
+			}
+		}
+	}
+}
+
+func TestHandleOpenAPI(t *testing.T) {
+	token := initToken()
+	w := httptest.NewRecorder()
+	token.HandleOpenAPI(w, httptest.NewRequest("GET", "http://127.0.0.1:5001/openapi.json", nil))
+
+	if w.Code != 200 {
+		t.Errorf("Status code %d != 200", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content type unexpected: %s", ct)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Errorf("invalid openapi document: %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package token
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RefreshPolicy decides when the background refresher refreshes the
+// token to keep the refresh token alive. Due is called on each tick of
+// the refresher (every minute) while the token is usable.
+type RefreshPolicy interface {
+	Due(now time.Time, lastRefresh, refreshExpiry time.Time) bool
+	String() string
+}
+
+// beforeExpiry refreshes when the refresh token is within margin of
+// expiry
+type beforeExpiry struct {
+	margin time.Duration
+}
+
+// BeforeExpiry returns a RefreshPolicy which refreshes when the refresh
+// token is within margin of its expiry
+func BeforeExpiry(margin time.Duration) RefreshPolicy {
+	return beforeExpiry{margin}
+}
+
+func (p beforeExpiry) Due(now, lastRefresh, refreshExpiry time.Time) bool {
+	return now.After(refreshExpiry.Add(-p.margin))
+}
+
+func (p beforeExpiry) String() string {
+	return fmt.Sprintf("before expiry (%s)", p.margin)
+}
+
+// fixedInterval refreshes every interval
+type fixedInterval struct {
+	interval time.Duration
+}
+
+// FixedInterval returns a RefreshPolicy which refreshes every interval
+// to keep the refresh token alive, regardless of its expiry
+func FixedInterval(interval time.Duration) RefreshPolicy {
+	return fixedInterval{interval}
+}
+
+func (p fixedInterval) Due(now, lastRefresh, refreshExpiry time.Time) bool {
+	return !now.Before(lastRefresh.Add(p.interval))
+}
+
+func (p fixedInterval) String() string {
+	return fmt.Sprintf("every %s", p.interval)
+}
+
+// fractionOfLifetime refreshes after a fraction of the refresh token
+// lifetime has elapsed
+type fractionOfLifetime struct {
+	fraction float64
+}
+
+// FractionOfLifetime returns a RefreshPolicy which refreshes once
+// fraction (between 0 and 1) of the refresh token's lifetime has
+// elapsed
+func FractionOfLifetime(fraction float64) (RefreshPolicy, error) {
+	if fraction <= 0 || fraction >= 1 {
+		return nil, fmt.Errorf("refresh fraction %g must be between 0 and 1", fraction)
+	}
+	return fractionOfLifetime{fraction}, nil
+}
+
+func (p fractionOfLifetime) Due(now, lastRefresh, refreshExpiry time.Time) bool {
+	lifetime := refreshExpiry.Sub(lastRefresh)
+	return !now.Before(lastRefresh.Add(time.Duration(float64(lifetime) * p.fraction)))
+}
+
+func (p fractionOfLifetime) String() string {
+	return fmt.Sprintf("after %g of lifetime", p.fraction)
+}
+
+// maintenanceWindow restricts another policy to daily hours
+type maintenanceWindow struct {
+	policy     RefreshPolicy
+	start, end time.Duration // offsets from midnight
+	loc        *time.Location
+}
+
+// MaintenanceWindow returns a RefreshPolicy which only refreshes when
+// policy is due and the time in loc is within the daily window, given
+// as "HH:MM-HH:MM" and which may span midnight. A due refresh is made
+// outside the window if the refresh token would otherwise expire
+// before the window next opens. As a BeforeExpiry policy is only due
+// shortly before expiry, with it the refresh is instead brought
+// forward into the last window which opens before the policy is due.
+func MaintenanceWindow(policy RefreshPolicy, window string, loc *time.Location) (RefreshPolicy, error) {
+	from, to, ok := strings.Cut(window, "-")
+	if !ok {
+		return nil, fmt.Errorf("maintenance window %q should be HH:MM-HH:MM", window)
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return nil, fmt.Errorf("maintenance window %q start: %w", window, err)
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return nil, fmt.Errorf("maintenance window %q end: %w", window, err)
+	}
+	if start == end {
+		return nil, fmt.Errorf("maintenance window %q is empty", window)
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+	return maintenanceWindow{policy: policy, start: start, end: end, loc: loc}, nil
+}
+
+// parseClock parses HH:MM as an offset from midnight
+func parseClock(s string) (time.Duration, error) {
+	c, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(c.Hour())*time.Hour + time.Duration(c.Minute())*time.Minute, nil
+}
+
+// clock returns the wall clock time at offset from midnight on the day
+// of t, which is not a fixed period after midnight on days when the
+// clocks change
+func clock(t time.Time, offset time.Duration) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, int(offset/time.Hour), int(offset%time.Hour/time.Minute), 0, 0, t.Location())
+}
+
+// open reports if now is within the window
+func (p maintenanceWindow) open(now time.Time) bool {
+	local := now.In(p.loc)
+	start, end := clock(local, p.start), clock(local, p.end)
+	if p.start < p.end {
+		return !local.Before(start) && local.Before(end)
+	}
+	return !local.Before(start) || local.Before(end)
+}
+
+// nextOpen returns the time the window next opens after now
+func (p maintenanceWindow) nextOpen(now time.Time) time.Time {
+	local := now.In(p.loc)
+	next := clock(local, p.start)
+	if !next.After(local) {
+		next = clock(local.AddDate(0, 0, 1), p.start)
+	}
+	return next
+}
+
+func (p maintenanceWindow) Due(now, lastRefresh, refreshExpiry time.Time) bool {
+	if b, ok := p.policy.(beforeExpiry); ok && p.open(now) {
+		// no later window opens before the policy is due
+		if !p.nextOpen(now).Before(refreshExpiry.Add(-b.margin)) {
+			return true
+		}
+	}
+	if !p.policy.Due(now, lastRefresh, refreshExpiry) {
+		return false
+	}
+	return p.open(now) || !p.nextOpen(now).Before(refreshExpiry)
+}
+
+func (p maintenanceWindow) String() string {
+	hhmm := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return fmt.Sprintf("%s within %s-%s %s", p.policy, hhmm(p.start), hhmm(p.end), p.loc)
+}
+
+// SetRefreshPolicy sets the policy deciding when the background
+// refresher refreshes the refresh token; by default the token is
+// refreshed shortly before the refresh token expires
+func (t *Token) SetRefreshPolicy(p RefreshPolicy) {
+	t.locker.Lock()
+	t.policy = p
+	t.locker.Unlock()
+}
+
+// refreshPolicy returns the refresh policy; the caller must hold the
+// lock
+func (t *Token) refreshPolicy() RefreshPolicy {
+	if t.policy == nil {
+		return BeforeExpiry(t.expirySecs)
+	}
+	return t.policy
+}
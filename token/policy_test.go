@@ -0,0 +1,159 @@
+package token
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRefreshPolicies(t *testing.T) {
+	last := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	expiry := last.Add(100 * time.Hour)
+
+	fraction, err := FractionOfLifetime(0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		policy RefreshPolicy
+		now    time.Time
+		due    bool
+	}{
+		{BeforeExpiry(time.Hour), last.Add(98 * time.Hour), false},
+		{BeforeExpiry(time.Hour), last.Add(99*time.Hour + time.Minute), true},
+		{FixedInterval(24 * time.Hour), last.Add(23 * time.Hour), false},
+		{FixedInterval(24 * time.Hour), last.Add(24 * time.Hour), true},
+		{fraction, last.Add(49 * time.Hour), false},
+		{fraction, last.Add(50 * time.Hour), true},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.Due(tt.now, last, expiry); got != tt.due {
+			t.Errorf("%s at %s want(%t) got(%t)", tt.policy, tt.now, tt.due, got)
+		}
+	}
+
+	for _, f := range []float64{0, 1, 1.5, -0.1} {
+		if _, err := FractionOfLifetime(f); err == nil {
+			t.Errorf("expected error for fraction %g", f)
+		}
+	}
+}
+
+func TestMaintenanceWindow(t *testing.T) {
+	last := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	expiry := last.Add(30 * 24 * time.Hour)
+
+	overnight, err := MaintenanceWindow(FixedInterval(time.Hour), "22:00-04:30", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	daytime, err := MaintenanceWindow(FixedInterval(time.Hour), "09:00-17:00", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		policy RefreshPolicy
+		now    time.Time
+		due    bool
+	}{
+		{overnight, time.Date(2024, 1, 1, 12, 30, 0, 0, time.UTC), false}, // policy not due
+		{overnight, time.Date(2024, 1, 1, 15, 0, 0, 0, time.UTC), false},  // outside window
+		{overnight, time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC), true},
+		{overnight, time.Date(2024, 1, 2, 4, 0, 0, 0, time.UTC), true},
+		{overnight, time.Date(2024, 1, 2, 4, 30, 0, 0, time.UTC), false},
+		{daytime, time.Date(2024, 1, 1, 16, 59, 0, 0, time.UTC), true},
+		{daytime, time.Date(2024, 1, 1, 17, 0, 0, 0, time.UTC), false},
+		{daytime, time.Date(2024, 1, 2, 8, 0, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.Due(tt.now, last, expiry); got != tt.due {
+			t.Errorf("%s at %s want(%t) got(%t)", tt.policy, tt.now, tt.due, got)
+		}
+	}
+
+	// refresh outside the window rather than let the token expire
+	soon := time.Date(2024, 1, 1, 18, 0, 0, 0, time.UTC)
+	if !daytime.Due(soon, last, soon.Add(2*time.Hour)) {
+		t.Error("expected a refresh outside the window before expiry")
+	}
+
+	for _, w := range []string{"", "09:00", "9-17", "09:00-09:00", "25:00-01:00"} {
+		if _, err := MaintenanceWindow(FixedInterval(time.Hour), w, time.UTC); err == nil {
+			t.Errorf("expected error for window %q", w)
+		}
+	}
+}
+
+func TestMaintenanceWindowBeforeExpiry(t *testing.T) {
+	last := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	expiry := time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)
+	policy, err := MaintenanceWindow(BeforeExpiry(time.Minute), "22:00-04:00", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		now time.Time
+		due bool
+	}{
+		{time.Date(2024, 1, 8, 23, 0, 0, 0, time.UTC), false},   // a later window opens before expiry
+		{time.Date(2024, 1, 9, 15, 0, 0, 0, time.UTC), false},   // outside window
+		{time.Date(2024, 1, 9, 23, 0, 0, 0, time.UTC), true},    // the last window before expiry
+		{time.Date(2024, 1, 10, 3, 59, 0, 0, time.UTC), true},   // still the last window
+		{time.Date(2024, 1, 10, 11, 59, 30, 0, time.UTC), true}, // due outside the window
+	}
+	for _, tt := range tests {
+		if got := policy.Due(tt.now, last, expiry); got != tt.due {
+			t.Errorf("%s at %s want(%t) got(%t)", policy, tt.now, tt.due, got)
+		}
+	}
+}
+
+func TestMaintenanceWindowDST(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip("no time zone database")
+	}
+	last := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	expiry := last.Add(60 * 24 * time.Hour)
+	policy, err := MaintenanceWindow(FixedInterval(time.Hour), "03:00-04:00", london)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the clocks go forward an hour at 01:00 GMT on 29 March 2026, when
+	// 03:00 local time is 02:00 UTC
+	tests := []struct {
+		now time.Time
+		due bool
+	}{
+		{time.Date(2026, 3, 29, 1, 30, 0, 0, time.UTC), false}, // 02:30 BST
+		{time.Date(2026, 3, 29, 2, 10, 0, 0, time.UTC), true},  // 03:10 BST
+		{time.Date(2026, 3, 29, 3, 10, 0, 0, time.UTC), false}, // 04:10 BST
+	}
+	for _, tt := range tests {
+		if got := policy.Due(tt.now, last, expiry); got != tt.due {
+			t.Errorf("%s at %s want(%t) got(%t)", policy, tt.now.In(london), tt.due, got)
+		}
+	}
+}
+
+func TestRefresherPolicy(t *testing.T) {
+	token := initToken()
+	token.AccessToken = "abc"
+	token.RefreshToken = "def"
+	token.RefreshTokenExpiryUTC = time.Now().UTC().Add(24 * time.Hour)
+	if err := loadCredentials(token); err != nil {
+		t.Fatalf("could not add client credentials %s", err)
+	}
+	token.refreshedAt = time.Now().UTC().Add(-2 * time.Hour)
+
+	if token.expiring() {
+		t.Error("default policy should not refresh a day before expiry")
+	}
+	token.SetRefreshPolicy(FixedInterval(time.Hour))
+	if !token.expiring() {
+		t.Error("interval policy should refresh after an hour")
+	}
+}
@@ -0,0 +1,136 @@
+package token
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// APIPrefix is the path prefix of the versioned json api
+const APIPrefix = "/api/v1"
+
+// ProblemContentType is the content type of error responses
+const ProblemContentType = "application/problem+json"
+
+// Machine readable error codes reported in Problem responses
+const (
+	ErrCodeBadRequest       = "bad_request"
+	ErrCodeMethodNotAllowed = "method_not_allowed"
+	ErrCodeUnauthorized     = "unauthorized"
+	ErrCodeForbidden        = "forbidden"
+	ErrCodeInvalidCSRF      = "invalid_csrf"
+	ErrCodeNotLoggedIn      = "not_logged_in"
+	ErrCodeNotInitialised   = "not_initialised"
+	ErrCodeXeroUnauthorized = "xero_unauthorized"
+	ErrCodeRateLimited      = "rate_limited"
+	ErrCodeRefreshFailed    = "refresh_failed"
+	ErrCodeRevokeFailed     = "revoke_failed"
+	ErrCodeXeroUnavailable  = "xero_unavailable"
+	ErrCodeXeroError        = "xero_error"
+	ErrCodeInternal         = "internal_error"
+)
+
+// problemTypePrefix prefixes the error code to form the problem type
+// uri
+const problemTypePrefix = "urn:xerooauthtokenserver:problem:"
+
+// Problem is an RFC 9457 problem details error response, extended with
+// a machine readable error code
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Code   string `json:"code"`
+}
+
+// WriteProblem writes an application/problem+json error response.
+// Secrets in detail are redacted.
+func WriteProblem(w http.ResponseWriter, status int, code, detail string) {
+	p := Problem{
+		Type:   problemTypePrefix + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: Redact(detail),
+		Code:   code,
+	}
+	j, _ := json.Marshal(p)
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(j)
+}
+
+// problem logs and writes a Problem response; server errors are
+// logged at error level and client errors at warn level
+func (t *Token) problem(w http.ResponseWriter, status int, code, detail string) {
+	if status >= 500 {
+		t.logger().Error(detail, "problem", code, "status", status)
+	} else {
+		t.logger().Warn(detail, "problem", code, "status", status)
+	}
+	WriteProblem(w, status, code, detail)
+}
+
+// xeroProblem classifies an error from a call to Xero, returning the
+// response status and error code, using fallback as the code for
+// errors reported by Xero which are not otherwise classified. A token
+// which became unusable before the call reports the same problem as
+// ready.
+func xeroProblem(w http.ResponseWriter, err error, fallback string) (int, string) {
+	var httpErr *HTTPClientError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrNotLoggedIn):
+		return http.StatusServiceUnavailable, ErrCodeNotLoggedIn
+	case errors.Is(err, ErrNotInitialised):
+		return http.StatusServiceUnavailable, ErrCodeNotInitialised
+	case errors.As(err, &httpErr) && httpErr.code == http.StatusTooManyRequests:
+		if httpErr.retryAfter != "" {
+			w.Header().Set("Retry-After", httpErr.retryAfter)
+		}
+		return http.StatusTooManyRequests, ErrCodeRateLimited
+	case errors.As(err, &httpErr) && (httpErr.code == http.StatusUnauthorized || httpErr.code == http.StatusForbidden):
+		return http.StatusBadGateway, ErrCodeXeroUnauthorized
+	case errors.As(err, &httpErr):
+		return http.StatusBadGateway, fallback
+	case errors.As(err, &netErr):
+		return http.StatusGatewayTimeout, ErrCodeXeroUnavailable
+	}
+	return http.StatusBadGateway, fallback
+}
+
+// ready writes a Problem and returns false if the token cannot yet be
+// used, because client credentials have not been provided or no token
+// has been obtained from Xero
+func (t *Token) ready(w http.ResponseWriter) bool {
+	switch err := t.State().usableErr(); err {
+	case nil:
+		return true
+	case ErrNotLoggedIn:
+		t.problem(w, http.StatusServiceUnavailable, ErrCodeNotLoggedIn, "client has not logged in")
+	default:
+		t.problem(w, http.StatusServiceUnavailable, ErrCodeNotInitialised, "system has not been initialised or is in an error state")
+	}
+	return false
+}
+
+// isAPI reports if a json response is required rather than a redirect,
+// either because the request is to the versioned api or because the
+// client prefers json
+func isAPI(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, APIPrefix+"/") || wantsJSON(r)
+}
+
+// writeJSON writes v as a json response
+func (t *Token) writeJSON(w http.ResponseWriter, v interface{}) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		t.problem(w, http.StatusInternalServerError, ErrCodeInternal, "json encoding error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
@@ -0,0 +1,154 @@
+package token
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func decodeProblem(t *testing.T, w *httptest.ResponseRecorder) Problem {
+	t.Helper()
+	if ct := w.Header().Get("Content-Type"); ct != ProblemContentType {
+		t.Fatalf("Content type unexpected: %s", ct)
+	}
+	var p Problem
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+		t.Fatalf("could not decode problem %s: %v", w.Body.String(), err)
+	}
+	return p
+}
+
+func TestWriteProblem(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteProblem(w, http.StatusServiceUnavailable, ErrCodeNotLoggedIn, "refresh_token=secret failed")
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Status code %d != 503", w.Code)
+	}
+	p := decodeProblem(t, w)
+	if p.Status != 503 || p.Code != ErrCodeNotLoggedIn || p.Title != "Service Unavailable" {
+		t.Errorf("unexpected problem %+v", p)
+	}
+	if p.Type != "urn:xerooauthtokenserver:problem:not_logged_in" {
+		t.Errorf("unexpected problem type %s", p.Type)
+	}
+	if strings.Contains(p.Detail, "secret") {
+		t.Errorf("problem detail not redacted: %s", p.Detail)
+	}
+}
+
+func TestProblemNotLoggedIn(t *testing.T) {
+	token := initToken()
+
+	for name, handler := range map[string]http.HandlerFunc{
+		"token":   token.HandleAccessToken,
+		"status":  token.HandleStatus,
+		"tenants": token.HandleTenants,
+	} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "http://127.0.0.1:5001/api/v1/"+name, nil))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: Status code %d != 503", name, w.Code)
+		}
+		if p := decodeProblem(t, w); p.Code != ErrCodeNotLoggedIn {
+			t.Errorf("%s: code %s != %s", name, p.Code, ErrCodeNotLoggedIn)
+		}
+	}
+}
+
+func TestProblemXeroErrors(t *testing.T) {
+	tests := []struct {
+		xeroStatus int
+		status     int
+		code       string
+	}{
+		{http.StatusTooManyRequests, http.StatusTooManyRequests, ErrCodeRateLimited},
+		{http.StatusUnauthorized, http.StatusBadGateway, ErrCodeXeroUnauthorized},
+		{http.StatusBadRequest, http.StatusBadGateway, ErrCodeRefreshFailed},
+	}
+	for _, tt := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(tt.xeroStatus)
+			w.Write([]byte(`{"error": "nope"}`))
+		}))
+
+		token := initToken()
+		token.AccessToken = "abc"
+		token.RefreshToken = "def"
+		if err := loadCredentials(token); err != nil {
+			t.Fatalf("could not add client credentials %s", err)
+		}
+		token.tokenURL = server.URL
+
+		w := httptest.NewRecorder()
+		token.HandleRefresh(w, httptest.NewRequest("POST", "http://127.0.0.1:5001/api/v1/refresh", nil))
+		server.Close()
+
+		if w.Code != tt.status {
+			t.Errorf("xero %d: Status code %d != %d", tt.xeroStatus, w.Code, tt.status)
+		}
+		if p := decodeProblem(t, w); p.Code != tt.code {
+			t.Errorf("xero %d: code %s != %s", tt.xeroStatus, p.Code, tt.code)
+		}
+		if tt.code == ErrCodeRateLimited && w.Header().Get("Retry-After") != "60" {
+			t.Errorf("Retry-After not passed through: %q", w.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestProblemUnusableToken(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		code string
+	}{
+		{ErrNotLoggedIn, ErrCodeNotLoggedIn},
+		{fmt.Errorf("refresh: %w", ErrNotInitialised), ErrCodeNotInitialised},
+	} {
+		status, code := xeroProblem(httptest.NewRecorder(), tt.err, ErrCodeRefreshFailed)
+		if status != http.StatusServiceUnavailable || code != tt.code {
+			t.Errorf("%v: got %d %s, want 503 %s", tt.err, status, code, tt.code)
+		}
+	}
+}
+
+func TestAPIRefreshReturnsJSON(t *testing.T) {
+	token := initToken()
+	token.AccessToken = "abc"
+	token.RefreshToken = "def"
+	if err := loadCredentials(token); err != nil {
+		t.Fatalf("could not add client credentials %s", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "abc", "refresh_token": "def", "expires_in": 1800}`))
+	}))
+	defer server.Close()
+	token.tokenURL = server.URL
+
+	w := httptest.NewRecorder()
+	token.HandleRefresh(w, httptest.NewRequest("POST", "http://127.0.0.1:5001/api/v1/refresh", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Status code %d != 200", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content type unexpected: %s", ct)
+	}
+	if !strings.Contains(w.Body.String(), `"refreshed"`) {
+		t.Errorf("unexpected body %s", w.Body.String())
+	}
+}
+
+func TestRequirePostProblem(t *testing.T) {
+	w := httptest.NewRecorder()
+	if requirePost(w, httptest.NewRequest("GET", "/api/v1/revoke", nil)) {
+		t.Fatal("GET should not be allowed")
+	}
+	if p := decodeProblem(t, w); p.Code != ErrCodeMethodNotAllowed || p.Status != 405 {
+		t.Errorf("unexpected problem %+v", p)
+	}
+}
@@ -0,0 +1,152 @@
+package token
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Redacted replaces sensitive values in logs and error messages
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are normalised (lower case, without "_" or "-") names
+// of fields, query parameters and log attributes holding secrets
+var sensitiveKeys = map[string]bool{
+	"accesstoken":   true,
+	"refreshtoken":  true,
+	"idtoken":       true,
+	"token":         true,
+	"code":          true,
+	"state":         true,
+	"secret":        true,
+	"clientsecret":  true,
+	"authorization": true,
+	"password":      true,
+	"apikey":        true,
+}
+
+// IsSensitive reports if key names a field holding a secret
+func IsSensitive(key string) bool {
+	k := strings.ToLower(key)
+	k = strings.ReplaceAll(k, "_", "")
+	k = strings.ReplaceAll(k, "-", "")
+	return sensitiveKeys[k]
+}
+
+// Mask returns Redacted for a non-empty s
+func Mask(s string) string {
+	if s == "" {
+		return ""
+	}
+	return Redacted
+}
+
+var (
+	// "access_token": "...", as found in json bodies
+	redactJSONField = regexp.MustCompile(`(?i)("(?:access_token|refresh_token|id_token|accessToken|refreshToken|token|code|state|client_secret|secret|password)"\s*:\s*")[^"]*(")`)
+	// access_token=... as found in query strings and form bodies
+	redactQueryField = regexp.MustCompile(`(?i)\b((?:access_token|refresh_token|id_token|token|code|state|client_secret|secret|password)=)[^&\s"]+`)
+	// authorization header values
+	redactBearer = regexp.MustCompile(`(?i)\b(Bearer|Basic)\s+[A-Za-z0-9\-._~+/]+=*`)
+	// JWT shaped strings, such as Xero access tokens
+	redactJWT = regexp.MustCompile(`eyJ[A-Za-z0-9\-_]+\.[A-Za-z0-9\-_]+\.[A-Za-z0-9\-_]*`)
+)
+
+// Redact masks secrets embedded in free text such as error messages,
+// response bodies and urls
+func Redact(s string) string {
+	s = redactJSONField.ReplaceAllString(s, "${1}"+Redacted+"${2}")
+	s = redactQueryField.ReplaceAllString(s, "${1}"+Redacted)
+	s = redactBearer.ReplaceAllString(s, "${1} "+Redacted)
+	s = redactJWT.ReplaceAllString(s, Redacted)
+	return s
+}
+
+// RedactURL returns u as a string with sensitive query parameters
+// masked
+func RedactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	r := *u
+	q := r.Query()
+	for k := range q {
+		if IsSensitive(k) {
+			q.Set(k, Redacted)
+		}
+	}
+	r.RawQuery = q.Encode()
+	r.User = nil
+	return r.String()
+}
+
+// redactHandler is a slog.Handler which masks sensitive attributes and
+// any secrets embedded in messages or string values before passing
+// records to the wrapped handler
+type redactHandler struct {
+	next slog.Handler
+}
+
+// NewRedactHandler wraps h in a redaction layer
+func NewRedactHandler(h slog.Handler) slog.Handler {
+	if _, ok := h.(*redactHandler); ok {
+		return h
+	}
+	return &redactHandler{next: h}
+}
+
+// Enabled reports if the wrapped handler handles level
+func (h *redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+// Handle redacts the record before handing it on
+func (h *redactHandler) Handle(ctx context.Context, r slog.Record) error {
+	nr := slog.NewRecord(r.Time, r.Level, Redact(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		nr.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, nr)
+}
+
+// WithAttrs redacts attrs before adding them to the wrapped handler
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	ra := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		ra[i] = redactAttr(a)
+	}
+	return &redactHandler{next: h.next.WithAttrs(ra)}
+}
+
+// WithGroup opens a group on the wrapped handler
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{next: h.next.WithGroup(name)}
+}
+
+// redactAttr masks an attribute with a sensitive key, and redacts
+// secrets in string and error values
+func redactAttr(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	if IsSensitive(a.Key) {
+		return slog.String(a.Key, Mask(a.Value.String()))
+	}
+	switch a.Value.Kind() {
+	case slog.KindGroup:
+		attrs := a.Value.Group()
+		ra := make([]slog.Attr, len(attrs))
+		for i, ga := range attrs {
+			ra[i] = redactAttr(ga)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(ra...)}
+	case slog.KindString:
+		return slog.String(a.Key, Redact(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, Redact(err.Error()))
+		}
+	}
+	return a
+}
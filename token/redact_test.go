@@ -0,0 +1,120 @@
+package token
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		input  string
+		secret string
+	}{
+		{`{"access_token": "abc123", "expires_in": 1800}`, "abc123"},
+		{`{"refreshToken":"def456"}`, "def456"},
+		{`code=xyz789&state=abcdef`, "xyz789"},
+		{`code=xyz789&state=abcdef`, "abcdef"},
+		{`Authorization: Bearer qwerty.uiop`, "qwerty.uiop"},
+		{`token eyJhbGciOi.eyJzdWIiOi.c2lnbmF0dXJl here`, "eyJhbGciOi"},
+	}
+	for _, tt := range tests {
+		got := Redact(tt.input)
+		if strings.Contains(got, tt.secret) {
+			t.Errorf("Redact(%s) leaks %s: %s", tt.input, tt.secret, got)
+		}
+		if !strings.Contains(got, Redacted) {
+			t.Errorf("Redact(%s) has no redaction marker: %s", tt.input, got)
+		}
+	}
+	if got := Redact("nothing to see"); got != "nothing to see" {
+		t.Errorf("Redact changed a non-sensitive string: %s", got)
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	u, _ := url.Parse("http://127.0.0.1:5001/code?code=abc&state=def&after=3")
+	got := RedactURL(u)
+	if strings.Contains(got, "abc") || strings.Contains(got, "def") {
+		t.Errorf("RedactURL leaks secrets: %s", got)
+	}
+	if !strings.Contains(got, "after=3") {
+		t.Errorf("RedactURL removed non-sensitive parameter: %s", got)
+	}
+}
+
+func TestRedactHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(NewRedactHandler(slog.NewJSONHandler(&buf, nil)))
+
+	logger.With("client_secret", "s3cr3t").Info(
+		"refresh_token=r3fr3sh registered",
+		"access_token", "acc3ss",
+		"error", errors.New(`body {"code": "c0d3"}`),
+		slog.Group("req", "authorization", "Bearer b3ar3r"),
+	)
+	out := buf.String()
+	for _, secret := range []string{"s3cr3t", "r3fr3sh", "acc3ss", "c0d3", "b3ar3r"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("log output leaks %s: %s", secret, out)
+		}
+	}
+}
+
+func TestTokenLoggingRedacted(t *testing.T) {
+	var buf bytes.Buffer
+
+	token := initToken()
+	token.SetLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	err := loadCredentials(token)
+	if err != nil {
+		t.Fatalf("could not add client credentials %s", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"access_token": "s3cr3tacc3ss", "refresh_token": "s3cr3tr3fr3sh", "expires_in": 1800}`))
+	}))
+	defer server.Close()
+
+	token.tokenURL = server.URL
+	token.AccessToken = "abc"
+	token.RefreshToken = "def"
+	activate(token)
+
+	// logging the token while it is refreshed is safe
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		token.logger().Info("token", "token", token)
+	}()
+	if err := token.Refresh(); err != nil {
+		t.Fatalf("refresh error %s", err)
+	}
+	<-done
+	token.logger().Info("token", "token", token)
+
+	for _, s := range []string{buf.String(), token.String()} {
+		if strings.Contains(s, "s3cr3t") {
+			t.Errorf("output leaks token: %s", s)
+		}
+	}
+	if !strings.Contains(buf.String(), "new refresh token registered") {
+		t.Errorf("expected refresh log line, got %s", buf.String())
+	}
+}
+
+func TestHTTPClientErrorRedacted(t *testing.T) {
+	e := &HTTPClientError{code: 400, message: `{"error": "invalid_grant", "refresh_token": "s3cr3t"}`}
+	if strings.Contains(e.Error(), "s3cr3t") {
+		t.Errorf("HTTPClientError leaks secret: %s", e)
+	}
+	if !strings.Contains(e.Error(), "invalid_grant") {
+		t.Errorf("HTTPClientError lost error detail: %s", e)
+	}
+}
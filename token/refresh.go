@@ -1,21 +1,30 @@
 package token
 
 import (
-	"log"
+	"math/rand"
 	"time"
 )
 
 // updater is a function that returns a channel to refresh a token if it
-// is due to expire
+// is due to expire; the channel is closed when the Token is shut down
 func (t *Token) refresher() <-chan struct{} {
 	ticker := time.NewTicker(t.expireTimeTicker)
 	refresher := make(chan struct{})
 	go func() {
+		defer close(refresher)
+		defer ticker.Stop()
 		for {
 			select {
+			case <-t.stop:
+				return
 			case <-ticker.C:
-				if t.expiring() {
-					refresher <- struct{}{}
+				t.checkExpiring()
+				if (t.expiring() || t.accessDue()) && t.retryDue() {
+					select {
+					case refresher <- struct{}{}:
+					case <-t.stop:
+						return
+					}
 				}
 			}
 		}
@@ -23,30 +32,104 @@ func (t *Token) refresher() <-chan struct{} {
 	return refresher
 }
 
-// expiring determines if the RefreshToken is about to expire; return
-// early if the system has not been initialised
+// AccessTokenLifetime is the lifetime of Xero access tokens
+const AccessTokenLifetime = 30 * time.Minute
+
+// expiring determines if the refresh policy requires the RefreshToken
+// to be refreshed; return early if the system does not hold usable
+// tokens
 func (t *Token) expiring() bool {
-	if t.AccessToken == "" || t.RefreshToken == "" {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	if !t.lifecycleState().usable() {
 		return false
 	}
-	now := time.Now().UTC()
-	expiration := t.RefreshTokenExpiryUTC.Add(-t.expirySecs)
-	if now.After(expiration) {
-		return true
+	return t.refreshPolicy().Due(time.Now().UTC(), t.refreshedAt, t.RefreshTokenExpiryUTC)
+}
+
+// SetProactiveRefresh enables refreshing the access token in the
+// background lead before it expires, less a random jitter of up to
+// jitter to spread refreshes by several servers, so that consumers are
+// always served a token from memory. A lead of 0 disables proactive
+// refreshes, leaving access tokens to be refreshed by Get when they
+// expire. The lead should exceed the refresher tick of one minute and
+// be less than AccessTokenLifetime; a lead and jitter at or beyond the
+// lifetime of the access token is clamped to half its lifetime.
+func (t *Token) SetProactiveRefresh(lead, jitter time.Duration) {
+	t.locker.Lock()
+	t.proactiveLead, t.proactiveJitter = lead, jitter
+	t.scheduleProactive()
+	t.locker.Unlock()
+}
+
+// scheduleProactive sets the time of the next proactive access token
+// refresh; the caller must hold the lock
+func (t *Token) scheduleProactive() {
+	if t.proactiveLead <= 0 || t.AccessTokenExpiryUTC.IsZero() {
+		t.proactiveAt = time.Time{}
+		return
+	}
+	var jitter time.Duration
+	if t.proactiveJitter > 0 {
+		jitter = time.Duration(rand.Int63n(int64(t.proactiveJitter)))
 	}
-	return false
+	before := t.proactiveLead + jitter
+	// a lead beyond the lifetime would refresh on every tick
+	if lifetime := t.AccessTokenExpiryUTC.Sub(t.refreshedAt); !t.refreshedAt.IsZero() && before >= lifetime {
+		t.logger().Warn("proactive refresh lead exceeds the access token lifetime", "lead", before, "lifetime", lifetime)
+		before = lifetime / 2
+	}
+	t.proactiveAt = t.AccessTokenExpiryUTC.Add(-before)
+}
+
+// accessDue determines if the access token is due a proactive refresh
+func (t *Token) accessDue() bool {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	if !t.lifecycleState().usable() || t.proactiveAt.IsZero() {
+		return false
+	}
+	return !time.Now().UTC().Before(t.proactiveAt)
 }
 
 // refreshRunner triggers a token refresh generated by communication on
 // the refresher channel; this is separated from the refresher function
-// to allow for testing
+// to allow for testing. Failures are logged as warnings until the token
+// is degraded or the failure is permanent, after which they are logged
+// as errors. The runner exits when the refresher channel is closed,
+// after finishing any refresh in progress.
 func (t *Token) refreshRunner(refresher <-chan struct{}) {
+	t.runners.Add(1)
 	go func() {
+		defer t.runners.Done()
 		for range refresher {
+			t.logger().Info("running background refresh")
 			err := t.Refresh()
-			log.Println("running refresh")
-			if err != nil {
-				log.Printf("refresh error %s", err)
+			if err == nil {
+				continue
+			}
+			f := t.RefreshFailureStatus()
+			switch {
+			case f.Permanent:
+				t.logger().Error(
+					"background refresh failed permanently; log in with Xero again",
+					"error", err,
+					"failures", f.ConsecutiveFailures,
+				)
+			case t.Health().State == HealthDegraded:
+				t.logger().Error(
+					"background refresh failed",
+					"error", err,
+					"failures", f.ConsecutiveFailures,
+					"next_retry", f.NextRetryUTC,
+				)
+			default:
+				t.logger().Warn(
+					"background refresh failed",
+					"error", err,
+					"failures", f.ConsecutiveFailures,
+					"next_retry", f.NextRetryUTC,
+				)
 			}
 		}
 	}()
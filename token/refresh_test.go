@@ -1,6 +1,7 @@
 package token
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -12,6 +13,7 @@ func TestRefresher(t *testing.T) {
 	token := &Token{
 		AccessToken:       "abc",
 		RefreshToken:      "def",
+		lifecycle:         StateActive,
 		redirectURL:       "https://exampletest.com",
 		clientID:          "XXXXXclientidXXXXX",
 		clientSecret:      "XXXXXclientsecretXXXXX",
@@ -87,6 +89,7 @@ func TestTriggerRefreshRunner(t *testing.T) {
 	token.tokenURL = server.URL
 	token.AccessToken = "ghi"
 	token.RefreshToken = "jkl"
+	activate(&token)
 	err := token.Refresh()
 	if err != nil {
 		t.Errorf("token.Refresh returned error %s", err)
@@ -104,3 +107,78 @@ func TestTriggerRefreshRunner(t *testing.T) {
 	}
 
 }
+
+func TestProactiveRefreshSchedule(t *testing.T) {
+	token := initToken()
+	token.AccessToken = "abc"
+	token.RefreshToken = "def"
+	if err := loadCredentials(token); err != nil {
+		t.Fatalf("could not add client credentials %s", err)
+	}
+	expiry := time.Now().UTC().Add(10 * time.Minute)
+	token.AccessTokenExpiryUTC = expiry
+
+	if token.accessDue() {
+		t.Error("access token should not be due without proactive refresh")
+	}
+
+	token.SetProactiveRefresh(5*time.Minute, time.Minute)
+	earliest := expiry.Add(-6 * time.Minute)
+	latest := expiry.Add(-5 * time.Minute)
+	if token.proactiveAt.Before(earliest) || token.proactiveAt.After(latest) {
+		t.Errorf("proactive refresh at %s not between %s and %s", token.proactiveAt, earliest, latest)
+	}
+	if token.accessDue() {
+		t.Error("access token should not be due 10 minutes before expiry")
+	}
+
+	token.SetProactiveRefresh(11*time.Minute, 0)
+	if !token.accessDue() {
+		t.Error("access token should be due within the lead time")
+	}
+
+	// a lead beyond the access token lifetime is clamped
+	token.refreshedAt = expiry.Add(-30 * time.Minute)
+	token.SetProactiveRefresh(30*time.Minute, time.Minute)
+	if want := expiry.Add(-15 * time.Minute); !token.proactiveAt.Equal(want) {
+		t.Errorf("clamped proactive refresh at %s want %s", token.proactiveAt, want)
+	}
+
+	token.SetProactiveRefresh(0, 0)
+	if token.accessDue() {
+		t.Error("access token should not be due when proactive refresh is disabled")
+	}
+}
+
+func TestProactiveRefresher(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "new", "refresh_token": "def", "expires_in": 1800}`))
+	}))
+	defer server.Close()
+
+	token := initToken()
+	token.tokenURL = server.URL
+	token.AccessToken = "old"
+	token.RefreshToken = "def"
+	token.AccessTokenExpiryUTC = time.Now().UTC().Add(time.Minute)
+	token.RefreshTokenExpiryUTC = time.Now().UTC().Add(time.Hour)
+	if err := loadCredentials(token); err != nil {
+		t.Fatalf("could not add client credentials %s", err)
+	}
+	token.SetProactiveRefresh(2*time.Minute, 0)
+
+	token.expireTimeTicker = 10 * time.Millisecond
+	token.refreshRunner(token.refresher())
+
+	generation := token.Generation()
+	token.WaitGeneration(context.Background(), generation, time.Second)
+	if token.Generation() == generation {
+		t.Fatal("access token was not refreshed proactively")
+	}
+	if token.AccessToken != "new" {
+		t.Errorf("access token error have(%s) want(new)", token.AccessToken)
+	}
+	if token.accessDue() {
+		t.Error("the next proactive refresh should be rescheduled")
+	}
+}
@@ -0,0 +1,143 @@
+package token
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/template"
+	"time"
+)
+
+// SinkFormats are the built in Sink templates: the raw access token, a
+// .env file, json, and http headers for the Xero API
+var SinkFormats = map[string]string{
+	"raw": "{{.AccessToken}}",
+	"env": "XERO_ACCESS_TOKEN={{.AccessToken}}\n" +
+		"XERO_TENANT_ID={{.TenantID}}\n" +
+		"XERO_ACCESS_TOKEN_EXPIRY={{rfc3339 .Expiry}}\n",
+	"json": `{"accessToken":{{json .AccessToken}},"tenantId":{{json .TenantID}},` +
+		`"expiry":{{json .Expiry}},"generation":{{.Generation}}}` + "\n",
+	"header": "Authorization: Bearer {{.AccessToken}}\n" +
+		"xero-tenant-id: {{.TenantID}}\n",
+}
+
+// sinkFuncs are the functions available to Sink templates
+var sinkFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		j, err := json.Marshal(v)
+		return string(j), err
+	},
+	"rfc3339": func(t time.Time) string { return t.UTC().Format(time.RFC3339) },
+	"unix":    func(t time.Time) int64 { return t.Unix() },
+}
+
+// SinkData is the data rendered by a Sink's template
+type SinkData struct {
+	AccessToken string
+	TenantID    string
+	Expiry      time.Time
+	Generation  uint64
+}
+
+// Sink writes the access token, rendered through a text/template, to a
+// file each time a token is obtained or refreshed, for programs which
+// read credentials from files. The file is replaced atomically so
+// readers never see a partial token.
+type Sink struct {
+	path     string
+	tmpl     *template.Template
+	mode     os.FileMode
+	uid, gid int
+}
+
+// NewSink returns a Sink writing to path with permissions mode. tmpl is
+// the name of one of the SinkFormats or the text of a template of
+// SinkData, which may use the functions json, rfc3339 and unix.
+func NewSink(path, tmpl string, mode os.FileMode) (*Sink, error) {
+	if f, ok := SinkFormats[tmpl]; ok {
+		tmpl = f
+	}
+	t, err := template.New(path).Funcs(sinkFuncs).Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sink template for %s: %w", path, err)
+	}
+	// check the template renders
+	if err := t.Execute(&bytes.Buffer{}, SinkData{}); err != nil {
+		return nil, fmt.Errorf("invalid sink template for %s: %w", path, err)
+	}
+	return &Sink{path: path, tmpl: t, mode: mode, uid: -1, gid: -1}, nil
+}
+
+// SetOwner sets the owner and group of the file; -1 leaves either
+// unchanged
+func (s *Sink) SetOwner(uid, gid int) {
+	s.uid, s.gid = uid, gid
+}
+
+// Path returns the path of the file written by the Sink
+func (s *Sink) Path() string {
+	return s.path
+}
+
+// Write renders d and writes it to the file
+func (s *Sink) Write(d SinkData) error {
+	var buf bytes.Buffer
+	if err := s.tmpl.Execute(&buf, d); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, buf.Bytes(), s.mode, s.uid, s.gid)
+}
+
+// Clear empties the file, keeping its permissions and owner, so that
+// a revoked token is not left behind; a file not yet written is left
+// absent
+func (s *Sink) Clear() error {
+	if _, err := os.Stat(s.path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return writeFileAtomic(s.path, nil, s.mode, s.uid, s.gid)
+}
+
+// AddSink adds a Sink written each time GetToken or Refresh succeeds,
+// and cleared when the token is revoked or logged out
+func (t *Token) AddSink(s *Sink) {
+	t.locker.Lock()
+	t.sinks = append(t.sinks, s)
+	t.locker.Unlock()
+}
+
+// writeSinks writes the current access token to the sinks, logging
+// failures, which do not fail the refresh
+func (t *Token) writeSinks() {
+	t.locker.Lock()
+	sinks := t.sinks
+	d := SinkData{
+		AccessToken: t.AccessToken,
+		TenantID:    t.tenantID,
+		Expiry:      t.AccessTokenExpiryUTC,
+		Generation:  t.generation,
+	}
+	t.locker.Unlock()
+	for _, s := range sinks {
+		if err := s.Write(d); err != nil {
+			t.logger().Error("token sink write failed", "path", s.path, "error", err)
+			continue
+		}
+		t.logger().Debug("token sink written", "path", s.path, "generation", d.Generation)
+	}
+}
+
+// clearSinks clears the sinks after the token is revoked or logged out,
+// logging failures
+func (t *Token) clearSinks() {
+	t.locker.Lock()
+	sinks := t.sinks
+	t.locker.Unlock()
+	for _, s := range sinks {
+		if err := s.Clear(); err != nil {
+			t.logger().Error("token sink clear failed", "path", s.path, "error", err)
+		}
+	}
+}
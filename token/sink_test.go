@@ -0,0 +1,149 @@
+package token
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rorycl/XeroOauthTokenServer/xerotest"
+)
+
+func TestSinkFormats(t *testing.T) {
+	dir := t.TempDir()
+	d := SinkData{
+		AccessToken: "abc.def",
+		TenantID:    "tenant",
+		Expiry:      time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Generation:  7,
+	}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"raw", "abc.def"},
+		{"env", "XERO_ACCESS_TOKEN=abc.def\nXERO_TENANT_ID=tenant\nXERO_ACCESS_TOKEN_EXPIRY=2026-01-02T03:04:05Z\n"},
+		{"header", "Authorization: Bearer abc.def\nxero-tenant-id: tenant\n"},
+		{"json", `{"accessToken":"abc.def","tenantId":"tenant","expiry":"2026-01-02T03:04:05Z","generation":7}` + "\n"},
+		{"token={{.AccessToken}} expires={{unix .Expiry}}", "token=abc.def expires=1767323045"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, "sink")
+		s, err := NewSink(path, tt.format, 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Write(d); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := os.ReadFile(path)
+		if string(got) != tt.want {
+			t.Errorf("%s: got %q want %q", tt.format, got, tt.want)
+		}
+		if tt.format == "json" && !json.Valid(got) {
+			t.Errorf("invalid json %s", got)
+		}
+		if fi, _ := os.Stat(path); runtime.GOOS != "windows" && fi.Mode().Perm() != 0640 {
+			t.Errorf("unexpected mode %s", fi.Mode())
+		}
+	}
+
+	for _, bad := range []string{"{{.AccessToken", "{{.RefreshToken}}"} {
+		if _, err := NewSink(filepath.Join(dir, "bad"), bad, 0600); err == nil {
+			t.Errorf("expected an error for template %q", bad)
+		}
+	}
+}
+
+func TestSinkOwner(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no file ownership on windows")
+	}
+	s, err := NewSink(filepath.Join(t.TempDir(), "sink"), "raw", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetOwner(os.Getuid(), os.Getgid())
+	if err := s.Write(SinkData{AccessToken: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSinkWrittenOnRefresh(t *testing.T) {
+	x := xerotest.NewServer()
+	defer x.Close()
+	token := xeroToken(t, x)
+	path := filepath.Join(t.TempDir(), "token.env")
+	s, err := NewSink(path, "env", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token.AddSink(s)
+
+	consent(t, token)
+	got, _ := os.ReadFile(path)
+	if !strings.Contains(string(got), "XERO_ACCESS_TOKEN="+token.AccessToken+"\n") ||
+		!strings.Contains(string(got), "XERO_TENANT_ID="+x.TenantID()+"\n") {
+		t.Errorf("unexpected sink after login %q", got)
+	}
+
+	if err := token.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = os.ReadFile(path)
+	if !strings.Contains(string(got), "XERO_ACCESS_TOKEN="+token.AccessToken+"\n") {
+		t.Errorf("sink not rewritten after refresh %q", got)
+	}
+
+	// a failed sink does not fail the refresh
+	s.path = filepath.Join(t.TempDir(), "missing", "token.env")
+	if err := token.Refresh(); err != nil {
+		t.Errorf("unexpected refresh error %s", err)
+	}
+}
+
+func TestSinkClearedOnRevoke(t *testing.T) {
+	x := xerotest.NewServer()
+	defer x.Close()
+
+	for name, end := range map[string]func(*Token){
+		"revoke": func(token *Token) { token.Revoke() },
+		"logout": func(token *Token) { token.Logout() },
+	} {
+		token := xeroToken(t, x)
+		path := filepath.Join(t.TempDir(), "token")
+		s, err := NewSink(path, "raw", 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token.AddSink(s)
+		consent(t, token)
+
+		end(token)
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if info.Size() != 0 {
+			t.Errorf("%s: sink not cleared", name)
+		}
+		if runtime.GOOS != "windows" && info.Mode().Perm() != 0640 {
+			t.Errorf("%s: sink mode %s, want 0640", name, info.Mode().Perm())
+		}
+	}
+
+	// a sink not yet written is not created
+	s, err := NewSink(filepath.Join(t.TempDir(), "token"), "raw", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(s.Path()); !os.IsNotExist(err) {
+		t.Errorf("unwritten sink created: %v", err)
+	}
+}
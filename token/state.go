@@ -0,0 +1,136 @@
+package token
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// State is the lifecycle state of a Token
+type State string
+
+// Token lifecycle states. A Token starts Unconfigured; client
+// credentials move it to CredentialsSet and generating the Xero
+// authorization url to AwaitingConsent. Exchanging the authorization
+// code makes it Active, and each refresh moves it to Refreshing and
+// back to Active, or to Degraded if the refresh fails. Consent may be
+// given again from Active or Degraded, such as after a permanent
+// refresh failure; the held tokens are not served while awaiting it. A
+// revoked token is Revoked until consent is given again, and logging
+// out returns the Token to Unconfigured.
+const (
+	StateUnconfigured    State = "unconfigured"
+	StateCredentialsSet  State = "credentials_set"
+	StateAwaitingConsent State = "awaiting_consent"
+	StateActive          State = "active"
+	StateRefreshing      State = "refreshing"
+	StateDegraded        State = "degraded"
+	StateRevoked         State = "revoked"
+)
+
+// transitions is the table of legal state transitions
+var transitions = map[State][]State{
+	StateUnconfigured:    {StateCredentialsSet},
+	StateCredentialsSet:  {StateCredentialsSet, StateAwaitingConsent, StateUnconfigured},
+	StateAwaitingConsent: {StateCredentialsSet, StateAwaitingConsent, StateActive, StateUnconfigured},
+	StateActive:          {StateAwaitingConsent, StateRefreshing, StateRevoked, StateUnconfigured},
+	StateRefreshing:      {StateActive, StateDegraded, StateRevoked, StateUnconfigured},
+	StateDegraded:        {StateAwaitingConsent, StateRefreshing, StateRevoked, StateUnconfigured},
+	StateRevoked:         {StateCredentialsSet, StateAwaitingConsent, StateUnconfigured},
+}
+
+// maxTransitions is the number of recent transitions retained
+const maxTransitions = 50
+
+// Errors returned when the Token is not in a state to be used
+var (
+	ErrNotLoggedIn    = errors.New("client is not logged in")
+	ErrNotInitialised = errors.New("token system has not been initialised")
+)
+
+// Transition records a change of lifecycle state
+type Transition struct {
+	From State     `json:"from"`
+	To   State     `json:"to"`
+	Time time.Time `json:"time"`
+}
+
+// TransitionError reports an illegal state transition
+type TransitionError struct {
+	From State
+	To   State
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("illegal token state transition from %s to %s", e.From, e.To)
+}
+
+// CanTransition reports if a transition between states is legal
+func CanTransition(from, to State) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transition moves the Token to state to, recording the transition, or
+// returns a *TransitionError if the transition is illegal. The caller
+// must hold the lock.
+func (t *Token) transition(to State) error {
+	from := t.lifecycleState()
+	if !CanTransition(from, to) {
+		return &TransitionError{From: from, To: to}
+	}
+	t.lifecycle = to
+	t.transitions = append(t.transitions, Transition{From: from, To: to, Time: time.Now().UTC()})
+	if len(t.transitions) > maxTransitions {
+		t.transitions = t.transitions[len(t.transitions)-maxTransitions:]
+	}
+	if from != to {
+		t.logger().Debug("token state transition", "from", from, "to", to)
+	}
+	return nil
+}
+
+// lifecycleState returns the lifecycle state; the caller must hold the
+// lock
+func (t *Token) lifecycleState() State {
+	if t.lifecycle == "" {
+		return StateUnconfigured
+	}
+	return t.lifecycle
+}
+
+// State returns the lifecycle state of the Token
+func (t *Token) State() State {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	return t.lifecycleState()
+}
+
+// Transitions returns the recent lifecycle state transitions, oldest
+// first
+func (t *Token) Transitions() []Transition {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	return append([]Transition(nil), t.transitions...)
+}
+
+// usable reports if the Token holds tokens which may be served to
+// consumers
+func (s State) usable() bool {
+	return s == StateActive || s == StateRefreshing || s == StateDegraded
+}
+
+// usableErr returns nil if the state is usable, or the reason it is not
+func (s State) usableErr() error {
+	switch {
+	case s.usable():
+		return nil
+	case s == StateUnconfigured:
+		return ErrNotLoggedIn
+	}
+	return ErrNotInitialised
+}
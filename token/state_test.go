@@ -0,0 +1,180 @@
+package token
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rorycl/XeroOauthTokenServer/xerotest"
+)
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to State
+		ok       bool
+	}{
+		{StateUnconfigured, StateCredentialsSet, true},
+		{StateUnconfigured, StateActive, false},
+		{StateCredentialsSet, StateAwaitingConsent, true},
+		{StateCredentialsSet, StateActive, false},
+		{StateAwaitingConsent, StateActive, true},
+		{StateActive, StateRefreshing, true},
+		{StateActive, StateCredentialsSet, false},
+		{StateActive, StateAwaitingConsent, true},
+		{StateRefreshing, StateActive, true},
+		{StateRefreshing, StateDegraded, true},
+		{StateRefreshing, StateRefreshing, false},
+		{StateDegraded, StateRefreshing, true},
+		{StateDegraded, StateActive, false},
+		{StateDegraded, StateAwaitingConsent, true},
+		{StateRevoked, StateAwaitingConsent, true},
+		{StateRevoked, StateActive, false},
+	}
+	for _, tt := range tests {
+		if got := CanTransition(tt.from, tt.to); got != tt.ok {
+			t.Errorf("CanTransition(%s, %s) want(%t) got(%t)", tt.from, tt.to, tt.ok, got)
+		}
+	}
+	// every state can be logged out
+	for from := range transitions {
+		if from != StateUnconfigured && !CanTransition(from, StateUnconfigured) {
+			t.Errorf("%s cannot transition to %s", from, StateUnconfigured)
+		}
+	}
+}
+
+func TestStateLifecycle(t *testing.T) {
+	server := fakeXero()
+	defer server.Close()
+
+	token := initToken()
+	token.tokenURL = server.URL + "/token"
+	token.revokeURL = server.URL + "/revocation"
+
+	if token.State() != StateUnconfigured {
+		t.Fatalf("unexpected initial state %s", token.State())
+	}
+	if err := loadCredentials(token); err != nil {
+		t.Fatalf("could not add client credentials %s", err)
+	}
+	token.AuthURL()
+	if err := token.GetToken("123"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if token.State() != StateActive {
+		t.Errorf("expected active, got %s", token.State())
+	}
+
+	// credentials cannot be replaced while active
+	var te *TransitionError
+	if err := loadCredentials(token); !errors.As(err, &te) {
+		t.Errorf("expected a transition error, got %v", err)
+	}
+
+	if err := token.Refresh(); err != nil {
+		t.Fatalf("unexpected refresh error %s", err)
+	}
+	if token.State() != StateActive {
+		t.Errorf("expected active after refresh, got %s", token.State())
+	}
+
+	token.tokenURL = server.URL + "/fail"
+	if err := token.Refresh(); err == nil {
+		t.Fatal("expected refresh error")
+	}
+	if token.State() != StateDegraded {
+		t.Errorf("expected degraded after failed refresh, got %s", token.State())
+	}
+
+	if err := token.Revoke(); err != nil {
+		t.Fatalf("unexpected revoke error %s", err)
+	}
+	if token.State() != StateRevoked {
+		t.Errorf("expected revoked, got %s", token.State())
+	}
+	if err := token.Refresh(); !errors.Is(err, ErrNotInitialised) {
+		t.Errorf("expected not initialised error, got %v", err)
+	}
+
+	token.Logout()
+	if token.State() != StateUnconfigured {
+		t.Errorf("expected unconfigured after logout, got %s", token.State())
+	}
+
+	want := []State{
+		StateCredentialsSet,
+		StateAwaitingConsent,
+		StateActive,
+		StateRefreshing,
+		StateActive,
+		StateRefreshing,
+		StateDegraded,
+		StateRevoked,
+		StateUnconfigured,
+	}
+	got := token.Transitions()
+	if len(got) != len(want) {
+		t.Fatalf("expected %d transitions, got %d: %+v", len(want), len(got), got)
+	}
+	for i, tr := range got {
+		if tr.To != want[i] || tr.Time.IsZero() {
+			t.Errorf("transition %d want(%s) got(%+v)", i, want[i], tr)
+		}
+		if i > 0 && tr.From != got[i-1].To {
+			t.Errorf("transition %d does not follow %d", i, i-1)
+		}
+	}
+}
+
+// TestReconsentAfterPermanentFailure checks that consent can be given
+// again after Xero rejects the refresh token
+func TestReconsentAfterPermanentFailure(t *testing.T) {
+	x := xerotest.NewServer()
+	defer x.Close()
+	token := xeroToken(t, x)
+	consent(t, token)
+
+	x.Fail(xerotest.EndpointToken, xerotest.Fault{Status: http.StatusBadRequest, Body: `{"error":"invalid_grant"}`}, 1)
+	if err := token.Refresh(); err == nil {
+		t.Fatal("expected the refresh to fail")
+	}
+	if token.State() != StateDegraded || !token.RefreshFailureStatus().Permanent {
+		t.Fatalf("expected a permanent failure, got %s %+v", token.State(), token.RefreshFailureStatus())
+	}
+
+	consent(t, token)
+	if token.State() != StateActive {
+		t.Errorf("expected active after consent, got %s", token.State())
+	}
+	if f := token.RefreshFailureStatus(); f.Permanent || f.ConsecutiveFailures != 0 {
+		t.Errorf("refresh failures not reset %+v", f)
+	}
+	if err := token.Refresh(); err != nil {
+		t.Errorf("unexpected refresh error %s", err)
+	}
+	got := token.Transitions()
+	want := []State{StateRefreshing, StateDegraded, StateAwaitingConsent, StateActive, StateRefreshing, StateActive}
+	got = got[len(got)-len(want):]
+	for i, tr := range got {
+		if tr.To != want[i] {
+			t.Errorf("transition %d want(%s) got(%+v)", i, want[i], tr)
+		}
+	}
+}
+
+func TestHandleCodeNotAwaitingConsent(t *testing.T) {
+	token := initToken()
+	if err := loadCredentials(token); err != nil {
+		t.Fatalf("could not add client credentials %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	token.HandleCode(w, httptest.NewRequest("GET", "http://127.0.0.1:5001/code?code=123", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Status code %d != 403", w.Code)
+	}
+	if token.State() != StateCredentialsSet {
+		t.Errorf("unexpected state %s", token.State())
+	}
+}
@@ -0,0 +1,254 @@
+package token
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Snapshot is the persisted state of a Token, including its client
+// credentials and tokens, from which a restarted server can resume
+// without logging in with Xero again
+type Snapshot struct {
+	ClientID              string    `json:"client_id"`
+	ClientSecret          string    `json:"client_secret"`
+	TenantID              string    `json:"tenant_id"`
+	State                 State     `json:"state"`
+	AccessToken           string    `json:"access_token"`
+	AccessTokenExpiryUTC  time.Time `json:"access_token_expiry_utc"`
+	RefreshToken          string    `json:"refresh_token"`
+	RefreshTokenExpiryUTC time.Time `json:"refresh_token_expiry_utc"`
+	RefreshedUTC          time.Time `json:"refreshed_utc"`
+	Scopes                []string  `json:"scopes"`
+	SavedUTC              time.Time `json:"saved_utc"`
+}
+
+// Store persists Token snapshots. Load returns a nil Snapshot if
+// nothing has been saved.
+type Store interface {
+	Save(s *Snapshot) error
+	Load() (*Snapshot, error)
+}
+
+// FileStore is a Store which saves snapshots as json to a file readable
+// only by its owner. Snapshots hold the client secret and refresh token
+// so the file should be protected accordingly.
+type FileStore struct {
+	path string
+}
+
+// NewFileStore returns a FileStore saving to path
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Save writes s to the file atomically
+func (f *FileStore) Save(s *Snapshot) error {
+	j, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := WriteFileAtomic(f.path, append(j, '\n'), 0600); err != nil {
+		return fmt.Errorf("could not save token state: %w", err)
+	}
+	return nil
+}
+
+// Load reads the snapshot from the file, returning nil if the file does
+// not exist
+func (f *FileStore) Load() (*Snapshot, error) {
+	j, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not load token state: %w", err)
+	}
+	var s Snapshot
+	if err := json.Unmarshal(j, &s); err != nil {
+		return nil, fmt.Errorf("could not decode token state %s: %w", f.path, err)
+	}
+	return &s, nil
+}
+
+// WriteFileAtomic writes data with permissions perm to a temporary file
+// in the directory of path and renames it over path, so that readers
+// never see a partially written file
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	return writeFileAtomic(path, data, perm, -1, -1)
+}
+
+// writeFileAtomic is WriteFileAtomic, also setting the owner of the file
+// to uid and gid unless they are -1
+func writeFileAtomic(path string, data []byte, perm os.FileMode, uid, gid int) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if uid != -1 || gid != -1 {
+		if err := tmp.Chown(uid, gid); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// SetStore sets the Store used by Load and Save
+func (t *Token) SetStore(s Store) {
+	t.locker.Lock()
+	t.store = s
+	t.locker.Unlock()
+}
+
+// Snapshot returns the persistable state of the Token. A Token which
+// is not configured returns an empty Snapshot, so that saving it clears
+// any previously saved state.
+func (t *Token) Snapshot() *Snapshot {
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	s := &Snapshot{
+		State:    t.lifecycleState(),
+		SavedUTC: time.Now().UTC(),
+	}
+	if s.State == StateUnconfigured {
+		return s
+	}
+	s.ClientID = t.clientID
+	s.ClientSecret = t.clientSecret
+	s.TenantID = t.tenantID
+	if s.State.usable() {
+		s.AccessToken = t.AccessToken
+		s.AccessTokenExpiryUTC = t.AccessTokenExpiryUTC
+		s.RefreshToken = t.RefreshToken
+		s.RefreshTokenExpiryUTC = t.RefreshTokenExpiryUTC
+		s.RefreshedUTC = t.refreshedAt
+		s.Scopes = append([]string(nil), t.Scopes...)
+	}
+	return s
+}
+
+// Restore restores an Unconfigured Token from s. The Token moves to
+// StateCredentialsSet, or to StateActive if s holds a refresh token
+// which has not expired, since consent was given before the snapshot
+// was taken. As a Token only becomes Active on consent it passes
+// through StateAwaitingConsent, with the consent being that recorded
+// in s.
+func (t *Token) Restore(s *Snapshot) error {
+	if s == nil || s.ClientID == "" {
+		return nil
+	}
+	if err := t.AddClientCredentials(s.ClientID, s.ClientSecret, s.TenantID); err != nil {
+		return fmt.Errorf("could not restore client credentials: %w", err)
+	}
+	now := time.Now().UTC()
+	if s.RefreshToken == "" || !s.RefreshTokenExpiryUTC.After(now) {
+		return nil
+	}
+
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	for _, to := range []State{StateAwaitingConsent, StateActive} {
+		if err := t.transition(to); err != nil {
+			return fmt.Errorf("could not restore token: %w", err)
+		}
+	}
+	t.AccessToken = s.AccessToken
+	t.AccessTokenExpiryUTC = s.AccessTokenExpiryUTC
+	t.RefreshToken = s.RefreshToken
+	t.RefreshTokenExpiryUTC = s.RefreshTokenExpiryUTC
+	t.refreshedAt = s.RefreshedUTC
+	t.Scopes = append([]string(nil), s.Scopes...)
+	t.scheduleProactive()
+	t.bumpGeneration()
+	t.logger().Info("token state restored", "saved", s.SavedUTC, "refresh_expiry", t.RefreshTokenExpiryUTC)
+	return nil
+}
+
+// Load restores the Token from its Store, if set
+func (t *Token) Load() error {
+	t.locker.Lock()
+	store := t.store
+	t.locker.Unlock()
+	if store == nil {
+		return nil
+	}
+	s, err := store.Load()
+	if err != nil {
+		return err
+	}
+	return t.Restore(s)
+}
+
+// Save saves the Token to its Store, if set. Saves are serialised so
+// that the last save holds the latest state.
+func (t *Token) Save() error {
+	t.saveLock.Lock()
+	defer t.saveLock.Unlock()
+	t.locker.Lock()
+	store := t.store
+	t.locker.Unlock()
+	if store == nil {
+		return nil
+	}
+	return store.Save(t.Snapshot())
+}
+
+// saveState saves the Token after it is obtained or refreshed, so that
+// the saved refresh token is never one Xero has rotated; failures are
+// logged
+func (t *Token) saveState() {
+	if err := t.Save(); err != nil {
+		t.logger().Error("token state save failed", "error", err)
+	}
+}
+
+// Shutdown stops the background refresher, waits for any in-flight
+// refresh and running hooks to finish and then saves the Token to its
+// Store. If ctx is done before they finish the Token is saved
+// regardless and the context error returned.
+func (t *Token) Shutdown(ctx context.Context) error {
+	t.stopOnce.Do(func() {
+		if t.stop != nil {
+			close(t.stop)
+		}
+	})
+
+	done := make(chan struct{})
+	go func() {
+		t.runners.Wait()
+		// wait for refreshes made by consumers and the hooks they run
+		t.refreshLock.Lock()
+		t.refreshLock.Unlock()
+		t.hooksRunning.Wait()
+		close(done)
+	}()
+
+	var waitErr error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		waitErr = fmt.Errorf("waiting for refresh: %w", ctx.Err())
+	}
+	return errors.Join(waitErr, t.Save())
+}
@@ -0,0 +1,204 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/rorycl/XeroOauthTokenServer/xerotest"
+)
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	store := NewFileStore(path)
+
+	s, err := store.Load()
+	if err != nil || s != nil {
+		t.Fatalf("expected no snapshot, got %+v %v", s, err)
+	}
+
+	want := &Snapshot{ClientID: "abc", RefreshToken: "def", State: StateActive}
+	if err := store.Save(want); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("state file mode %s, want 0600", info.Mode().Perm())
+	}
+	got, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ClientID != want.ClientID || got.RefreshToken != want.RefreshToken || got.State != want.State {
+		t.Errorf("want(%+v) got(%+v)", want, got)
+	}
+
+	// no temporary files are left behind
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("expected only the state file, got %d entries", len(entries))
+	}
+}
+
+func TestSavedOnRefresh(t *testing.T) {
+	x := xerotest.NewServer()
+	defer x.Close()
+	token := xeroToken(t, x)
+	store := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+	token.SetStore(store)
+
+	consent(t, token)
+	s, err := store.Load()
+	if err != nil || s == nil || s.RefreshToken != token.RefreshToken {
+		t.Fatalf("token not saved after consent %+v %v", s, err)
+	}
+
+	if err := token.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = store.Load()
+	if err != nil || s.RefreshToken != token.RefreshToken {
+		t.Errorf("rotated refresh token not saved %+v %v", s, err)
+	}
+}
+
+func TestSavedOnRevokeAndLogout(t *testing.T) {
+	x := xerotest.NewServer()
+	defer x.Close()
+	token := xeroToken(t, x)
+	store := NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+	token.SetStore(store)
+	consent(t, token)
+
+	if err := token.Revoke(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := store.Load()
+	if err != nil || s.RefreshToken != "" || s.ClientID == "" || s.State != StateRevoked {
+		t.Errorf("revoked token not saved %+v %v", s, err)
+	}
+
+	token.Logout()
+	s, err = store.Load()
+	if err != nil || s.ClientID != "" || s.ClientSecret != "" {
+		t.Errorf("logged out token not saved %+v %v", s, err)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	token := initToken()
+	token.AccessToken = "abc"
+	token.RefreshToken = "def"
+	token.RefreshTokenExpiryUTC = time.Now().UTC().Add(time.Hour)
+	if err := loadCredentials(token); err != nil {
+		t.Fatalf("could not add client credentials %s", err)
+	}
+	s := token.Snapshot()
+	if s.State != StateActive || s.RefreshToken != "def" || s.ClientSecret == "" {
+		t.Fatalf("unexpected snapshot %+v", s)
+	}
+
+	restored := initToken()
+	if err := restored.Restore(s); err != nil {
+		t.Fatal(err)
+	}
+	if restored.State() != StateActive || restored.RefreshToken != "def" || restored.AccessToken != "abc" {
+		t.Errorf("unexpected restored token %s %s", restored.State(), restored)
+	}
+	var states []State
+	for _, tr := range restored.Transitions() {
+		states = append(states, tr.To)
+	}
+	if !slices.Equal(states, []State{StateCredentialsSet, StateAwaitingConsent, StateActive}) {
+		t.Errorf("unexpected restored transitions %v", states)
+	}
+
+	// an expired refresh token restores only the client credentials
+	s.RefreshTokenExpiryUTC = time.Now().UTC().Add(-time.Minute)
+	expired := initToken()
+	if err := expired.Restore(s); err != nil {
+		t.Fatal(err)
+	}
+	if expired.State() != StateCredentialsSet || expired.RefreshToken != "" {
+		t.Errorf("unexpected restored token %s %s", expired.State(), expired)
+	}
+
+	// a logged out token saves an empty snapshot
+	token.Logout()
+	if s := token.Snapshot(); s.ClientID != "" || s.RefreshToken != "" {
+		t.Errorf("expected an empty snapshot, got %+v", s)
+	}
+}
+
+func TestShutdownWaitsForRefresh(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte(`{"access_token": "new", "refresh_token": "newer", "expires_in": 1800}`))
+	}))
+	defer server.Close()
+
+	token := initToken()
+	token.tokenURL = server.URL
+	token.AccessToken = "abc"
+	token.RefreshToken = "def"
+	token.RefreshTokenExpiryUTC = time.Now().UTC().Add(time.Hour)
+	if err := loadCredentials(token); err != nil {
+		t.Fatalf("could not add client credentials %s", err)
+	}
+	path := filepath.Join(t.TempDir(), "state.json")
+	token.SetStore(NewFileStore(path))
+
+	go token.Refresh()
+	<-started
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- token.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned during a refresh: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewFileStore(path).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.RefreshToken != "newer" {
+		t.Errorf("saved refresh token want(newer) got(%s)", s.RefreshToken)
+	}
+
+	// the refresher has stopped
+	if _, ok := <-token.refresher(); ok {
+		t.Error("refresher should be closed after shutdown")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	token := initToken()
+	token.refreshLock.Lock()
+	defer token.refreshLock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := token.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a deadline error, got %v", err)
+	}
+}
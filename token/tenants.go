@@ -60,13 +60,20 @@ func (t *Token) Tenants() (tenants *Tenants, err error) {
 	if err != nil {
 		return tenants, err
 	}
+	t.metrics.xeroResponse("connections", resp.StatusCode)
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
 		return tenants, fmt.Errorf(
-			"Tenant callout http error, %d",
+			"Tenant callout http error, %d: %w",
 			resp.StatusCode,
+			&HTTPClientError{
+				code:       resp.StatusCode,
+				message:    Redact(string(body)),
+				retryAfter: resp.Header.Get("Retry-After"),
+			},
 		)
 	}
-	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return tenants, fmt.Errorf(
@@ -6,7 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strings"
@@ -53,7 +53,8 @@ const DefaultExpirySecs int = 60
 // that could cause a race condition if the Auth.URL call is made twice
 // before the code exchange for the first url is completed.
 
-// The Token data structure is locked via a sync.Mutex on update.
+// The Token data structure is locked via a sync.Mutex on update. Its
+// lifecycle is tracked by an explicit State, for which see state.go.
 type Token struct {
 	AccessToken           string    `json:"access_token"`
 	AccessTokenExpiryUTC  time.Time `json:"access_token_expiry_utc"`
@@ -63,7 +64,6 @@ type Token struct {
 	clientID              string
 	clientSecret          string
 	tenantID              string
-	clientLoggedIn        bool
 	state                 string
 	authURL               string
 	redirectURL           string
@@ -76,10 +76,44 @@ type Token struct {
 	expirySecs            time.Duration
 	refreshTokenLifetime  time.Duration
 	locker                sync.Mutex
+	refreshLock           sync.Mutex
+	lifecycle             State
+	transitions           []Transition
 	refreshChan           <-chan struct{}
+	stop                  chan struct{}
+	stopOnce              sync.Once
+	runners               sync.WaitGroup
+	store                 Store
+	saveLock              sync.Mutex
+	sinks                 []*Sink
+	hooks                 []Hook
+	hookSlots             chan struct{}
+	hookRuns              []HookRun
+	hooksRunning          sync.WaitGroup
+	expiringNotified      time.Time
+	generation            uint64
+	generationChan        chan struct{}
+	waitersReleased       bool
+	metrics               *metrics
+	slogger               *slog.Logger
+	auditor               Auditor
+	readiness             *Readiness
+	refreshFailures       int
+	lastRefreshFailure    time.Time
+	lastRefreshError      string
+	refreshPermanent      bool
+	nextRefreshRetry      time.Time
+	backoffBase           time.Duration
+	backoffMax            time.Duration
+	proactiveLead         time.Duration
+	proactiveJitter       time.Duration
+	proactiveAt           time.Time
+	policy                RefreshPolicy
+	refreshedAt           time.Time
 }
 
-// String represents Token for printing
+// String represents Token for printing, with the access and refresh
+// tokens masked
 func (t *Token) String() string {
 	tpl := `
 access_token   %s
@@ -90,22 +124,39 @@ scopes         %v
 `
 	return fmt.Sprintf(
 		tpl,
-		t.AccessToken,
+		Mask(t.AccessToken),
 		t.AccessTokenExpiryUTC,
-		t.RefreshToken,
+		Mask(t.RefreshToken),
 		t.RefreshTokenExpiryUTC,
 		t.Scopes,
 	)
 }
 
-// AsJSON returns a json encoding for a Tokenserver
+// AsJSON returns a json encoding for a Tokenserver, including its
+// lifecycle state, recent state transitions, refresh failures and hook
+// runs
 func (t *Token) AsJSON() (j []byte, err error) {
-	return json.Marshal(t)
+	return json.Marshal(struct {
+		*Token
+		State           State           `json:"state"`
+		Transitions     []Transition    `json:"transitions"`
+		RefreshFailures RefreshFailures `json:"refresh_failures"`
+		Hooks           []HookRun       `json:"hooks"`
+	}{t, t.State(), t.Transitions(), t.RefreshFailureStatus(), t.HookRuns()})
 }
 
-// TokenJSON returns a json respresentation of a token
+// TokenJSON returns a json respresentation of a token together with
+// its generation, expiry and tenant id
 func (t *Token) TokenJSON() (j []byte, err error) {
-	ts := map[string]string{"accessToken": t.AccessToken}
+	generation := t.Generation()
+	t.locker.Lock()
+	ts := map[string]interface{}{
+		"accessToken": t.AccessToken,
+		"generation":  generation,
+		"expiry":      t.AccessTokenExpiryUTC,
+		"tenantId":    t.tenantID,
+	}
+	t.locker.Unlock()
 	return json.Marshal(ts)
 }
 
@@ -118,12 +169,17 @@ func (t *Token) RefreshTokenJSON() (j []byte, err error) {
 // VerifyScopes ensures that all intended scopes are in the token's
 // scopes from Xero
 func (t *Token) VerifyScopes() error {
+	return t.verifyScopes(t.Scopes)
+}
+
+// verifyScopes ensures that all intended scopes are in scopes
+func (t *Token) verifyScopes(scopes []string) error {
 	if len(t.scopesRequested) < 1 {
 		return errors.New("no requested scopes provided to verify")
 	}
 	for _, req := range t.scopesRequested {
 		var matcher string
-		for _, has := range t.Scopes {
+		for _, has := range scopes {
 			if req == has {
 				matcher = has
 				break
@@ -174,18 +230,28 @@ func NewToken(redirect string, scopes []string, authURL, tokenURL, tenantURL str
 		expireTimeTicker:     time.Minute * 1,
 		expirySecs:           time.Second * time.Duration(DefaultExpirySecs),
 		refreshTokenLifetime: refreshLifetime,
+		stop:                 make(chan struct{}),
 	}
+	t.metrics = newMetrics(t)
 
-	// initialise goroutines for refreshing tokens
+	// initialise goroutines for refreshing tokens, stopped by Shutdown
 	t.refreshChan = t.refresher()
 	t.refreshRunner(t.refreshChan)
 
 	return t, nil
 }
 
+// SetRevokeURL sets the Xero revocation endpoint, by default
+// XeroRevokeURL
+func (t *Token) SetRevokeURL(revokeURL string) {
+	t.locker.Lock()
+	t.revokeURL = revokeURL
+	t.locker.Unlock()
+}
+
 // AddClientCredentials adds the client id and client secret to the
-// token struct after checking, and sets clientLoggedIn to true.
-// After initialisation the clientID and clientSecret are set to ""
+// token struct after checking, moving the Token to StateCredentialsSet.
+// Credentials cannot be replaced while the Token holds tokens.
 func (t *Token) AddClientCredentials(client, secret, tenant string) error {
 	if len(client) != 32 {
 		return fmt.Errorf("client identifier %s should be 32 characters in length", client)
@@ -198,21 +264,29 @@ func (t *Token) AddClientCredentials(client, secret, tenant string) error {
 		return fmt.Errorf("tenant id %s is not a valid uuid", tenant)
 	}
 	t.locker.Lock()
+	defer t.locker.Unlock()
+	if err := t.transition(StateCredentialsSet); err != nil {
+		return err
+	}
 	t.clientID = client
 	t.clientSecret = secret
 	t.tenantID = tenant
-	t.clientLoggedIn = true
-	t.locker.Unlock()
 
 	return nil
 }
 
 // AuthURL returns the authorization url which is the beginning of the
-// authorization process; the state string is randomized and stored in t
-// (note that this could cause a race condition)
+// authorization process, moving the Token to StateAwaitingConsent; the
+// state string is randomized and stored in t (note that this could cause
+// a race condition)
 func (t *Token) AuthURL() string {
 
+	t.locker.Lock()
+	if err := t.transition(StateAwaitingConsent); err != nil {
+		t.logger().Warn("authorization url requested", "error", err)
+	}
 	t.state = randstring.RandString(10)
+	t.locker.Unlock()
 
 	scope := ""
 	for _, s := range t.scopesRequested {
@@ -241,9 +315,16 @@ func (t *Token) encodeIDSecret() string {
 // setExpiry sets the UTC expiration time of the token and refreshtoken
 func (t *Token) setExpiry(expiry int) {
 	now := time.Now().UTC()
+	t.refreshedAt = now
 	t.AccessTokenExpiryUTC = now.Add(time.Duration(expiry) * time.Second)
 	t.RefreshTokenExpiryUTC = now.Add(t.refreshTokenLifetime)
-	log.Printf("Setting expiry: lifetime %v refresh %s", t.refreshTokenLifetime, t.RefreshTokenExpiryUTC)
+	t.scheduleProactive()
+	t.logger().Debug(
+		"setting expiry",
+		"access_expiry", t.AccessTokenExpiryUTC,
+		"refresh_lifetime", t.refreshTokenLifetime,
+		"refresh_expiry", t.RefreshTokenExpiryUTC,
+	)
 }
 
 // tokenResults is the type of the Xero API results
@@ -255,8 +336,20 @@ type tokenResults struct {
 	Scope        string `json:"scope"`
 }
 
-// GetToken retrieves a token if possible from an authorization code
+// GetToken retrieves a token if possible from an authorization code,
+// moving the Token from StateAwaitingConsent to StateActive
 func (t *Token) GetToken(code string) error {
+	return t.getToken(code, nil)
+}
+
+// getToken is GetToken, rejecting the token before it is held, saved or
+// written to sinks if check, when not nil, returns an error for its
+// scopes
+func (t *Token) getToken(code string, check func(scopes []string) error) error {
+
+	if t.State() != StateAwaitingConsent {
+		return errors.New("no authorization is awaiting consent")
+	}
 
 	form := url.Values{}
 	form.Add("grant_type", "authorization_code")
@@ -279,13 +372,18 @@ func (t *Token) GetToken(code string) error {
 		return err
 	}
 	defer resp.Body.Close()
+	t.metrics.xeroResponse("token", resp.StatusCode)
 
 	if resp.StatusCode != 200 {
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
 			body = []byte("could not read body")
 		}
-		return &HTTPClientError{resp.StatusCode, string(body)}
+		return &HTTPClientError{
+			code:       resp.StatusCode,
+			message:    Redact(string(body)),
+			retryAfter: resp.Header.Get("Retry-After"),
+		}
 	}
 
 	var results tokenResults
@@ -295,34 +393,71 @@ func (t *Token) GetToken(code string) error {
 	if results.AccessToken == "" || results.RefreshToken == "" || results.ExpiresIn == 0 {
 		return errors.New("empty response received from server")
 	}
+	scopes := strings.Split(results.Scope, " ")
+	if check != nil {
+		if err := check(scopes); err != nil {
+			return err
+		}
+	}
 
 	t.locker.Lock()
+	if err := t.transition(StateActive); err != nil {
+		t.locker.Unlock()
+		return err
+	}
 	t.AccessToken = results.AccessToken
 	t.RefreshToken = results.RefreshToken
-	t.Scopes = strings.Split(results.Scope, " ")
+	t.Scopes = scopes
 	t.setExpiry(results.ExpiresIn)
+	t.resetRefreshFailures()
+	t.bumpGeneration()
 	t.locker.Unlock()
 
+	t.writeSinks()
+	t.saveState()
+	t.runHooks(HookRefreshed, nil)
 	return nil
 }
 
 // Refresh uses a refresh token to retrieve a new token and refresh
-// token, and bypasses the normal login method
-func (t *Token) Refresh() error {
+// token, and bypasses the normal login method. Refreshes are serialised;
+// the Token is StateRefreshing during the refresh and afterwards
+// StateActive, or StateDegraded if the refresh failed.
+func (t *Token) Refresh() (err error) {
+
+	started := time.Now()
+	defer func() {
+		t.metrics.refreshed(started, err)
+		if t.recordRefresh(err) && err != nil {
+			t.runHooks(HookRefreshFailed, err)
+		}
+	}()
 
-	if t.clientLoggedIn == false {
-		return errors.New("client is not logged in")
-	}
+	t.refreshLock.Lock()
+	defer t.refreshLock.Unlock()
 
-	if t.AccessToken == "" || t.RefreshToken == "" {
-		return errors.New("token system has not been initialised")
+	t.locker.Lock()
+	if err := t.lifecycleState().usableErr(); err != nil {
+		t.locker.Unlock()
+		return err
 	}
-
-	// reset access token if the service is being refreshed from the
-	// command line via a saved refresh token
-	if t.AccessToken == "override" {
-		t.AccessToken = ""
+	if err := t.transition(StateRefreshing); err != nil {
+		t.locker.Unlock()
+		return err
 	}
+	t.locker.Unlock()
+
+	defer func() {
+		t.locker.Lock()
+		if t.lifecycleState() == StateRefreshing {
+			if err == nil {
+				t.transition(StateActive)
+			} else {
+				t.transition(StateDegraded)
+			}
+		}
+		t.locker.Unlock()
+	}()
 
 	form := url.Values{}
 	form.Add("grant_type", "refresh_token")
@@ -344,13 +479,18 @@ func (t *Token) Refresh() error {
 		return err
 	}
 	defer resp.Body.Close()
+	t.metrics.xeroResponse("token", resp.StatusCode)
 
 	if resp.StatusCode != 200 {
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
 			body = []byte("could not read body")
 		}
-		return &HTTPClientError{resp.StatusCode, string(body)}
+		return &HTTPClientError{
+			code:       resp.StatusCode,
+			message:    Redact(string(body)),
+			retryAfter: resp.Header.Get("Retry-After"),
+		}
 	}
 
 	var results tokenResults
@@ -362,14 +502,23 @@ func (t *Token) Refresh() error {
 	}
 
 	t.locker.Lock()
+	if t.lifecycleState() != StateRefreshing {
+		// revoked or logged out during the refresh
+		t.locker.Unlock()
+		return ErrNotInitialised
+	}
 	t.AccessToken = results.AccessToken
 	t.RefreshToken = results.RefreshToken
 	t.Scopes = strings.Split(results.Scope, " ")
 	t.setExpiry(results.ExpiresIn)
+	t.bumpGeneration()
 	t.locker.Unlock()
 
-	log.Printf("new refresh token registered: %s", t.RefreshToken)
+	t.logger().Info("new refresh token registered", "refresh_expiry", t.RefreshTokenExpiryUTC)
 
+	t.writeSinks()
+	t.saveState()
+	t.runHooks(HookRefreshed, nil)
 	return nil
 }
 
@@ -377,21 +526,28 @@ func (t *Token) Refresh() error {
 // made that some latitude (expirySecs) is needed when determining
 // expiration.
 func (t *Token) Get() (tt *Token, err error) {
-	now := time.Now().UTC()
-	if t.AccessTokenExpiryUTC.Add(-t.expirySecs).After(now) {
+	t.locker.Lock()
+	fresh := t.AccessTokenExpiryUTC.Add(-t.expirySecs).After(time.Now().UTC())
+	t.locker.Unlock()
+	if fresh {
 		return t, nil
 	}
-	log.Println("Running refresh")
+	if f := t.RefreshFailureStatus(); f.Permanent {
+		// avoid calling Xero when the refresh token is known to be invalid
+		return t, fmt.Errorf("refresh permanently failed, log in with Xero again: %s", f.LastError)
+	}
+	t.logger().Info("access token expiring, running refresh")
 	err = t.Refresh()
 	return t, err
 }
 
-// Revoke revokes a Token and all their connections via the refreshtoken
+// Revoke revokes a Token and all their connections via the refreshtoken,
+// moving the Token to StateRevoked
 // see https://developer.xero.com/documentation/guides/oauth2/auth-flow#revoking-tokens
 func (t *Token) Revoke() error {
 
-	if t.AccessToken == "" || t.RefreshToken == "" {
-		return errors.New("token system has not been initialised")
+	if err := t.State().usableErr(); err != nil {
+		return err
 	}
 
 	form := url.Values{}
@@ -414,28 +570,49 @@ func (t *Token) Revoke() error {
 		return err
 	}
 	defer resp.Body.Close()
+	t.metrics.xeroResponse("revoke", resp.StatusCode)
 
 	if resp.StatusCode != 200 {
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
 			body = []byte("could not read body")
 		}
-		return fmt.Errorf("revoke returned %d: %s", resp.StatusCode, body)
+		return fmt.Errorf("revoke failed: %w", &HTTPClientError{
+			code:       resp.StatusCode,
+			message:    Redact(string(body)),
+			retryAfter: resp.Header.Get("Retry-After"),
+		})
 	}
 
 	// clear current structure
 	t.locker.Lock()
+	if err := t.transition(StateRevoked); err != nil {
+		t.locker.Unlock()
+		return err
+	}
+	t.clearTokens()
+	t.locker.Unlock()
+
+	// the saved refresh token and written access token are no longer
+	// valid
+	t.saveState()
+	t.clearSinks()
+	t.runHooks(HookRevoked, nil)
+	return nil
+}
+
+// clearTokens clears the tokens; the caller must hold the lock
+func (t *Token) clearTokens() {
 	t.AccessToken = ""
 	t.RefreshToken = ""
 	t.Scopes = []string{}
 	t.AccessTokenExpiryUTC = time.Time{}
 	t.RefreshTokenExpiryUTC = time.Time{}
-	t.locker.Unlock()
-
-	return nil
+	t.proactiveAt = time.Time{}
 }
 
-// Logout revokes the token and removes the client data
+// Logout revokes the token and removes the client data, moving the
+// Token to StateUnconfigured
 func (t *Token) Logout() {
 
 	// ignore errors from revoke
@@ -443,10 +620,16 @@ func (t *Token) Logout() {
 
 	// unset all client details (even if not set)
 	t.locker.Lock()
+	if t.lifecycleState() != StateUnconfigured {
+		t.transition(StateUnconfigured)
+	}
+	t.clearTokens()
 	t.clientID = ""
 	t.clientSecret = ""
 	t.tenantID = ""
-	t.clientLoggedIn = false
 	t.locker.Unlock()
 
+	// clear the saved client credentials and any written token
+	t.saveState()
+	t.clearSinks()
 }
@@ -1,14 +1,18 @@
 package token
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/rorycl/XeroOauthTokenServer/xerotest"
 )
 
 // depends on token and err in handler_test
@@ -125,6 +129,8 @@ func TestURL(t *testing.T) {
 
 func TestGetToken(t *testing.T) {
 	token := initToken()
+	loadCredentials(token)
+	awaitConsent(token)
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -151,6 +157,8 @@ func TestGetToken(t *testing.T) {
 
 func TestGetTokenFail(t *testing.T) {
 	token := initToken()
+	loadCredentials(token)
+	awaitConsent(token)
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -170,6 +178,8 @@ func TestGetTokenFail(t *testing.T) {
 
 func TestGetTokenFailStatus(t *testing.T) {
 	token := initToken()
+	loadCredentials(token)
+	awaitConsent(token)
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusUnauthorized)
@@ -205,6 +215,8 @@ func TestGetTokenFailStatus(t *testing.T) {
 
 func TestGetTokenTimeout(t *testing.T) {
 	token := initToken()
+	loadCredentials(token)
+	awaitConsent(token)
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -242,6 +254,7 @@ func TestRefresh(t *testing.T) {
 	token.tokenURL = server.URL
 	token.AccessToken = "abc"
 	token.RefreshToken = "def"
+	activate(token)
 	err := token.Refresh()
 
 	if err != nil {
@@ -273,6 +286,7 @@ func TestRefreshFailEmpty(t *testing.T) {
 	token.tokenURL = server.URL
 	token.AccessToken = "abc"
 	token.RefreshToken = "def"
+	activate(token)
 	err := token.Refresh()
 
 	h := &HTTPClientError{}
@@ -303,6 +317,7 @@ func TestRefreshFailUnAuthorized(t *testing.T) {
 	token.tokenURL = server.URL
 	token.AccessToken = "abc"
 	token.RefreshToken = "def"
+	activate(token)
 	err := token.Refresh()
 
 	h := &HTTPClientError{}
@@ -365,6 +380,7 @@ func TestGet(t *testing.T) {
 	token.tokenURL = server.URL
 	token.AccessToken = "xxx"
 	token.RefreshToken = "yyy"
+	activate(token)
 	token.expirySecs = (1 * time.Second)
 	token.AccessTokenExpiryUTC = time.Now().UTC().Add(time.Second * 2)
 
@@ -377,6 +393,32 @@ func TestGet(t *testing.T) {
 	}
 }
 
+// TestGetDuringRefresh calls Get while the token is refreshed in the
+// background, for the race detector
+func TestGetDuringRefresh(t *testing.T) {
+	x := xerotest.NewServer()
+	defer x.Close()
+	token := xeroToken(t, x)
+	consent(t, token)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			if err := token.Refresh(); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if _, err := token.Get(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
+
 func TestGetWithRefresh(t *testing.T) {
 	token := initToken()
 
@@ -395,6 +437,7 @@ func TestGetWithRefresh(t *testing.T) {
 	token.tokenURL = server.URL
 	token.AccessToken = "xx2"
 	token.RefreshToken = "yy2"
+	activate(token)
 	token.expirySecs = (3 * time.Second)
 	token.AccessTokenExpiryUTC = time.Now().UTC().Add(time.Second * 2)
 
@@ -473,8 +516,8 @@ func TestAddClientCredentials(t *testing.T) {
 	}
 
 	token := initToken()
-	if token.clientLoggedIn == true {
-		t.Error("clientLoggedIn should not be true on init")
+	if token.State() != StateUnconfigured {
+		t.Error("token should be unconfigured on init")
 	}
 
 	for _, e := range tests {
@@ -487,3 +530,85 @@ func TestAddClientCredentials(t *testing.T) {
 		}
 	}
 }
+
+func TestGenerationIncrements(t *testing.T) {
+	token := initToken()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"access_token": "abc", "refresh_token": "def", "expires_in": 1800}`))
+	}))
+	defer server.Close()
+
+	token.tokenURL = server.URL
+	err := loadCredentials(token)
+	if err != nil {
+		t.Fatalf("could not add client credentials %s", err)
+	}
+	if g := token.Generation(); g != 0 {
+		t.Errorf("initial generation want(0) got(%d)", g)
+	}
+	awaitConsent(token)
+	err = token.GetToken("123")
+	if err != nil {
+		t.Fatalf("error %s", err)
+	}
+	err = token.Refresh()
+	if err != nil {
+		t.Fatalf("error %s", err)
+	}
+	if g := token.Generation(); g != 2 {
+		t.Errorf("generation want(2) got(%d)", g)
+	}
+}
+
+func TestWaitGeneration(t *testing.T) {
+	token := initToken()
+
+	// timeout without a new generation
+	n := time.Now()
+	g := token.WaitGeneration(context.Background(), 0, 50*time.Millisecond)
+	if g != 0 {
+		t.Errorf("generation want(0) got(%d)", g)
+	}
+	if time.Since(n) < 50*time.Millisecond {
+		t.Errorf("WaitGeneration returned before wait elapsed")
+	}
+
+	// woken by a new generation
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		token.locker.Lock()
+		token.bumpGeneration()
+		token.locker.Unlock()
+	}()
+	n = time.Now()
+	g = token.WaitGeneration(context.Background(), 0, 2*time.Second)
+	if g != 1 {
+		t.Errorf("generation want(1) got(%d)", g)
+	}
+	if time.Since(n) > time.Second {
+		t.Errorf("WaitGeneration was not woken by new generation")
+	}
+
+	// a generation newer than after returns immediately
+	g = token.WaitGeneration(context.Background(), 0, 2*time.Second)
+	if g != 1 {
+		t.Errorf("generation want(1) got(%d)", g)
+	}
+
+	// woken by ReleaseWaiters, after which waits do not block
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		token.ReleaseWaiters()
+	}()
+	n = time.Now()
+	for i := 0; i < 2; i++ {
+		if g = token.WaitGeneration(context.Background(), 1, 2*time.Second); g != 1 {
+			t.Errorf("generation want(1) got(%d)", g)
+		}
+	}
+	if time.Since(n) > time.Second {
+		t.Errorf("WaitGeneration was not released")
+	}
+}
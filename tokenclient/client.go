@@ -0,0 +1,326 @@
+// Package tokenclient is a client for a running XeroOauthTokenServer.
+//
+// A Client fetches the access token from the server's json api and
+// caches it until shortly before it expires. Requests to the server are
+// retried on network errors, rate limiting and server errors. The
+// Client can be used as an oauth2.TokenSource, and Transport is an
+// http.RoundTripper which adds the Authorization and xero-tenant-id
+// headers to requests to the Xero API, refreshing the token if Xero
+// rejects it.
+//
+//	c, err := tokenclient.New("http://127.0.0.1:5001")
+//	c.SetAPIKey(os.Getenv("XEROTOKENSERVER_APIKEY"))
+//	xero := &http.Client{Transport: &tokenclient.Transport{Client: c}}
+//	resp, err := xero.Get("https://api.xero.com/api.xro/2.0/Invoices")
+package tokenclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rorycl/XeroOauthTokenServer/token"
+)
+
+// DefaultExpiryMargin is how long before its expiry a cached token is
+// fetched again
+const DefaultExpiryMargin = 60 * time.Second
+
+// DefaultRetries is the number of times a failed request to the server
+// is retried, after DefaultRetryWait, doubling for each retry
+const (
+	DefaultRetries   = 3
+	DefaultRetryWait = 500 * time.Millisecond
+)
+
+// Token is an access token served by the token server
+type Token struct {
+	AccessToken string    `json:"accessToken"`
+	Generation  uint64    `json:"generation"`
+	Expiry      time.Time `json:"expiry"`
+	TenantID    string    `json:"tenantId"`
+}
+
+// valid reports if the token is not within margin of expiry
+func (t *Token) valid(margin time.Duration) bool {
+	return t != nil && t.AccessToken != "" && time.Now().Add(margin).Before(t.Expiry)
+}
+
+// Tenant is a Xero tenant accessible with the token
+type Tenant struct {
+	ID             string `json:"id"`
+	AuthEventID    string `json:"authEventId"`
+	TenantID       string `json:"tenantId"`
+	TenantType     string `json:"tenantType"`
+	TenantName     string `json:"tenantName"`
+	CreatedDateUTC string `json:"createdDateUtc"`
+	UpdatedDateUTC string `json:"updatedDateUtc"`
+}
+
+// Error is an error response from the token server
+type Error struct {
+	token.Problem
+}
+
+func (e *Error) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("token server error %d %s", e.Status, e.Code)
+	}
+	return fmt.Sprintf("token server error %d %s: %s", e.Status, e.Code, e.Detail)
+}
+
+// Client is a client for a token server
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	apiKey     string
+	margin     time.Duration
+	retries    int
+	retryWait  time.Duration
+
+	mu     sync.Mutex
+	cached *Token
+}
+
+// New returns a Client for the token server at baseURL, such as
+// "http://127.0.0.1:5001"
+func New(baseURL string) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token server url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("token server url %q should be http or https", baseURL)
+	}
+	return &Client{
+		baseURL:    u,
+		httpClient: &http.Client{Timeout: token.MaxTokenWait + 10*time.Second},
+		margin:     DefaultExpiryMargin,
+		retries:    DefaultRetries,
+		retryWait:  DefaultRetryWait,
+	}, nil
+}
+
+// NewUnix returns a Client for a token server listening on the unix
+// socket at path
+func NewUnix(path string) (*Client, error) {
+	c, err := New("http://unix")
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	c.httpClient.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, "unix", path)
+		},
+	}
+	return c, nil
+}
+
+// SetAPIKey sets the api key sent to a server requiring api keys
+func (c *Client) SetAPIKey(key string) {
+	c.apiKey = key
+}
+
+// SetHTTPClient sets the http client used to call the server
+func (c *Client) SetHTTPClient(h *http.Client) {
+	c.httpClient = h
+}
+
+// SetExpiryMargin sets how long before its expiry a cached token is
+// fetched again
+func (c *Client) SetExpiryMargin(margin time.Duration) {
+	c.margin = margin
+}
+
+// SetRetries sets the number of retries of failed GET requests to the
+// server and the wait before the first retry, which doubles for each
+// subsequent retry
+func (c *Client) SetRetries(retries int, wait time.Duration) {
+	c.retries, c.retryWait = retries, wait
+}
+
+// Token returns the cached access token, fetching it from the server
+// if there is none or it is about to expire
+func (c *Client) Token(ctx context.Context) (*Token, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cached.valid(c.margin) {
+		return c.cached, nil
+	}
+	return c.fetch(ctx)
+}
+
+// Invalidate discards the cached token
+func (c *Client) Invalidate() {
+	c.mu.Lock()
+	c.cached = nil
+	c.mu.Unlock()
+}
+
+// Refresh asks the server to refresh the access token, which requires
+// the refresh permission, and returns the new token
+func (c *Client) Refresh(ctx context.Context) (*Token, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cached = nil
+	if err := c.do(ctx, http.MethodPost, "/refresh", nil); err != nil {
+		return nil, err
+	}
+	return c.fetch(ctx)
+}
+
+// Status returns the server's token status json, which requires the
+// status permission
+func (c *Client) Status(ctx context.Context) (json.RawMessage, error) {
+	var status json.RawMessage
+	if err := c.do(ctx, http.MethodGet, "/status", &status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Tenants returns the Xero tenants accessible with the token, which
+// requires the tenants permission
+func (c *Client) Tenants(ctx context.Context) ([]Tenant, error) {
+	var tenants []Tenant
+	if err := c.do(ctx, http.MethodGet, "/tenants", &tenants); err != nil {
+		return nil, err
+	}
+	return tenants, nil
+}
+
+// Revoke asks the server to revoke the token and its connections with
+// Xero, which requires the revoke permission. The server must be logged
+// in again afterwards.
+func (c *Client) Revoke(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cached = nil
+	return c.do(ctx, http.MethodPost, "/revoke", nil)
+}
+
+// renew replaces a token rejected by Xero. If the server already holds
+// a newer token, such as one refreshed for another client, that is
+// returned; otherwise the server is asked to refresh.
+func (c *Client) renew(ctx context.Context, rejected *Token) (*Token, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cached = nil
+	t, err := c.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if rejected == nil || t.Generation > rejected.Generation {
+		return t, nil
+	}
+	c.cached = nil
+	if err := c.do(ctx, http.MethodPost, "/refresh", nil); err != nil {
+		return nil, err
+	}
+	return c.fetch(ctx)
+}
+
+// fetch fetches and caches the token; the caller must hold the lock
+func (c *Client) fetch(ctx context.Context) (*Token, error) {
+	var t Token
+	if err := c.do(ctx, http.MethodGet, "/token", &t); err != nil {
+		return nil, err
+	}
+	if t.AccessToken == "" {
+		return nil, errors.New("token server returned an empty access token")
+	}
+	c.cached = &t
+	return &t, nil
+}
+
+// do calls the api endpoint path, decoding the json response into v if
+// it is not nil. GET requests are retried after network errors, rate
+// limiting and Xero being unreachable; POST requests, which are not
+// idempotent, are never retried.
+func (c *Client) do(ctx context.Context, method, path string, v any) error {
+	u := c.baseURL.JoinPath(token.APIPrefix, path)
+	wait := c.retryWait
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		retry, err = c.call(ctx, method, u.String(), v)
+		if err == nil || !retry || attempt >= c.retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// call makes a single request, reporting if a failure may be retried
+func (c *Client) call(ctx context.Context, method, u string, v any) (retry bool, err error) {
+	var body io.Reader
+	if method != http.MethodGet {
+		// a json body exempts the request from csrf protection
+		body = strings.NewReader("{}")
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	idempotent := method == http.MethodGet
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return idempotent && ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return idempotent && retryable(resp.StatusCode), decodeError(resp)
+	}
+	if v == nil {
+		return false, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return false, fmt.Errorf("could not decode token server response: %w", err)
+	}
+	return false, nil
+}
+
+// retryable reports if a request failing with status may succeed if
+// retried: rate limiting, or the server being unable to reach Xero.
+// Other server errors, such as a refresh token Xero has rejected or a
+// server not logged in, persist until an administrator intervenes.
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusGatewayTimeout
+}
+
+// decodeError returns the problem reported by an error response
+func decodeError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	e := &Error{}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), token.ProblemContentType) {
+		if json.Unmarshal(body, &e.Problem) == nil {
+			return e
+		}
+	}
+	e.Status = resp.StatusCode
+	e.Title = http.StatusText(resp.StatusCode)
+	e.Detail = strings.TrimSpace(string(body))
+	return e
+}
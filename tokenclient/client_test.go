@@ -0,0 +1,268 @@
+package tokenclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rorycl/XeroOauthTokenServer/token"
+	"github.com/rorycl/XeroOauthTokenServer/tokenservertest"
+)
+
+func newClient(t *testing.T) (*Client, *tokenservertest.Server) {
+	t.Helper()
+	server := tokenservertest.NewServer()
+	t.Cleanup(server.Close)
+	c, err := New(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetRetries(2, time.Millisecond)
+	return c, server
+}
+
+func TestClientCache(t *testing.T) {
+	c, server := newClient(t)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		tok, err := c.Token(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tok.AccessToken != server.Token().AccessToken || tok.TenantID != tokenservertest.DefaultTenantID {
+			t.Errorf("unexpected token %+v", tok)
+		}
+	}
+	if n := server.Requests(tokenservertest.EndpointToken); n != 1 {
+		t.Errorf("expected 1 call to the server, got %d", n)
+	}
+
+	// tokens within the expiry margin are fetched again
+	server.Issue("expiring", time.Now().Add(30*time.Second))
+	c.Invalidate()
+	for i := 0; i < 2; i++ {
+		if _, err := c.Token(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := server.Requests(tokenservertest.EndpointToken); n != 3 {
+		t.Errorf("expected 3 calls to the server, got %d", n)
+	}
+
+	tok, err := c.Refresh(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != server.Token().AccessToken || server.Requests(tokenservertest.EndpointRefresh) != 1 {
+		t.Errorf("unexpected token after refresh %+v", tok)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	c, server := newClient(t)
+	server.Fail(tokenservertest.EndpointToken, http.StatusGatewayTimeout, token.ErrCodeXeroUnavailable, 1)
+	server.Fail(tokenservertest.EndpointToken, http.StatusTooManyRequests, token.ErrCodeRateLimited, 1)
+	if _, err := c.Token(context.Background()); err != nil {
+		t.Fatalf("expected success after retries, got %s", err)
+	}
+	if n := server.Requests(tokenservertest.EndpointToken); n != 3 {
+		t.Errorf("expected 3 calls to the server, got %d", n)
+	}
+
+	c.Invalidate()
+	server.Fail(tokenservertest.EndpointToken, http.StatusGatewayTimeout, token.ErrCodeXeroUnavailable, 3)
+	_, err := c.Token(context.Background())
+	var e *Error
+	if !errors.As(err, &e) || e.Status != http.StatusGatewayTimeout || e.Code != token.ErrCodeXeroUnavailable {
+		t.Errorf("expected a 504 problem, got %v", err)
+	}
+
+	// persistent server errors are not retried
+	server.Fail(tokenservertest.EndpointToken, http.StatusServiceUnavailable, token.ErrCodeNotInitialised, 1)
+	if _, err := c.Token(context.Background()); !errors.As(err, &e) || e.Code != token.ErrCodeNotInitialised {
+		t.Errorf("expected not initialised, got %v", err)
+	}
+	if n := server.Requests(tokenservertest.EndpointToken); n != 7 {
+		t.Errorf("expected 7 calls to the server, got %d", n)
+	}
+
+	// posts are not retried
+	for _, f := range []struct {
+		status int
+		code   string
+	}{
+		{http.StatusForbidden, token.ErrCodeForbidden},
+		{http.StatusBadGateway, token.ErrCodeRefreshFailed},
+		{http.StatusGatewayTimeout, token.ErrCodeXeroUnavailable},
+	} {
+		server.Fail(tokenservertest.EndpointRefresh, f.status, f.code, 1)
+		if _, err := c.Refresh(context.Background()); !errors.As(err, &e) || e.Code != f.code {
+			t.Errorf("expected %s, got %v", f.code, err)
+		}
+	}
+	if n := server.Requests(tokenservertest.EndpointRefresh); n != 3 {
+		t.Errorf("expected 3 calls to refresh, got %d", n)
+	}
+}
+
+func TestClientStatusTenantsRevoke(t *testing.T) {
+	c, server := newClient(t)
+	ctx := context.Background()
+
+	status, err := c.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s struct {
+		State token.State `json:"state"`
+	}
+	if err := json.Unmarshal(status, &s); err != nil || s.State != token.StateActive {
+		t.Errorf("unexpected status %s", status)
+	}
+	tenants, err := c.Tenants(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tenants) != 1 || tenants[0].TenantID != tokenservertest.DefaultTenantID {
+		t.Errorf("unexpected tenants %+v", tenants)
+	}
+
+	if _, err := c.Token(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Revoke(ctx); err != nil {
+		t.Fatal(err)
+	}
+	c.SetRetries(0, 0)
+	var e *Error
+	if _, err := c.Token(ctx); !errors.As(err, &e) || e.Code != token.ErrCodeNotInitialised {
+		t.Errorf("expected the revoked token not to be served, got %v", err)
+	}
+	if server.Requests(tokenservertest.EndpointRevoke) != 1 {
+		t.Error("expected 1 call to revoke")
+	}
+}
+
+func TestClientAPIKey(t *testing.T) {
+	c, server := newClient(t)
+	server.RequireAPIKey("secret")
+
+	_, err := c.Token(context.Background())
+	var e *Error
+	if !errors.As(err, &e) || e.Code != token.ErrCodeUnauthorized {
+		t.Fatalf("expected unauthorized, got %v", err)
+	}
+
+	c.SetAPIKey("secret")
+	if _, err := c.Token(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %s", err)
+	}
+	fake := tokenservertest.NewServer()
+	defer fake.Close()
+	server := &http.Server{Handler: fake.Handler()}
+	go server.Serve(l)
+	defer server.Close()
+
+	c, err := NewUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Token(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTokenSource(t *testing.T) {
+	c, server := newClient(t)
+	tok, err := c.TokenSource(context.Background()).Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != server.Token().AccessToken || tok.Type() != "Bearer" || !tok.Valid() {
+		t.Errorf("unexpected oauth2 token %+v", tok)
+	}
+	if tok.Extra("tenantId") != tokenservertest.DefaultTenantID {
+		t.Errorf("unexpected tenant %v", tok.Extra("tenantId"))
+	}
+}
+
+func TestTransport(t *testing.T) {
+	c, server := newClient(t)
+
+	// xero accepts only the server's current token
+	var mu sync.Mutex
+	var bodies []string
+	xero := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer "+server.Token().AccessToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(r.Header.Get("xero-tenant-id")))
+	}))
+	defer xero.Close()
+
+	client := &http.Client{Transport: &Transport{Client: c}}
+	resp, err := client.Get(xero.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != tokenservertest.DefaultTenantID {
+		t.Errorf("unexpected response %d %s", resp.StatusCode, body)
+	}
+
+	// a token rotated elsewhere is fetched without forcing a refresh
+	server.Rotate()
+	resp, err = client.Post(xero.URL, "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || server.Requests(tokenservertest.EndpointRefresh) != 0 {
+		t.Errorf("unexpected response %d", resp.StatusCode)
+	}
+	if bodies[len(bodies)-1] != "payload" {
+		t.Errorf("request body was not replayed: %q", bodies)
+	}
+
+	// a token rejected by xero is refreshed
+	c.mu.Lock()
+	c.cached.AccessToken = "revoked"
+	c.mu.Unlock()
+	client.Transport = &Transport{Client: c, TenantID: "other"}
+	resp, err = client.Get(xero.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "other" {
+		t.Errorf("unexpected response %d %s", resp.StatusCode, body)
+	}
+	if n := server.Requests(tokenservertest.EndpointRefresh); n != 1 {
+		t.Errorf("expected 1 refresh, got %d", n)
+	}
+}
@@ -0,0 +1,100 @@
+package tokenclient
+
+import (
+	"context"
+	"net/http"
+
+	"golang.org/x/oauth2"
+)
+
+// tokenSource adapts a Client to an oauth2.TokenSource
+type tokenSource struct {
+	ctx    context.Context
+	client *Client
+}
+
+// TokenSource returns an oauth2.TokenSource serving the Client's token,
+// for use with packages built on golang.org/x/oauth2. ctx is used for
+// requests to the token server.
+func (c *Client) TokenSource(ctx context.Context) oauth2.TokenSource {
+	return &tokenSource{ctx: ctx, client: c}
+}
+
+// Token returns the access token as an oauth2.Token
+func (s *tokenSource) Token() (*oauth2.Token, error) {
+	t, err := s.client.Token(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+	ot := &oauth2.Token{
+		AccessToken: t.AccessToken,
+		TokenType:   "Bearer",
+		Expiry:      t.Expiry,
+	}
+	return ot.WithExtra(map[string]any{"tenantId": t.TenantID}), nil
+}
+
+// Transport is an http.RoundTripper for the Xero API which sets the
+// Authorization header from Client and, unless already set, the
+// xero-tenant-id header to TenantID or the tenant id served with the
+// token. If Xero responds 401 Unauthorized the token is renewed and the
+// request retried once, provided its body can be replayed.
+type Transport struct {
+	Client   *Client
+	TenantID string
+	// Base is the underlying RoundTripper, http.DefaultTransport if nil
+	Base http.RoundTripper
+}
+
+// RoundTrip authorizes and sends req
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tok, err := t.Client.Token(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.base().RoundTrip(t.authorize(req, tok))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+
+	renewed, err := t.Client.renew(req.Context(), tok)
+	if err != nil {
+		return resp, nil
+	}
+	retry := t.authorize(req, renewed)
+	if req.Body != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		retry.Body = body
+	}
+	resp.Body.Close()
+	return t.base().RoundTrip(retry)
+}
+
+// authorize returns a clone of req with the authorization headers set
+func (t *Transport) authorize(req *http.Request, tok *Token) *http.Request {
+	r := req.Clone(req.Context())
+	r.Header.Set("Authorization", "Bearer "+tok.AccessToken)
+	if r.Header.Get("xero-tenant-id") == "" {
+		tenant := t.TenantID
+		if tenant == "" {
+			tenant = tok.TenantID
+		}
+		if tenant != "" {
+			r.Header.Set("xero-tenant-id", tenant)
+		}
+	}
+	return r
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
@@ -0,0 +1,397 @@
+// Package tokenservertest provides an in-process fake XeroOauthTokenServer
+// for unit testing consumers of the server.
+//
+// The fake serves the /token, /refresh, /status, /tenants and /revoke
+// endpoints, both unversioned and under /api/v1, with the same response
+// shapes as the real server. Tests script its behaviour: issuing tokens
+// with chosen expiries, rotating tokens, and failing or delaying
+// requests to an endpoint.
+//
+//	s := tokenservertest.NewServer()
+//	defer s.Close()
+//	s.Issue("expiring", time.Now().Add(time.Second))
+//	s.Fail(tokenservertest.EndpointRefresh, http.StatusBadGateway, token.ErrCodeRefreshFailed, 1)
+//	c, _ := tokenclient.New(s.URL)
+package tokenservertest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rorycl/XeroOauthTokenServer/token"
+)
+
+// Endpoints of the fake server, used to script failures and latency
+// and to count requests
+const (
+	EndpointToken   = "token"
+	EndpointRefresh = "refresh"
+	EndpointStatus  = "status"
+	EndpointTenants = "tenants"
+	EndpointRevoke  = "revoke"
+)
+
+// DefaultTenantID is the tenant id served with tokens unless set by
+// SetTenantID
+const DefaultTenantID = "00000000-0000-0000-0000-000000000001"
+
+// maxTransitions is the number of state transitions reported by /status
+const maxTransitions = 50
+
+// Token is the token held by the fake server
+type Token struct {
+	AccessToken           string
+	Generation            uint64
+	Expiry                time.Time
+	RefreshToken          string
+	RefreshTokenExpiryUTC time.Time
+}
+
+// Tenant is a Xero tenant served by /tenants
+type Tenant struct {
+	ID             string `json:"id"`
+	AuthEventID    string `json:"authEventId"`
+	TenantID       string `json:"tenantId"`
+	TenantType     string `json:"tenantType"`
+	TenantName     string `json:"tenantName"`
+	CreatedDateUTC string `json:"createdDateUtc"`
+	UpdatedDateUTC string `json:"updatedDateUtc"`
+}
+
+// fault is a scripted error response
+type fault struct {
+	status int
+	code   string
+}
+
+// Server is a fake token server
+type Server struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	token       Token
+	lifetime    time.Duration
+	tenantID    string
+	tenants     []Tenant
+	apiKey      string
+	faults      map[string][]fault
+	latency     map[string]time.Duration
+	requests    map[string]int
+	rotated     chan struct{}
+	revoked     bool
+	transitions []token.Transition
+}
+
+// NewServer starts and returns a fake server holding a token which
+// expires in 30 minutes. The caller should call Close when finished.
+func NewServer() *Server {
+	s := &Server{
+		lifetime: 30 * time.Minute,
+		tenantID: DefaultTenantID,
+		faults:   map[string][]fault{},
+		latency:  map[string]time.Duration{},
+		requests: map[string]int{},
+		rotated:  make(chan struct{}),
+	}
+	s.tenants = []Tenant{{
+		ID:             "00000000-0000-0000-0000-0000000000a1",
+		AuthEventID:    "00000000-0000-0000-0000-0000000000e1",
+		TenantID:       DefaultTenantID,
+		TenantType:     "ORGANISATION",
+		TenantName:     "Demo Company",
+		CreatedDateUTC: "2024-01-01T00:00:00.0000000",
+		UpdatedDateUTC: "2024-01-01T00:00:00.0000000",
+	}}
+	s.Rotate()
+	s.Server = httptest.NewServer(s.Handler())
+	return s
+}
+
+// Handler returns the fake server's handler, for tests that serve it
+// themselves, such as on a unix socket
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	for _, prefix := range []string{"", token.APIPrefix} {
+		mux.HandleFunc(prefix+"/token", s.endpoint(EndpointToken, s.handleToken))
+		mux.HandleFunc(prefix+"/refresh", s.endpoint(EndpointRefresh, s.handleRefresh))
+		mux.HandleFunc(prefix+"/status", s.endpoint(EndpointStatus, s.handleStatus))
+		mux.HandleFunc(prefix+"/tenants", s.endpoint(EndpointTenants, s.handleTenants))
+		mux.HandleFunc(prefix+"/revoke", s.endpoint(EndpointRevoke, s.handleRevoke))
+	}
+	return mux
+}
+
+// SetLifetime sets the lifetime of tokens issued by later rotations
+func (s *Server) SetLifetime(d time.Duration) {
+	s.mu.Lock()
+	s.lifetime = d
+	s.mu.Unlock()
+}
+
+// SetTenantID sets the tenant id served with tokens
+func (s *Server) SetTenantID(id string) {
+	s.mu.Lock()
+	s.tenantID = id
+	s.mu.Unlock()
+}
+
+// SetTenants sets the tenants served by /tenants
+func (s *Server) SetTenants(tenants []Tenant) {
+	s.mu.Lock()
+	s.tenants = tenants
+	s.mu.Unlock()
+}
+
+// RequireAPIKey requires requests to present key as a bearer token
+func (s *Server) RequireAPIKey(key string) {
+	s.mu.Lock()
+	s.apiKey = key
+	s.mu.Unlock()
+}
+
+// Issue replaces the token with accessToken, expiring at expiry, as a
+// new generation
+func (s *Server) Issue(accessToken string, expiry time.Time) Token {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.issue(accessToken, expiry)
+}
+
+// Rotate replaces the token with a new generation expiring after the
+// lifetime set by SetLifetime, as the real server does on a refresh
+func (s *Server) Rotate() Token {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rotate()
+}
+
+// rotate issues a new token; the caller must hold the lock
+func (s *Server) rotate() Token {
+	next := s.token.Generation + 1
+	return s.issue(fmt.Sprintf("access-token-%d", next), time.Now().UTC().Add(s.lifetime))
+}
+
+// issue sets the token and wakes long-polling requests; the caller must
+// hold the lock
+func (s *Server) issue(accessToken string, expiry time.Time) Token {
+	login := s.token.Generation == 0 || s.revoked
+	s.revoked = false
+	s.token.Generation++
+	s.token.AccessToken = accessToken
+	s.token.Expiry = expiry.UTC()
+	s.token.RefreshToken = fmt.Sprintf("refresh-token-%d", s.token.Generation)
+	s.token.RefreshTokenExpiryUTC = time.Now().UTC().Add(60 * 24 * time.Hour)
+	if login {
+		s.record(token.StateAwaitingConsent, token.StateActive)
+	} else {
+		s.record(token.StateActive, token.StateRefreshing)
+		s.record(token.StateRefreshing, token.StateActive)
+	}
+	close(s.rotated)
+	s.rotated = make(chan struct{})
+	return s.token
+}
+
+// record records a state transition reported by /status; the caller
+// must hold the lock
+func (s *Server) record(from, to token.State) {
+	s.transitions = append(s.transitions, token.Transition{From: from, To: to, Time: time.Now().UTC()})
+	if len(s.transitions) > maxTransitions {
+		s.transitions = s.transitions[len(s.transitions)-maxTransitions:]
+	}
+}
+
+// Token returns the token held by the server
+func (s *Server) Token() Token {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.token
+}
+
+// Fail makes the next n requests to endpoint fail with status and the
+// problem code, such as token.ErrCodeRefreshFailed. Failures for an
+// endpoint are queued in the order they are scripted.
+func (s *Server) Fail(endpoint string, status int, code string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < n; i++ {
+		s.faults[endpoint] = append(s.faults[endpoint], fault{status, code})
+	}
+}
+
+// SetLatency delays every response from endpoint by d
+func (s *Server) SetLatency(endpoint string, d time.Duration) {
+	s.mu.Lock()
+	s.latency[endpoint] = d
+	s.mu.Unlock()
+}
+
+// Requests returns the number of requests made to endpoint
+func (s *Server) Requests(endpoint string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[endpoint]
+}
+
+// endpoint wraps h with request counting, api key checks and scripted
+// latency and failures
+func (s *Server) endpoint(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests[name]++
+		latency, key, revoked := s.latency[name], s.apiKey, s.revoked
+		var f *fault
+		if len(s.faults[name]) > 0 {
+			f = &s.faults[name][0]
+			s.faults[name] = s.faults[name][1:]
+		}
+		s.mu.Unlock()
+
+		if latency > 0 {
+			select {
+			case <-time.After(latency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if key != "" && r.Header.Get("Authorization") != "Bearer "+key {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="xerooauthtokenserver"`)
+			token.WriteProblem(w, http.StatusUnauthorized, token.ErrCodeUnauthorized, "a valid api key is required")
+			return
+		}
+		if r.Method != http.MethodGet && r.Header.Get("Authorization") == "" &&
+			!strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			// as the real server's csrf protection
+			token.WriteProblem(w, http.StatusForbidden, token.ErrCodeInvalidCSRF, "invalid or missing csrf token")
+			return
+		}
+		if f != nil {
+			token.WriteProblem(w, f.status, f.code, fmt.Sprintf("scripted %s failure", name))
+			return
+		}
+		if revoked && name != EndpointStatus {
+			token.WriteProblem(w, http.StatusServiceUnavailable, token.ErrCodeNotInitialised, "system has not been initialised or is in an error state")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// handleToken serves the token, long-polling for a newer generation if
+// the "after" parameter is given, as the real server does
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if after := r.URL.Query().Get("after"); after != "" {
+		generation, err := strconv.ParseUint(after, 10, 64)
+		if err != nil {
+			token.WriteProblem(w, http.StatusBadRequest, token.ErrCodeBadRequest, "invalid after parameter: "+after)
+			return
+		}
+		wait := token.DefaultTokenWait
+		if ws := r.URL.Query().Get("wait"); ws != "" {
+			if wait, err = time.ParseDuration(ws); err != nil || wait < 0 {
+				token.WriteProblem(w, http.StatusBadRequest, token.ErrCodeBadRequest, "invalid wait parameter: "+ws)
+				return
+			}
+		}
+		s.wait(r.Context(), generation, min(wait, token.MaxTokenWait))
+	}
+	s.mu.Lock()
+	body := map[string]any{
+		"accessToken": s.token.AccessToken,
+		"generation":  s.token.Generation,
+		"expiry":      s.token.Expiry,
+		"tenantId":    s.tenantID,
+	}
+	s.mu.Unlock()
+	writeJSON(w, body)
+}
+
+// wait blocks until the generation exceeds generation, wait elapses or
+// ctx is done
+func (s *Server) wait(ctx context.Context, generation uint64, wait time.Duration) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		current, rotated := s.token.Generation, s.rotated
+		s.mu.Unlock()
+		if current > generation {
+			return
+		}
+		select {
+		case <-rotated:
+		case <-timer.C:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleRefresh rotates the token on a POST
+func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		token.WriteProblem(w, http.StatusMethodNotAllowed, token.ErrCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+	t := s.Rotate()
+	writeJSON(w, map[string]any{"status": "refreshed", "generation": t.Generation})
+}
+
+// handleRevoke revokes the token on a POST, after which other endpoints
+// than /status fail until a token is issued or rotated
+func (s *Server) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		token.WriteProblem(w, http.StatusMethodNotAllowed, token.ErrCodeMethodNotAllowed, "method not allowed")
+		return
+	}
+	s.mu.Lock()
+	s.revoked = true
+	s.record(token.StateActive, token.StateRevoked)
+	s.mu.Unlock()
+	writeJSON(w, map[string]string{"status": "revoked"})
+}
+
+// handleStatus serves the token status
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	state := token.StateActive
+	if s.revoked {
+		state = token.StateRevoked
+	}
+	body := map[string]any{
+		"access_token":             s.token.AccessToken,
+		"access_token_expiry_utc":  s.token.Expiry,
+		"refresh_token":            s.token.RefreshToken,
+		"refresh_token_expiry_utc": s.token.RefreshTokenExpiryUTC,
+		"scopes":                   []string{"offline_access", "accounting.transactions"},
+		"state":                    state,
+		"transitions":              append([]token.Transition(nil), s.transitions...),
+		"refresh_failures":         token.RefreshFailures{},
+		"hooks":                    []token.HookRun{},
+	}
+	s.mu.Unlock()
+	writeJSON(w, body)
+}
+
+// handleTenants serves the tenants
+func (s *Server) handleTenants(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	tenants := append([]Tenant{}, s.tenants...)
+	s.mu.Unlock()
+	writeJSON(w, tenants)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
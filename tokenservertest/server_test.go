@@ -0,0 +1,167 @@
+package tokenservertest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rorycl/XeroOauthTokenServer/token"
+)
+
+// get decodes the json response from path into v, returning the status
+func get(t *testing.T, s *Server, method, path string, v any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, s.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("could not decode %s response: %s", path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// post posts an empty json object to path, decoding the json response
+// into v
+func post(t *testing.T, s *Server, path string, v any) int {
+	t.Helper()
+	resp, err := http.Post(s.URL+path, "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("could not decode %s response: %s", path, err)
+	}
+	return resp.StatusCode
+}
+
+type accessToken struct {
+	AccessToken string    `json:"accessToken"`
+	Generation  uint64    `json:"generation"`
+	Expiry      time.Time `json:"expiry"`
+	TenantID    string    `json:"tenantId"`
+}
+
+func TestServerToken(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	expiry := time.Now().Add(time.Minute).UTC().Truncate(time.Second)
+	issued := s.Issue("chosen", expiry)
+
+	for _, path := range []string{"/token", token.APIPrefix + "/token"} {
+		var at accessToken
+		if status := get(t, s, "GET", path, &at); status != http.StatusOK {
+			t.Fatalf("%s status %d", path, status)
+		}
+		if at.AccessToken != "chosen" || at.Generation != issued.Generation || !at.Expiry.Equal(expiry) {
+			t.Errorf("%s unexpected token %+v", path, at)
+		}
+		if at.TenantID != DefaultTenantID {
+			t.Errorf("%s unexpected tenant %s", path, at.TenantID)
+		}
+	}
+
+	var refreshed struct {
+		Status     string `json:"status"`
+		Generation uint64 `json:"generation"`
+	}
+	if status := get(t, s, "GET", "/refresh", nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("refresh GET status %d", status)
+	}
+	if status := get(t, s, "POST", "/refresh", nil); status != http.StatusForbidden {
+		t.Errorf("expected a csrf failure for a form post, got %d", status)
+	}
+	if status := post(t, s, "/refresh", &refreshed); status != http.StatusOK {
+		t.Fatalf("refresh status %d", status)
+	}
+	if refreshed.Generation != issued.Generation+1 || s.Token().AccessToken == "chosen" {
+		t.Errorf("token was not rotated %+v", refreshed)
+	}
+	if n := s.Requests(EndpointToken); n != 2 {
+		t.Errorf("expected 2 token requests, got %d", n)
+	}
+}
+
+func TestServerLongPoll(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	generation := s.Token().Generation
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		s.Rotate()
+	}()
+	var at accessToken
+	started := time.Now()
+	get(t, s, "GET", "/token?wait=5s&after="+strconv.FormatUint(generation, 10), &at)
+	if at.Generation != generation+1 {
+		t.Errorf("expected generation %d, got %d", generation+1, at.Generation)
+	}
+	if time.Since(started) > 2*time.Second {
+		t.Error("long-poll did not return on rotation")
+	}
+}
+
+func TestServerFaults(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	s.Fail(EndpointToken, http.StatusBadGateway, token.ErrCodeRefreshFailed, 1)
+	s.Fail(EndpointToken, http.StatusTooManyRequests, token.ErrCodeRateLimited, 1)
+	for _, want := range []struct {
+		status int
+		code   string
+	}{
+		{http.StatusBadGateway, token.ErrCodeRefreshFailed},
+		{http.StatusTooManyRequests, token.ErrCodeRateLimited},
+		{http.StatusOK, ""},
+	} {
+		var p token.Problem
+		status := get(t, s, "GET", "/token", &p)
+		if status != want.status || p.Code != want.code {
+			t.Errorf("want(%d %s) got(%d %s)", want.status, want.code, status, p.Code)
+		}
+	}
+
+	s.SetLatency(EndpointStatus, 50*time.Millisecond)
+	started := time.Now()
+	var status map[string]any
+	get(t, s, "GET", "/status", &status)
+	if time.Since(started) < 50*time.Millisecond {
+		t.Error("status response was not delayed")
+	}
+	if status["state"] != string(token.StateActive) || status["access_token"] != s.Token().AccessToken {
+		t.Errorf("unexpected status %v", status)
+	}
+
+	s.RequireAPIKey("secret")
+	if code := get(t, s, "GET", "/tenants", nil); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without an api key, got %d", code)
+	}
+}
+
+func TestServerTenants(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.SetTenants([]Tenant{{TenantID: "a"}, {TenantID: "b"}})
+
+	var tenants []Tenant
+	if status := get(t, s, "GET", token.APIPrefix+"/tenants", &tenants); status != http.StatusOK {
+		t.Fatalf("tenants status %d", status)
+	}
+	if len(tenants) != 2 || tenants[1].TenantID != "b" {
+		t.Errorf("unexpected tenants %+v", tenants)
+	}
+}
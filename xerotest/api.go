@@ -0,0 +1,186 @@
+package xerotest
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// resource is an accounting api resource, readable with either of its
+// scopes and writable only with the first
+type resource struct {
+	scopes []string
+	body   func(tenant Tenant) any
+}
+
+// resources are the accounting api endpoints implemented by the fake
+var resources = map[string]resource{
+	"Organisation": {
+		scopes: []string{"accounting.settings", "accounting.settings.read"},
+		body: func(t Tenant) any {
+			return map[string]any{"Organisations": []map[string]any{{
+				"OrganisationID": t.TenantID,
+				"Name":           t.TenantName,
+				"BaseCurrency":   "GBP",
+				"CountryCode":    "GB",
+			}}}
+		},
+	},
+	"Invoices": {
+		scopes: []string{"accounting.transactions", "accounting.transactions.read"},
+		body: func(t Tenant) any {
+			return map[string]any{"Invoices": []map[string]any{{
+				"InvoiceID":     "243216c5-369e-4056-ac67-05388f86dc81",
+				"InvoiceNumber": "INV-0001",
+				"Type":          "ACCREC",
+				"Status":        "AUTHORISED",
+				"Total":         115.00,
+				"AmountDue":     115.00,
+				"CurrencyCode":  "GBP",
+			}}}
+		},
+	},
+	"Contacts": {
+		scopes: []string{"accounting.contacts", "accounting.contacts.read"},
+		body: func(t Tenant) any {
+			return map[string]any{"Contacts": []map[string]any{{
+				"ContactID":     "bd2270c3-8706-4c11-9cfb-000b551c3f51",
+				"Name":          "ABC Limited",
+				"ContactStatus": "ACTIVE",
+			}}}
+		},
+	},
+	"Reports/ProfitAndLoss": {
+		scopes: []string{"accounting.reports.read"},
+		body: func(t Tenant) any {
+			return map[string]any{"Reports": []map[string]any{{
+				"ReportID":   "ProfitAndLoss",
+				"ReportName": "Profit and Loss",
+				"ReportType": "ProfitAndLoss",
+			}}}
+		},
+	},
+}
+
+// authorize returns the grant for the request's bearer access token,
+// writing a 401 response if it is missing, unknown or expired; the
+// caller must hold the lock
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) (*grant, bool) {
+	h := r.Header.Get("Authorization")
+	g, ok := s.access[strings.TrimPrefix(h, "Bearer ")]
+	switch {
+	case !strings.HasPrefix(h, "Bearer ") || !ok:
+		writeProblem(w, http.StatusUnauthorized, "AuthenticationUnsuccessful")
+	case s.now().After(g.expiry):
+		writeProblem(w, http.StatusUnauthorized, fmt.Sprintf("TokenExpired: token expired at %s", g.expiry.Format(time.RFC1123)))
+	default:
+		return g, true
+	}
+	return nil, false
+}
+
+// handleConnections lists the tenants connected by the token's
+// authorization
+func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.authorize(w, r)
+	if !ok {
+		return
+	}
+	tenants := make([]Tenant, len(s.tenants))
+	for i, t := range s.tenants {
+		t.AuthEventID = g.authEvent
+		tenants[i] = t
+	}
+	writeJSON(w, http.StatusOK, tenants)
+}
+
+// handleAPI serves the accounting api resources, enforcing scopes, the
+// xero-tenant-id header and rate limits
+func (s *Server) handleAPI(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.authorize(w, r)
+	if !ok {
+		return
+	}
+
+	res, ok := resources[strings.TrimPrefix(r.URL.Path, APIPath)]
+	if !ok {
+		writeProblem(w, http.StatusNotFound, "The resource you're looking for cannot be found")
+		return
+	}
+	allowed := res.scopes
+	if r.Method != http.MethodGet {
+		allowed = res.scopes[:1]
+	}
+	if !slices.ContainsFunc(allowed, func(sc string) bool { return slices.Contains(g.scopes, sc) }) {
+		writeProblem(w, http.StatusForbidden, "AuthorizationUnsuccessful: insufficient scope")
+		return
+	}
+	i := slices.IndexFunc(s.tenants, func(t Tenant) bool {
+		return t.TenantID == r.Header.Get("xero-tenant-id")
+	})
+	if i < 0 {
+		writeProblem(w, http.StatusForbidden, "AuthorizationUnsuccessful: unknown xero-tenant-id")
+		return
+	}
+
+	if !s.rateLimit(w) {
+		return
+	}
+	writeJSON(w, http.StatusOK, res.body(s.tenants[i]))
+}
+
+// rateLimit records an api call and sets Xero's rate limit headers,
+// writing a 429 response if a limit is exceeded; the caller must hold
+// the lock
+func (s *Server) rateLimit(w http.ResponseWriter) bool {
+	now := s.now()
+	s.calls = slices.DeleteFunc(s.calls, func(t time.Time) bool {
+		return now.Sub(t) >= 24*time.Hour
+	})
+	var minute []time.Time
+	for _, t := range s.calls {
+		if now.Sub(t) < time.Minute {
+			minute = append(minute, t)
+		}
+	}
+
+	var problem string
+	var retry time.Duration
+	switch {
+	case len(s.calls) >= s.dayLimit:
+		problem, retry = "day", 24*time.Hour-now.Sub(s.calls[0])
+	case len(minute) >= s.minuteLimit:
+		problem, retry = "minute", time.Minute-now.Sub(minute[0])
+	default:
+		s.calls = append(s.calls, now)
+		minute = append(minute, now)
+	}
+
+	w.Header().Set("X-DayLimit-Remaining", strconv.Itoa(max(s.dayLimit-len(s.calls), 0)))
+	w.Header().Set("X-MinLimit-Remaining", strconv.Itoa(max(s.minuteLimit-len(minute), 0)))
+	w.Header().Set("X-AppMinLimit-Remaining", strconv.Itoa(max(10000-len(minute), 0)))
+	if problem == "" {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+	w.Header().Set("X-Rate-Limit-Problem", problem)
+	writeProblem(w, http.StatusTooManyRequests, "rate limit exceeded")
+	return false
+}
+
+// writeProblem writes a Xero api style error
+func writeProblem(w http.ResponseWriter, status int, detail string) {
+	writeJSON(w, status, map[string]any{
+		"Type":   nil,
+		"Title":  http.StatusText(status),
+		"Status": status,
+		"Detail": detail,
+	})
+}
@@ -0,0 +1,237 @@
+package xerotest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// codeLifetime is the lifetime of an authorization code
+const codeLifetime = 5 * time.Minute
+
+// simulatedUserID is the id of the Xero user who gives consent
+const simulatedUserID = "3f8a6b1e-2c4d-4e5f-8a9b-0c1d2e3f4a5b"
+
+// signingKey signs the fake's access tokens, which are shaped like
+// Xero's jwt access tokens but not otherwise meaningful
+var signingKey = []byte(newID())
+
+// handleAuthorize gives consent automatically, redirecting to the
+// redirect uri with an authorization code and the state
+func (s *Server) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || redirect.Scheme == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if q.Get("client_id") != s.ClientID {
+		http.Error(w, "unauthorized_client", http.StatusBadRequest)
+		return
+	}
+
+	back := redirect.Query()
+	back.Set("state", q.Get("state"))
+	scopes := strings.Fields(q.Get("scope"))
+	switch {
+	case q.Get("response_type") != "code":
+		back.Set("error", "unsupported_response_type")
+	case len(scopes) == 0 || !knownScopes(scopes):
+		back.Set("error", "invalid_scope")
+	default:
+		code := newID()
+		s.mu.Lock()
+		s.codes[code] = &grant{
+			scopes:      scopes,
+			redirectURI: q.Get("redirect_uri"),
+			expiry:      s.now().Add(codeLifetime),
+			authEvent:   newID(),
+		}
+		s.mu.Unlock()
+		back.Set("code", code)
+	}
+	redirect.RawQuery = back.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// Consent follows authURL, an authorization url for the fake such as
+// from token.AuthURL, without a browser, returning the authorization
+// code and state from the redirect
+func (s *Server) Consent(authURL string) (code, state string, err error) {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		return "", "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		return "", "", fmt.Errorf("authorize returned status %d", resp.StatusCode)
+	}
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return "", "", err
+	}
+	q := loc.Query()
+	if e := q.Get("error"); e != "" {
+		return "", "", fmt.Errorf("consent refused: %s", e)
+	}
+	return q.Get("code"), q.Get("state"), nil
+}
+
+// knownScopes reports if all scopes are granted by the fake
+func knownScopes(scopes []string) bool {
+	for _, sc := range scopes {
+		if !slices.Contains(Scopes, sc) {
+			return false
+		}
+	}
+	return true
+}
+
+// tokenResponse is the response of the token endpoint
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+// handleToken exchanges an authorization code or refresh token for a
+// new access token and refresh token
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "invalid_request")
+		return
+	}
+	if !s.clientAuthorized(r) {
+		writeError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+
+	var g grant
+	switch r.PostFormValue("grant_type") {
+	case "authorization_code":
+		code, ok := s.codes[r.PostFormValue("code")]
+		if !ok || now.After(code.expiry) || code.redirectURI != r.PostFormValue("redirect_uri") {
+			writeError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		delete(s.codes, r.PostFormValue("code"))
+		g = *code
+	case "refresh_token":
+		rt, ok := s.refresh[r.PostFormValue("refresh_token")]
+		if !ok || now.After(rt.expiry) || (rt.rotated && now.After(rt.graceEnd)) {
+			writeError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		if !rt.rotated {
+			rt.rotated = true
+			rt.graceEnd = now.Add(s.gracePeriod)
+		}
+		g = rt.grant
+	default:
+		writeError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	access := s.accessToken(g, now)
+	s.access[access] = &grant{scopes: g.scopes, expiry: now.Add(s.accessLifetime), authEvent: g.authEvent}
+	refresh := newID()
+	s.refresh[refresh] = &refreshGrant{grant: grant{
+		scopes:    g.scopes,
+		expiry:    now.Add(s.refreshLifetime),
+		authEvent: g.authEvent,
+	}}
+	writeJSON(w, http.StatusOK, tokenResponse{
+		AccessToken:  access,
+		ExpiresIn:    int(s.accessLifetime.Seconds()),
+		TokenType:    "Bearer",
+		RefreshToken: refresh,
+		Scope:        strings.Join(g.scopes, " "),
+	})
+}
+
+// accessToken returns a new jwt shaped access token; the caller must
+// hold the lock
+func (s *Server) accessToken(g grant, now time.Time) string {
+	enc := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":                     s.URL,
+		"aud":                     s.URL + "/resources",
+		"nbf":                     now.Unix(),
+		"iat":                     now.Unix(),
+		"exp":                     now.Add(s.accessLifetime).Unix(),
+		"client_id":               s.ClientID,
+		"sub":                     simulatedUserID,
+		"xero_userid":             simulatedUserID,
+		"global_session_id":       g.authEvent,
+		"auth_time":               now.Unix(),
+		"authentication_event_id": g.authEvent,
+		"jti":                     newID(),
+		"scope":                   g.scopes,
+	})
+	payload := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte(payload))
+	return payload + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+// clientAuthorized reports if the request has the client credentials
+// as basic authentication
+func (s *Server) clientAuthorized(r *http.Request) bool {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	id, _ = url.QueryUnescape(id)
+	secret, _ = url.QueryUnescape(secret)
+	return id == s.ClientID && secret == s.ClientSecret
+}
+
+// handleRevocation revokes a refresh token, together with the access
+// tokens and connections of its authorization
+func (s *Server) handleRevocation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "invalid_request")
+		return
+	}
+	if !s.clientAuthorized(r) {
+		writeError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rt, ok := s.refresh[r.PostFormValue("token")]
+	if !ok {
+		// as rfc 7009, revoking an unknown token succeeds
+		return
+	}
+	for k, g := range s.refresh {
+		if g.authEvent == rt.authEvent {
+			delete(s.refresh, k)
+		}
+	}
+	for k, g := range s.access {
+		if g.authEvent == rt.authEvent {
+			delete(s.access, k)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+// Package xerotest provides an in-process fake of the Xero identity
+// service and API for integration tests.
+//
+// The fake implements the authorize, token and revocation endpoints of
+// the Xero OAuth2 flow, the connections endpoint and a few accounting
+// API endpoints. Consent is given automatically: the authorize endpoint
+// redirects straight back to the redirect uri with a code. Refresh
+// tokens are rotated on use, with the previous refresh token remaining
+// usable for a grace period, and access and refresh tokens expire
+// according to the fake's clock, which tests can advance. API endpoints
+// enforce scopes and the xero-tenant-id header and report Xero's rate
+// limit headers. Failures can be injected per endpoint.
+//
+//	x := xerotest.NewServer()
+//	defer x.Close()
+//	t, _ := token.NewToken(redirect, scopes, x.AuthURL(), x.TokenURL(), x.ConnectionsURL(), 0)
+//	t.AddClientCredentials(x.ClientID, x.ClientSecret, x.TenantID())
+package xerotest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// Paths of the fake's endpoints, which follow Xero's
+const (
+	AuthorizePath   = "/identity/connect/authorize"
+	TokenPath       = "/connect/token"
+	RevocationPath  = "/connect/revocation"
+	ConnectionsPath = "/connections"
+	APIPath         = "/api.xro/2.0/"
+)
+
+// Endpoints used to inject failures
+const (
+	EndpointAuthorize   = "authorize"
+	EndpointToken       = "token"
+	EndpointRevocation  = "revocation"
+	EndpointConnections = "connections"
+	EndpointAPI         = "api"
+)
+
+// Default client credentials and lifetimes, which follow Xero's
+const (
+	DefaultClientID        = "0123456789ABCDEF0123456789ABCDEF"
+	DefaultClientSecret    = "0123456789abcdef0123456789abcdef0123456789abcdef"
+	DefaultAccessLifetime  = 30 * time.Minute
+	DefaultRefreshLifetime = 60 * 24 * time.Hour
+	DefaultGracePeriod     = 30 * time.Minute
+	DefaultMinuteLimit     = 60
+	DefaultDayLimit        = 5000
+)
+
+// Scopes are the scopes which the fake grants
+var Scopes = []string{
+	"offline_access",
+	"openid",
+	"profile",
+	"email",
+	"accounting.transactions",
+	"accounting.transactions.read",
+	"accounting.reports.read",
+	"accounting.settings",
+	"accounting.settings.read",
+	"accounting.contacts",
+	"accounting.contacts.read",
+}
+
+// Tenant is a Xero organisation connected by consent
+type Tenant struct {
+	ID             string `json:"id"`
+	AuthEventID    string `json:"authEventId"`
+	TenantID       string `json:"tenantId"`
+	TenantType     string `json:"tenantType"`
+	TenantName     string `json:"tenantName"`
+	CreatedDateUTC string `json:"createdDateUtc"`
+	UpdatedDateUTC string `json:"updatedDateUtc"`
+}
+
+// Fault is an injected failure response. If Body is empty a Xero style
+// json error is returned.
+type Fault struct {
+	Status     int
+	Body       string
+	RetryAfter string
+}
+
+// Server is a fake Xero
+type Server struct {
+	*httptest.Server
+
+	// ClientID and ClientSecret are the registered client credentials
+	ClientID     string
+	ClientSecret string
+
+	mu              sync.Mutex
+	offset          time.Duration
+	accessLifetime  time.Duration
+	refreshLifetime time.Duration
+	gracePeriod     time.Duration
+	minuteLimit     int
+	dayLimit        int
+	tenants         []Tenant
+	codes           map[string]*grant
+	access          map[string]*grant
+	refresh         map[string]*refreshGrant
+	faults          map[string][]Fault
+	requests        map[string]int
+	calls           []time.Time // api calls for rate limiting
+}
+
+// grant is an authorization code or access token with its scopes
+type grant struct {
+	scopes      []string
+	redirectURI string
+	expiry      time.Time
+	authEvent   string
+}
+
+// refreshGrant is a refresh token. A rotated refresh token remains
+// usable until its grace period ends.
+type refreshGrant struct {
+	grant
+	rotated  bool
+	graceEnd time.Time
+}
+
+// NewServer starts and returns a fake Xero with one connected tenant.
+// The caller should call Close when finished.
+func NewServer() *Server {
+	s := &Server{
+		ClientID:        DefaultClientID,
+		ClientSecret:    DefaultClientSecret,
+		accessLifetime:  DefaultAccessLifetime,
+		refreshLifetime: DefaultRefreshLifetime,
+		gracePeriod:     DefaultGracePeriod,
+		minuteLimit:     DefaultMinuteLimit,
+		dayLimit:        DefaultDayLimit,
+		codes:           map[string]*grant{},
+		access:          map[string]*grant{},
+		refresh:         map[string]*refreshGrant{},
+		faults:          map[string][]Fault{},
+		requests:        map[string]int{},
+		tenants: []Tenant{{
+			ID:             "c3f3a8d2-7a0e-4bb3-9c2a-8d5e6f7a0b01",
+			TenantID:       "6a2e4d1c-5b3f-4e8a-9d7c-1b2a3c4d5e6f",
+			TenantType:     "ORGANISATION",
+			TenantName:     "Demo Company (Global)",
+			CreatedDateUTC: "2024-01-01T00:00:00.0000000",
+			UpdatedDateUTC: "2024-01-01T00:00:00.0000000",
+		}},
+	}
+	s.Server = httptest.NewServer(s.Handler())
+	return s
+}
+
+// Handler returns the fake's handler, for tests that serve it
+// themselves
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(AuthorizePath, s.endpoint(EndpointAuthorize, s.handleAuthorize))
+	mux.HandleFunc(TokenPath, s.endpoint(EndpointToken, s.handleToken))
+	mux.HandleFunc(RevocationPath, s.endpoint(EndpointRevocation, s.handleRevocation))
+	mux.HandleFunc(ConnectionsPath, s.endpoint(EndpointConnections, s.handleConnections))
+	mux.HandleFunc(APIPath, s.endpoint(EndpointAPI, s.handleAPI))
+	return mux
+}
+
+// AuthURL returns the url of the authorize endpoint
+func (s *Server) AuthURL() string { return s.URL + AuthorizePath }
+
+// TokenURL returns the url of the token endpoint
+func (s *Server) TokenURL() string { return s.URL + TokenPath }
+
+// RevokeURL returns the url of the revocation endpoint
+func (s *Server) RevokeURL() string { return s.URL + RevocationPath }
+
+// ConnectionsURL returns the url of the connections endpoint
+func (s *Server) ConnectionsURL() string { return s.URL + ConnectionsPath }
+
+// TenantID returns the id of the first tenant
+func (s *Server) TenantID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.tenants) == 0 {
+		return ""
+	}
+	return s.tenants[0].TenantID
+}
+
+// SetTenants sets the tenants connected by consent
+func (s *Server) SetTenants(tenants []Tenant) {
+	s.mu.Lock()
+	s.tenants = tenants
+	s.mu.Unlock()
+}
+
+// SetLifetimes sets the lifetimes of access tokens and refresh tokens
+// issued subsequently and the grace period of rotated refresh tokens
+func (s *Server) SetLifetimes(access, refresh, grace time.Duration) {
+	s.mu.Lock()
+	s.accessLifetime, s.refreshLifetime, s.gracePeriod = access, refresh, grace
+	s.mu.Unlock()
+}
+
+// SetRateLimits sets the number of api calls allowed per minute and
+// per day
+func (s *Server) SetRateLimits(perMinute, perDay int) {
+	s.mu.Lock()
+	s.minuteLimit, s.dayLimit = perMinute, perDay
+	s.mu.Unlock()
+}
+
+// Now returns the time on the fake's clock
+func (s *Server) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now()
+}
+
+// now returns the fake's time; the caller must hold the lock
+func (s *Server) now() time.Time {
+	return time.Now().UTC().Add(s.offset)
+}
+
+// Advance moves the fake's clock forward by d, expiring tokens and
+// grace periods without waiting
+func (s *Server) Advance(d time.Duration) {
+	s.mu.Lock()
+	s.offset += d
+	s.mu.Unlock()
+}
+
+// Fail makes the next n requests to endpoint fail with f
+func (s *Server) Fail(endpoint string, f Fault, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < n; i++ {
+		s.faults[endpoint] = append(s.faults[endpoint], f)
+	}
+}
+
+// Requests returns the number of requests made to endpoint
+func (s *Server) Requests(endpoint string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[endpoint]
+}
+
+// endpoint wraps h with request counting and injected failures
+func (s *Server) endpoint(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests[name]++
+		var f *Fault
+		if len(s.faults[name]) > 0 {
+			f = &s.faults[name][0]
+			s.faults[name] = s.faults[name][1:]
+		}
+		s.mu.Unlock()
+
+		if f == nil {
+			h(w, r)
+			return
+		}
+		if f.RetryAfter != "" {
+			w.Header().Set("Retry-After", f.RetryAfter)
+		}
+		if f.Body == "" {
+			writeError(w, f.Status, "server_error")
+			return
+		}
+		w.WriteHeader(f.Status)
+		w.Write([]byte(f.Body))
+	}
+}
+
+// newID returns a random hex identifier
+func newID() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// writeError writes an oauth2 style json error
+func writeError(w http.ResponseWriter, status int, code string) {
+	writeJSON(w, status, map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,236 @@
+package xerotest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// noRedirect is a client which returns redirects rather than following
+// them
+var noRedirect = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// consent runs the authorize endpoint, returning the code
+func consent(t *testing.T, s *Server, scopes string) string {
+	t.Helper()
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {s.ClientID},
+		"redirect_uri":  {"http://localhost/code"},
+		"scope":         {scopes},
+		"state":         {"xyz"},
+	}
+	code, state, err := s.Consent(s.AuthURL() + "?" + q.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != "xyz" {
+		t.Errorf("state not returned: %s", state)
+	}
+	return code
+}
+
+// exchange posts form to the token endpoint
+func exchange(t *testing.T, s *Server, form url.Values) (int, tokenResponse, string) {
+	t.Helper()
+	req, _ := http.NewRequest("POST", s.TokenURL(), strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(s.ClientID, s.ClientSecret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		tokenResponse
+		Error string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode, body.tokenResponse, body.Error
+}
+
+// login consents and exchanges the code for tokens
+func login(t *testing.T, s *Server, scopes string) tokenResponse {
+	t.Helper()
+	code := consent(t, s, scopes)
+	status, tr, errCode := exchange(t, s, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {"http://localhost/code"},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("code exchange failed %d %s", status, errCode)
+	}
+	return tr
+}
+
+// call calls an api path with the access token
+func call(t *testing.T, s *Server, path, access, tenant string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest("GET", s.URL+path, nil)
+	req.Header.Set("Authorization", "Bearer "+access)
+	if tenant != "" {
+		req.Header.Set("xero-tenant-id", tenant)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestCodeExchange(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	code := consent(t, s, "offline_access accounting.transactions")
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {"http://localhost/code"},
+	}
+	status, tr, _ := exchange(t, s, form)
+	if status != http.StatusOK || tr.AccessToken == "" || tr.RefreshToken == "" || tr.ExpiresIn != 1800 {
+		t.Fatalf("unexpected exchange %d %+v", status, tr)
+	}
+	if strings.Count(tr.AccessToken, ".") != 2 {
+		t.Errorf("access token is not jwt shaped: %s", tr.AccessToken)
+	}
+	if tr.Scope != "offline_access accounting.transactions" {
+		t.Errorf("unexpected scope %s", tr.Scope)
+	}
+
+	// codes are single use
+	if status, _, errCode := exchange(t, s, form); status != http.StatusBadRequest || errCode != "invalid_grant" {
+		t.Errorf("expected invalid_grant for a used code, got %d %s", status, errCode)
+	}
+
+	// unknown scopes are refused
+	q := url.Values{"response_type": {"code"}, "client_id": {s.ClientID}, "redirect_uri": {"http://localhost/code"}, "scope": {"payroll.everything"}}
+	resp, err := noRedirect.Get(s.AuthURL() + "?" + q.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !strings.Contains(resp.Header.Get("Location"), "error=invalid_scope") {
+		t.Errorf("expected invalid_scope, got %s", resp.Header.Get("Location"))
+	}
+
+	// bad client credentials
+	req, _ := http.NewRequest("POST", s.TokenURL(), strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(s.ClientID, "wrong")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected invalid_client, got %d", resp.StatusCode)
+	}
+}
+
+func TestRefreshRotation(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	first := login(t, s, "offline_access accounting.transactions")
+
+	refresh := func(rt string) (int, tokenResponse, string) {
+		return exchange(t, s, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {rt}})
+	}
+	status, second, _ := refresh(first.RefreshToken)
+	if status != http.StatusOK || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("refresh token was not rotated %d %+v", status, second)
+	}
+
+	// the rotated refresh token is usable during the grace period
+	s.Advance(DefaultGracePeriod - time.Minute)
+	if status, _, _ := refresh(first.RefreshToken); status != http.StatusOK {
+		t.Errorf("expected the rotated token to be usable in the grace period, got %d", status)
+	}
+	s.Advance(2 * time.Minute)
+	if status, _, errCode := refresh(first.RefreshToken); status != http.StatusBadRequest || errCode != "invalid_grant" {
+		t.Errorf("expected invalid_grant after the grace period, got %d %s", status, errCode)
+	}
+
+	// access tokens expire
+	if resp := call(t, s, ConnectionsPath, second.AccessToken, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected an expired access token, got %d", resp.StatusCode)
+	}
+
+	// refresh tokens expire
+	s.Advance(DefaultRefreshLifetime)
+	if status, _, errCode := refresh(second.RefreshToken); status != http.StatusBadRequest || errCode != "invalid_grant" {
+		t.Errorf("expected invalid_grant for an expired refresh token, got %d %s", status, errCode)
+	}
+}
+
+func TestAPIScopesAndRateLimits(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.SetRateLimits(2, 100)
+	tr := login(t, s, "offline_access accounting.transactions.read")
+	tenant := s.TenantID()
+
+	if resp := call(t, s, APIPath+"Invoices", tr.AccessToken, ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 without a tenant, got %d", resp.StatusCode)
+	}
+	if resp := call(t, s, APIPath+"Organisation", tr.AccessToken, tenant); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 without the settings scope, got %d", resp.StatusCode)
+	}
+
+	resp := call(t, s, APIPath+"Invoices", tr.AccessToken, tenant)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-MinLimit-Remaining") != "1" || resp.Header.Get("X-DayLimit-Remaining") != "99" {
+		t.Errorf("unexpected response %d %v", resp.StatusCode, resp.Header)
+	}
+	call(t, s, APIPath+"Invoices", tr.AccessToken, tenant)
+	resp = call(t, s, APIPath+"Invoices", tr.AccessToken, tenant)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" || resp.Header.Get("X-Rate-Limit-Problem") != "minute" {
+		t.Errorf("expected a minute rate limit, got %d %v", resp.StatusCode, resp.Header)
+	}
+	s.Advance(time.Minute)
+	if resp := call(t, s, APIPath+"Invoices", tr.AccessToken, tenant); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the rate limit to reset, got %d", resp.StatusCode)
+	}
+}
+
+func TestRevocationAndFaults(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	tr := login(t, s, "offline_access accounting.transactions")
+
+	s.Fail(EndpointConnections, Fault{Status: http.StatusServiceUnavailable, RetryAfter: "5"}, 1)
+	resp := call(t, s, ConnectionsPath, tr.AccessToken, "")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "5" {
+		t.Errorf("expected the injected failure, got %d", resp.StatusCode)
+	}
+	if resp := call(t, s, ConnectionsPath, tr.AccessToken, ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected connections, got %d", resp.StatusCode)
+	}
+
+	req, _ := http.NewRequest("POST", s.RevokeURL(), strings.NewReader(url.Values{"token": {tr.RefreshToken}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(s.ClientID, s.ClientSecret)
+	rr, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr.Body.Close()
+	if rr.StatusCode != http.StatusOK {
+		t.Fatalf("revocation failed %d", rr.StatusCode)
+	}
+	if resp := call(t, s, ConnectionsPath, tr.AccessToken, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the access token to be revoked, got %d", resp.StatusCode)
+	}
+	if n := s.Requests(EndpointConnections); n != 3 {
+		t.Errorf("expected 3 connections requests, got %d", n)
+	}
+}